@@ -0,0 +1,254 @@
+// Package checksum parses the checksum files published next to cloud
+// images and computes file digests.
+package checksum
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+)
+
+// Supported algorithms.
+const (
+	MD5    = "md5"
+	SHA1   = "sha1"
+	SHA224 = "sha224"
+	SHA256 = "sha256"
+	SHA384 = "sha384"
+	SHA512 = "sha512"
+)
+
+// sizes maps each algorithm to the length of its digest in bytes.
+var sizes = map[string]int{
+	MD5:    md5.Size,
+	SHA1:   sha1.Size,
+	SHA224: sha256.Size224,
+	SHA256: sha256.Size,
+	SHA384: sha512.Size384,
+	SHA512: sha512.Size,
+}
+
+// bySize maps a digest length in bytes to its algorithm. SHA-224 and
+// SHA-384 are only recognized by name since they are rarely published.
+var bySize = map[int]string{
+	md5.Size:    MD5,
+	sha1.Size:   SHA1,
+	sha256.Size: SHA256,
+	sha512.Size: SHA512,
+}
+
+// New returns a hash computing the digests of the given algorithm.
+func New(algorithm string) (hash.Hash, error) {
+	switch NormalizeAlgorithm(algorithm) {
+	case MD5:
+		return md5.New(), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA224:
+		return sha256.New224(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case SHA384:
+		return sha512.New384(), nil
+	case SHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+}
+
+// NormalizeAlgorithm returns the name of an algorithm as spelled in a
+// checksum file, such as "SHA256", "SHA-256" or "SHA2-256", in the form of
+// the constants of this package. Unknown algorithms are returned lowercased.
+func NormalizeAlgorithm(name string) string {
+	n := strings.ToLower(strings.TrimSpace(name))
+	n = strings.TrimPrefix(n, "sha2-")
+	n = strings.ReplaceAll(n, "-", "")
+	switch n {
+	case "224", "256", "384", "512":
+		return "sha" + n
+	}
+	return n
+}
+
+// Entry is the checksum of a single file.
+type Entry struct {
+	// Algorithm is the algorithm named by the checksum file, or empty if
+	// the format does not name it.
+	Algorithm string
+	// Digest is the checksum as written in the file, hex or base64.
+	Digest string
+	// Filename is the file the checksum applies to. It is empty for
+	// checksum files holding a single bare digest.
+	Filename string
+}
+
+// Parser recognizes one checksum file format.
+type Parser struct {
+	// Name identifies the format in error messages.
+	Name string
+	// Parse returns the entries found in the lines of a checksum file.
+	// Lines that are not in its format are ignored.
+	Parse func(lines []string) []Entry
+}
+
+// registry holds the parsers in the order they are tried.
+var registry []Parser
+
+// Register adds a parser, tried after the ones already registered.
+func Register(p Parser) {
+	registry = append(registry, p)
+}
+
+// Parsers returns the registered parsers in the order they are tried.
+func Parsers() []Parser {
+	return append([]Parser(nil), registry...)
+}
+
+// Lookup finds the checksum of filename in the contents of a checksum file
+// and returns its algorithm and lowercase hex digest. Clearsigned files are
+// unwrapped first; the signature itself is not checked. source is the name
+// or URL of the checksum file: when the format does not name the algorithm,
+// it is taken from names such as SHA256SUMS or image.qcow2.sha512, and only
+// then guessed from the length of the digest.
+func Lookup(data []byte, filename, source string) (algorithm, digest string, err error) {
+	lines := strings.Split(string(Unwrap(data)), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+
+	for _, p := range registry {
+		for _, e := range p.Parse(lines) {
+			if e.Filename != "" && e.Filename != filename && path.Base(e.Filename) != filename {
+				continue
+			}
+			algorithm, digest, err := resolve(e, source)
+			if err != nil {
+				return "", "", fmt.Errorf("%s checksum of %s: %w", p.Name, filename, err)
+			}
+			return algorithm, digest, nil
+		}
+	}
+	return "", "", fmt.Errorf("checksum for %s not found in checksum file", filename)
+}
+
+// Parse parses a checksum written as "algorithm:digest", such as
+// "sha256:5a1b...", and returns its algorithm and lowercase hex digest.
+// Without an algorithm, it is guessed from the length of the digest.
+func Parse(s string) (algorithm, digest string, err error) {
+	e := Entry{Digest: strings.TrimSpace(s)}
+	if algo, d, ok := strings.Cut(e.Digest, ":"); ok {
+		e.Algorithm, e.Digest = algo, d
+	}
+	return resolve(e, "")
+}
+
+// Format returns a checksum in the form accepted by Parse.
+func Format(algorithm, digest string) string {
+	return algorithm + ":" + digest
+}
+
+// resolve decodes the digest of an entry and determines its algorithm.
+func resolve(e Entry, source string) (string, string, error) {
+	raw, ok := decodeDigest(e.Digest)
+	if !ok {
+		return "", "", fmt.Errorf("invalid digest %q", e.Digest)
+	}
+	algorithm := NormalizeAlgorithm(e.Algorithm)
+	if algorithm == "" {
+		algorithm = algorithmFromName(source)
+	}
+	if algorithm == "" {
+		if algorithm = bySize[len(raw)]; algorithm == "" {
+			return "", "", fmt.Errorf("unsupported checksum length: %d", len(e.Digest))
+		}
+	}
+	size, ok := sizes[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+	if len(raw) != size {
+		return "", "", fmt.Errorf("%s digest has %d bytes, expected %d", algorithm, len(raw), size)
+	}
+	return algorithm, hex.EncodeToString(raw), nil
+}
+
+// algorithmFromName returns the algorithm named by a checksum file name,
+// or "" if the name does not tell.
+func algorithmFromName(source string) string {
+	name := strings.ToLower(path.Base(source))
+	for _, algorithm := range []string{SHA512, SHA384, SHA256, SHA224, SHA1, MD5} {
+		if strings.Contains(name, algorithm) {
+			return algorithm
+		}
+	}
+	return ""
+}
+
+// decodeDigest decodes a hex or base64 digest of a supported length.
+func decodeDigest(s string) ([]byte, bool) {
+	if raw, err := hex.DecodeString(s); err == nil && knownSize(len(raw)) {
+		return raw, true
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if raw, err := enc.DecodeString(s); err == nil && knownSize(len(raw)) {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// knownSize reports whether n is the digest length of a supported algorithm.
+func knownSize(n int) bool {
+	for _, size := range sizes {
+		if n == size {
+			return true
+		}
+	}
+	return false
+}
+
+// isDigest reports whether s looks like a hex or base64 digest.
+func isDigest(s string) bool {
+	_, ok := decodeDigest(s)
+	return ok
+}
+
+// PGP armor markers of a clearsigned message.
+const (
+	signedHeader    = "-----BEGIN PGP SIGNED MESSAGE-----"
+	signatureHeader = "-----BEGIN PGP SIGNATURE-----"
+)
+
+// Unwrap returns the signed text of a clearsigned message, undoing the dash
+// escaping of its lines. Any other data is returned unchanged.
+func Unwrap(data []byte) []byte {
+	start := bytes.Index(data, []byte(signedHeader))
+	if start < 0 {
+		return data
+	}
+	lines := strings.Split(string(data[start+len(signedHeader):]), "\n")
+	// Skip the rest of the marker line and the armor headers, such as
+	// "Hash: SHA256", up to the first empty line.
+	i := 1
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+		i++
+	}
+	i++
+	var text []string
+	for ; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r")
+		if line == signatureHeader {
+			break
+		}
+		text = append(text, strings.TrimPrefix(line, "- "))
+	}
+	return []byte(strings.Join(text, "\n"))
+}
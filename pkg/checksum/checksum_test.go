@@ -0,0 +1,136 @@
+package checksum
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		filename  string
+		algorithm string
+		digest    string
+	}{
+		{"Ubuntu 24.04", "ubuntu2404-SHA256SUMS", "noble-server-cloudimg-amd64.img", SHA256,
+			"36607ddfcc602d0128ecbc04eeeced628733fd464afe6e529c2a3cc150ab2ef9"},
+		{"Debian 13", "debian13-SHA512SUMS", "debian-13-generic-amd64.qcow2", SHA512,
+			"7c5bf5d6d0f99329f7f6e4f23a1e2f1a53bc9c276e6007ac6180c1476806ffb4e53602b9341537b6d252e214456d1b3cd83c6bebd0b626cd16da1cb04d7a5c1c"},
+		{"Debian 13 other variant", "debian13-SHA512SUMS", "debian-13-genericcloud-amd64.raw", SHA512,
+			"e17098a7f3b1eb496271ff4a04293e91af966a3b70770d8666bae47e559b563dafabdba5e2ef29643862e13709d40f139cd804b692a3d184eadecdbadc597f66"},
+		{"Debian 12", "debian12-SHA512SUMS", "debian-12-generic-amd64.qcow2", SHA512,
+			"01630e381d54b1c6e9e03b32dd5c55ff79266504b13867d9006d5076808c4ce307f829db88315337ba9b26342e57bf736fcf63c8c4872bd8f2d407283580cbdb"},
+		{"AlmaLinux 10", "alma10-CHECKSUM", "AlmaLinux-10-GenericCloud-latest.x86_64_v2.qcow2", SHA256,
+			"4ca87d540ac9c820c8d1f01fece0c03d8798fe829e1a8d57a98fdd115de6f06e"},
+		{"AlmaLinux 9", "alma9-CHECKSUM", "AlmaLinux-9-GenericCloud-9.6-20250522.x86_64.qcow2", SHA256,
+			"a74966dea9e539bb1a3fe790ebdf76d83c164448e09266c0c434630ae735f237"},
+		{"Fedora 42, clearsigned", "fedora42-CHECKSUM", "Fedora-Cloud-Base-Generic-42-1.1.x86_64.qcow2", SHA256,
+			"ad98f6b3d23218e67b518c8312bce1a6439d06c19867cea14c3b3fa3381c68ab"},
+		{"Rocky 10", "rocky10-CHECKSUM", "Rocky-10-GenericCloud-Base-10.0-20250609.1.x86_64.qcow2", SHA256,
+			"4404f43e7048289cbd77785f1412d0dc22cad7a570bf0950221065f0da7ac811"},
+		{"Rocky 9, clearsigned", "rocky9-CHECKSUM", "Rocky-9-GenericCloud-Base-9.6-20250531.0.x86_64.qcow2", SHA256,
+			"eb5aadb6a290e5cd94812f6f02c1fe1cb5b6e4d5f700edc692d1f840d92b1314"},
+		{"single digest", "image.qcow2.sha256", "image.qcow2", SHA256,
+			"c291d6f27ebf8d5edebf88802508bf876fb38e8354a571ea1beee27ba6bfb6df"},
+		{"single digest for any file", "image.qcow2.sha256", "renamed.qcow2", SHA256,
+			"c291d6f27ebf8d5edebf88802508bf876fb38e8354a571ea1beee27ba6bfb6df"},
+		{"base64 tagged pair", "tagged.txt", "openEuler-24.03-LTS-x86_64.qcow2.xz", SHA256,
+			"6b101f376ed77c456446a163171d9cf2722a81573cb64747e420d6be2c0c7fd1"},
+		{"algorithm from the file name", "SHA224SUMS", "image.qcow2", SHA224,
+			"7b679374a1dc7de9d3e8bacc34a4cd618ba8a04a104ee86b2e0e1b4a"},
+		{"algorithm from the digest length", "checksums.txt", "image.qcow2", SHA512,
+			"5de3249f6ae6b4d71310c8f0d2fea643eb5b0adcbf91e8501a90f71865386f66004076d8e17b290360b68b53188fd50523b5ab64703fdeb3736cfe32e7056838"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			algorithm, digest, err := Lookup(data, tt.filename, "https://mirror.example.com/images/"+tt.file)
+			if err != nil {
+				t.Fatalf("Lookup: %v", err)
+			}
+			if algorithm != tt.algorithm || digest != tt.digest {
+				t.Errorf("Lookup = %s:%s, want %s:%s", algorithm, digest, tt.algorithm, tt.digest)
+			}
+		})
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		filename string
+		want     string
+	}{
+		{"digest longer than the algorithm of the file name", "mismatch-SHA256SUMS", "image.qcow2", "GNU checksum of image.qcow2: sha256 digest has 64 bytes, expected 32"},
+		{"digest shorter than the algorithm of the line", "mismatch-CHECKSUM", "image.qcow2", "BSD checksum of image.qcow2: sha256 digest has 20 bytes, expected 32"},
+		{"missing file", "debian13-SHA512SUMS", "debian-13-generic-arm64.qcow2", "checksum for debian-13-generic-arm64.qcow2 not found in checksum file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = Lookup(data, tt.filename, tt.file)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Lookup error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	digest := "c291d6f27ebf8d5edebf88802508bf876fb38e8354a571ea1beee27ba6bfb6df"
+	tests := []struct {
+		in        string
+		algorithm string
+		wantErr   string
+	}{
+		{"sha256:" + digest, SHA256, ""},
+		{"SHA-256:" + strings.ToUpper(digest), SHA256, ""},
+		{digest, SHA256, ""},
+		{"sha512:" + digest, "", "sha512 digest has 32 bytes, expected 64"},
+		{"sha256:" + digest[:10], "", "invalid digest"},
+		{"whirlpool:" + digest, "", "unsupported algorithm: whirlpool"},
+	}
+	for _, tt := range tests {
+		algorithm, got, err := Parse(tt.in)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Parse(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("Parse(%q): %v", tt.in, err)
+		case algorithm != tt.algorithm || got != digest:
+			t.Errorf("Parse(%q) = %s:%s, want %s:%s", tt.in, algorithm, got, tt.algorithm, digest)
+		}
+	}
+}
+
+func TestUnwrap(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "rocky9-CHECKSUM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(Unwrap(data))
+	if strings.Contains(text, "PGP") || strings.Contains(text, "Hash:") {
+		t.Errorf("Unwrap kept the armor:\n%s", text)
+	}
+	if !strings.HasPrefix(text, "# Rocky-9-GenericCloud-Base-9.6-20250531.0.x86_64.qcow2: ") {
+		t.Errorf("Unwrap did not start at the signed text:\n%s", text)
+	}
+
+	// Lines starting with a dash are escaped by the signer.
+	signed := "-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\n- -----BEGIN NOTE-----\nline\n-----BEGIN PGP SIGNATURE-----\n\nsig\n-----END PGP SIGNATURE-----\n"
+	if text := string(Unwrap([]byte(signed))); !strings.HasPrefix(text, "-----BEGIN NOTE-----\nline") {
+		t.Errorf("Unwrap did not undo dash escaping:\n%s", text)
+	}
+}
@@ -0,0 +1,89 @@
+package checksum
+
+import (
+	"regexp"
+	"strings"
+)
+
+func init() {
+	Register(Parser{Name: "BSD", Parse: parseBSD})
+	Register(Parser{Name: "GNU", Parse: parseGNU})
+	Register(Parser{Name: "tagged pair", Parse: parsePairs})
+	Register(Parser{Name: "single digest", Parse: parseSingle})
+}
+
+// bsdLine matches the output of BSD tools and `sha256sum --tag`:
+//
+//	SHA256 (Rocky-9-GenericCloud-Base.latest.x86_64.qcow2) = 5a1b...
+var bsdLine = regexp.MustCompile(`^([A-Za-z0-9-]+) ?\((.+)\) ?= ?(\S+)$`)
+
+// parseBSD parses "ALGO (file) = digest" lines, as published by Fedora,
+// Rocky Linux and AlmaLinux.
+func parseBSD(lines []string) []Entry {
+	var entries []Entry
+	for _, line := range lines {
+		m := bsdLine.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		entries = append(entries, Entry{Algorithm: m[1], Digest: m[3], Filename: m[2]})
+	}
+	return entries
+}
+
+// parseGNU parses "digest  file" lines, as written by sha256sum and
+// published by Ubuntu and Debian. Binary mode ("digest *file") is accepted.
+func parseGNU(lines []string) []Entry {
+	var entries []Entry
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		digest, file, ok := strings.Cut(line, " ")
+		if !ok || !isDigest(digest) {
+			continue
+		}
+		file = strings.TrimPrefix(strings.TrimLeft(file, " "), "*")
+		file = strings.TrimPrefix(file, "./")
+		if file == "" {
+			continue
+		}
+		entries = append(entries, Entry{Digest: digest, Filename: file})
+	}
+	return entries
+}
+
+// pairTag matches the digest line following a "## file" line:
+//
+//	SHA256: 5a1b...
+var pairTag = regexp.MustCompile(`^([A-Za-z0-9-]+): ?(\S+)$`)
+
+// parsePairs parses a "## file" line followed by an "ALGO: digest" line.
+func parsePairs(lines []string) []Entry {
+	var entries []Entry
+	for i := 0; i+1 < len(lines); i++ {
+		file, ok := strings.CutPrefix(strings.TrimSpace(lines[i]), "## ")
+		if !ok {
+			continue
+		}
+		m := pairTag.FindStringSubmatch(strings.TrimSpace(lines[i+1]))
+		if m == nil {
+			continue
+		}
+		entries = append(entries, Entry{Algorithm: m[1], Digest: m[2], Filename: strings.TrimSpace(file)})
+		i++
+	}
+	return entries
+}
+
+// parseSingle accepts a file holding nothing but one digest, such as the
+// .sha256 files published next to some images. The digest applies to any
+// file name.
+func parseSingle(lines []string) []Entry {
+	fields := strings.Fields(strings.Join(lines, "\n"))
+	if len(fields) != 1 || !isDigest(fields[0]) {
+		return nil
+	}
+	return []Entry{{Digest: fields[0]}}
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aloks98/pve-ctgen/pkg/generator"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/ui"
+
+	"golang.org/x/term"
+)
+
+func runBuild(args []string) int {
+	fs := newFlagSet("build")
+	paths := addPathFlags(fs)
+	selection := addSelectionFlags(fs)
+	yes := fs.Bool("yes", false, "start building without showing the image checklist in the interactive UI")
+	noTUI := fs.Bool("no-tui", false, "disable the interactive UI and print line-oriented progress")
+	jsonOutput := fs.Bool("json", false, "print progress events as JSON lines (implies --no-tui)")
+	dryRun := fs.Bool("dry-run", false, "show what would be done without downloading or executing anything (implies --no-tui)")
+	parallel := fs.Int("parallel", 1, "number of images to download and build concurrently")
+	eventLog := fs.String("event-log", "", "append progress events as JSON lines to `file`")
+	locked := fs.Bool("locked", false, "build exactly the image URLs and checksums recorded in the lock file, failing on drift")
+	force := fs.Bool("force", false, "rebuild templates whose image, steps and cloud-init file are unchanged since their last build")
+	skipSpaceCheck := fs.Bool("skip-space-check", false, "start building without checking that the images fit in the ISO directory, work directory and storages")
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+
+	opts := generator.Options{Paths: paths.Paths(), Selection: *selection, DryRun: *dryRun, Parallel: *parallel, Locked: *locked, Force: *force, SkipSpaceCheck: *skipSpaceCheck}
+
+	var sinks report.Multi
+	if *eventLog != "" {
+		f, err := os.OpenFile(*eventLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening event log: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		sinks = append(sinks, report.NewJSON(f))
+	}
+
+	// Fall back to plain output when not attached to a terminal, e.g. when
+	// running from cron, a systemd timer or CI.
+	if *noTUI || *jsonOutput || *dryRun || !term.IsTerminal(int(os.Stdout.Fd())) {
+		if *jsonOutput {
+			sinks = append(sinks, report.NewJSON(os.Stdout))
+		} else {
+			sinks = append(sinks, report.NewConsole(os.Stdout, os.Stderr))
+		}
+		if err := generator.Run(opts, sinks); err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	ui := ui.NewUI()
+	sinks = append(sinks, ui)
+	if !*yes {
+		opts.ChooseImages = ui.ChooseImages
+	}
+	if err := ui.Run(func() error { return generator.Run(opts, sinks) }); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+func runCache(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "ls":
+			return runCacheList(args[1:])
+		case "prune":
+			return runCachePrune(args[1:])
+		case "help", "-h", "-help", "--help":
+			cacheUsage(os.Stdout)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "unknown cache command %q\n\n", args[0])
+	}
+	cacheUsage(os.Stderr)
+	return 2
+}
+
+func cacheUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: pve-ctgen cache <command> [flags]\n\nCommands:\n")
+	fmt.Fprintf(w, "  %-14s %s\n", "ls", "list the cached images")
+	fmt.Fprintf(w, "  %-14s %s\n", "prune", "apply the retention rules to the cache")
+}
+
+func runCacheList(args []string) int {
+	fs := newFlagSet("cache ls")
+	paths := addPathFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	cache := utils.Cache{Dir: paths.Paths().ISODir}
+	index, err := cache.LoadIndex()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+
+	entries := index.Entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].UsedAt.After(entries[j].UsedAt)
+	})
+	var live []types.CacheEntry
+	for _, entry := range entries {
+		if _, ok := cache.Lookup(entry.Checksum); ok {
+			live = append(live, entry)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCHECKSUM\tSIZE\tLAST USED\tURL")
+	for _, entry := range live {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Name, shortChecksum(entry.Checksum), utils.FormatSize(entry.Size), entry.UsedAt.Local().Format(time.DateTime), entry.URL)
+	}
+	w.Flush()
+	fmt.Printf("%d image(s), %s in %s\n", len(live), utils.FormatSize(utils.CacheSize(live)), cache.Dir)
+	return 0
+}
+
+func runCachePrune(args []string) int {
+	fs := newFlagSet("cache prune")
+	paths := addPathFlags(fs)
+	keep := fs.Int("keep", 0, "number of images kept per image name (default from the settings file)")
+	maxSize := fs.String("max-size", "", "maximum total `size` of the cache, e.g. 20G (default from the settings file)")
+	dryRun := fs.Bool("dry-run", false, "show what would be removed without removing anything")
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	p := paths.Paths()
+
+	settings, err := utils.LoadSettings(p.SettingsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	policy := settings.Cache
+	if *keep != 0 {
+		policy.Keep = *keep
+	}
+	if *maxSize != "" {
+		policy.MaxSize = *maxSize
+	}
+
+	cache := utils.Cache{Dir: p.ISODir}
+	removed, freed, err := cache.Prune(policy, *dryRun)
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, entry := range removed {
+		name := entry.Name
+		if name == "" {
+			name = "(unreferenced)"
+		}
+		fmt.Printf("%s %s %s (%s)\n", verb, name, shortChecksum(entry.Checksum), utils.FormatSize(entry.Size))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	if *dryRun {
+		fmt.Printf("Would free %s\n", utils.FormatSize(freed))
+	} else {
+		fmt.Println(style.Green(fmt.Sprintf("Freed %s", utils.FormatSize(freed))))
+	}
+	return 0
+}
+
+// shortChecksum abbreviates the digest of a checksum for display.
+func shortChecksum(sum string) string {
+	if len(sum) > 23 {
+		return sum[:23]
+	}
+	return sum
+}
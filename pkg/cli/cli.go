@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+// command is a pve-ctgen subcommand.
+type command struct {
+	Name    string
+	Summary string
+	Run     func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{Name: "build", Summary: "download images and build Proxmox templates (default)", Run: runBuild},
+		{Name: "validate", Summary: "check the configuration files without building", Run: runValidate},
+		{Name: "list", Summary: "list the configured images", Run: runList},
+		{Name: "lock", Summary: "pin the URL and checksum of every image in the lock file", Run: runLock},
+		{Name: "cache", Summary: "list the cached images (ls) or apply the retention rules (prune)", Run: runCache},
+		{Name: "check-updates", Summary: "report the images whose upstream checksum changed since they were built", Run: runCheckUpdates},
+		{Name: "help", Summary: "show this help", Run: runHelp},
+	}
+}
+
+// Run parses the command line and executes the selected subcommand. It
+// returns the process exit status.
+func Run(args []string) int {
+	// Without a subcommand behave like earlier releases and build everything.
+	if len(args) == 0 || (len(args[0]) > 0 && args[0][0] == '-') {
+		return runBuild(args)
+	}
+	for _, cmd := range commands {
+		if cmd.Name == args[0] {
+			return cmd.Run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage(os.Stderr)
+	return 2
+}
+
+func runHelp(args []string) int {
+	usage(os.Stdout)
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: pve-ctgen <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-14s %s\n", cmd.Name, cmd.Summary)
+	}
+	fmt.Fprintf(w, "\nRun 'pve-ctgen <command> -h' for the flags of a command.\n")
+}
+
+// newFlagSet creates a flag set for a subcommand that prints errors
+// instead of exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("pve-ctgen "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// pathFlags registers the flags for every path used by a run. Each flag
+// defaults to an environment variable, falling back to the historical
+// location relative to the working directory.
+type pathFlags struct {
+	configDir  string
+	imagesFile string
+	stepsFile  string
+	settings   string
+	lockFile   string
+	stateFile  string
+	keyringDir string
+	paths      types.Paths
+}
+
+func addPathFlags(fs *flag.FlagSet) *pathFlags {
+	p := &pathFlags{}
+	fs.StringVar(&p.configDir, "config-dir", envOr("PVE_CTGEN_CONFIG_DIR", "config"), "directory containing os_list.json, steps.json and settings.json [$PVE_CTGEN_CONFIG_DIR]")
+	fs.StringVar(&p.imagesFile, "images", os.Getenv("PVE_CTGEN_IMAGES"), "image list `file` (default <config-dir>/os_list.json) [$PVE_CTGEN_IMAGES]")
+	fs.StringVar(&p.stepsFile, "steps", os.Getenv("PVE_CTGEN_STEPS"), "step list `file` (default <config-dir>/steps.json) [$PVE_CTGEN_STEPS]")
+	fs.StringVar(&p.settings, "settings", os.Getenv("PVE_CTGEN_SETTINGS"), "global settings `file` (default <config-dir>/settings.json) [$PVE_CTGEN_SETTINGS]")
+	fs.StringVar(&p.lockFile, "lock-file", os.Getenv("PVE_CTGEN_LOCK_FILE"), "lock `file` pinning image URLs and checksums (default <images>.lock.json) [$PVE_CTGEN_LOCK_FILE]")
+	fs.StringVar(&p.stateFile, "state-file", os.Getenv("PVE_CTGEN_STATE_FILE"), "`file` recording the checksum of every built template (default <work-dir>/pve-ctgen.state.json) [$PVE_CTGEN_STATE_FILE]")
+	fs.StringVar(&p.keyringDir, "keyring-dir", os.Getenv("PVE_CTGEN_KEYRING_DIR"), "`directory` containing the GPG keyrings of images (default <config-dir>/keys) [$PVE_CTGEN_KEYRING_DIR]")
+	fs.StringVar(&p.paths.CloudInitDir, "cloudinit-dir", envOr("PVE_CTGEN_CLOUDINIT_DIR", "cloudinit"), "directory containing cloud-init vendor files [$PVE_CTGEN_CLOUDINIT_DIR]")
+	fs.StringVar(&p.paths.ISODir, "iso-dir", envOr("PVE_CTGEN_ISO_DIR", "/var/lib/vz/template/iso"), "directory holding the cache of downloaded images [$PVE_CTGEN_ISO_DIR]")
+	fs.StringVar(&p.paths.SnippetsDir, "snippets-dir", envOr("PVE_CTGEN_SNIPPETS_DIR", "/var/lib/vz/snippets"), "Proxmox snippets directory [$PVE_CTGEN_SNIPPETS_DIR]")
+	fs.StringVar(&p.paths.LogDir, "log-dir", envOr("PVE_CTGEN_LOG_DIR", "logs"), "directory for per-image error logs [$PVE_CTGEN_LOG_DIR]")
+	fs.StringVar(&p.paths.WorkDir, "work-dir", envOr("PVE_CTGEN_WORK_DIR", "."), "directory for scratch disk images [$PVE_CTGEN_WORK_DIR]")
+	return p
+}
+
+// Paths returns the resolved paths once the flags have been parsed.
+func (p *pathFlags) Paths() types.Paths {
+	paths := p.paths
+	paths.ImagesFile = p.imagesFile
+	if paths.ImagesFile == "" {
+		paths.ImagesFile = filepath.Join(p.configDir, "os_list.json")
+	}
+	paths.StepsFile = p.stepsFile
+	if paths.StepsFile == "" {
+		paths.StepsFile = filepath.Join(p.configDir, "steps.json")
+	}
+	paths.SettingsFile = p.settings
+	if paths.SettingsFile == "" {
+		paths.SettingsFile = filepath.Join(p.configDir, "settings.json")
+	}
+	paths.LockFile = p.lockFile
+	if paths.LockFile == "" {
+		paths.LockFile = strings.TrimSuffix(paths.ImagesFile, ".json") + ".lock.json"
+	}
+	paths.StateFile = p.stateFile
+	if paths.StateFile == "" {
+		paths.StateFile = filepath.Join(paths.WorkDir, "pve-ctgen.state.json")
+	}
+	paths.KeyringDir = p.keyringDir
+	if paths.KeyringDir == "" {
+		paths.KeyringDir = filepath.Join(p.configDir, "keys")
+	}
+	return paths
+}
+
+// listFlag is a repeatable flag accepting comma-separated values.
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// addSelectionFlags registers the flags used to pick a subset of images.
+func addSelectionFlags(fs *flag.FlagSet) *utils.Selection {
+	sel := &utils.Selection{}
+	fs.Var((*listFlag)(&sel.Only), "only", "build only the images with these comma-separated `names or IDs`")
+	fs.Var((*listFlag)(&sel.Tags), "tag", "build only the images carrying one of these comma-separated `tags` (and listed by --only, if given)")
+	fs.Var((*listFlag)(&sel.Exclude), "exclude", "skip the images with these comma-separated `names, IDs or tags`")
+	return sel
+}
+
+// flagExit returns the exit status for a flag parsing error.
+func flagExit(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
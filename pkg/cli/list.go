@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+func runList(args []string) int {
+	fs := newFlagSet("list")
+	paths := addPathFlags(fs)
+	selection := addSelectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+
+	images, err := utils.LoadImages(paths.Paths().ImagesFile)
+	if err == nil {
+		images, err = utils.SelectImages(images, *selection)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tVENDOR\tTAGS\tURL")
+	for _, img := range images {
+		var url string
+		if img.Resolver != nil {
+			url = fmt.Sprintf("%s (%s resolver)", img.Resolver.URL, img.Resolver.Type)
+		} else if sources := utils.ImageSources(img); len(sources) > 0 {
+			url = sources[0].URL
+			if len(sources) > 1 {
+				url += fmt.Sprintf(" (+%d mirror(s))", len(sources)-1)
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", img.ID, img.Name, img.Vendor, img.Tags, url)
+	}
+	w.Flush()
+	return 0
+}
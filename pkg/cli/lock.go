@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+func runLock(args []string) int {
+	fs := newFlagSet("lock")
+	paths := addPathFlags(fs)
+	selection := addSelectionFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	p := paths.Paths()
+
+	all, err := utils.LoadImages(p.ImagesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	settings, err := utils.LoadSettings(p.SettingsFile)
+	if err == nil {
+		err = utils.ConfigureHTTP(settings.HTTP)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	retry, err := utils.NewRetry(settings.Retry.Download)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	images, err := utils.SelectImages(all, *selection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+
+	// Images that are not selected keep their current entry.
+	previous := make(map[string]types.LockedImage)
+	if old, err := utils.LoadLock(p.LockFile); err == nil {
+		for _, entry := range old.Images {
+			previous[entry.Name] = entry
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+
+	selected := make(map[string]bool)
+	for _, img := range images {
+		selected[img.Name] = true
+	}
+
+	var lock types.LockFile
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCHECKSUM\tURL")
+	for _, img := range all {
+		if !selected[img.Name] {
+			if entry, ok := previous[img.Name]; ok {
+				lock.Images = append(lock.Images, entry)
+			}
+			continue
+		}
+		entry, err := utils.LockImage(img, p.KeyringDir, retry)
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, style.Red(fmt.Sprintf("%s: %v", img.Name, err)))
+			continue
+		}
+		lock.Images = append(lock.Images, entry)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", entry.Name, entry.Checksum, entry.URLs[0])
+	}
+	w.Flush()
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d image(s) could not be locked, %s was not written\n", failed, p.LockFile)
+		return 1
+	}
+	if err := utils.WriteLock(p.LockFile, lock); err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	fmt.Println(style.Green(fmt.Sprintf("Wrote %s", p.LockFile)))
+	return 0
+}
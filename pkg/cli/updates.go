@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+// staleExit is the exit status of check-updates --exit-code when a
+// template must be rebuilt.
+const staleExit = 3
+
+func runCheckUpdates(args []string) int {
+	fs := newFlagSet("check-updates")
+	paths := addPathFlags(fs)
+	selection := addSelectionFlags(fs)
+	exitCode := fs.Bool("exit-code", false, fmt.Sprintf("exit with status %d if any template is stale or was never built", staleExit))
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	p := paths.Paths()
+
+	all, err := utils.LoadImages(p.ImagesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	settings, err := utils.LoadSettings(p.SettingsFile)
+	if err == nil {
+		err = utils.ConfigureHTTP(settings.HTTP)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	retry, err := utils.NewRetry(settings.Retry.Download)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	images, err := utils.SelectImages(all, *selection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	state, err := utils.LoadState(p.StateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	built := utils.BuiltImages(state)
+
+	var stale []string
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTEMPLATE\tCACHE\tUPSTREAM\tURL")
+	for _, img := range images {
+		var last *types.BuiltImage
+		if entry, ok := built[img.Name]; ok {
+			last = &entry
+		}
+		check, err := utils.CheckUpdate(img, last, p, retry)
+		if err != nil {
+			failed++
+			fmt.Fprintln(os.Stderr, style.Red(fmt.Sprintf("%s: %v", img.Name, err)))
+			continue
+		}
+		if check.Stale() {
+			stale = append(stale, img.Name)
+		}
+		upstream := check.Upstream
+		if upstream == "" {
+			upstream = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", check.Name, check.Template, check.Cache, upstream, check.URL)
+	}
+	w.Flush()
+
+	if len(stale) > 0 {
+		fmt.Println(style.Yellow(fmt.Sprintf("%d template(s) out of date: %s", len(stale), strings.Join(stale, ", "))))
+	} else if failed == 0 {
+		fmt.Println(style.Green("All templates are up to date"))
+	}
+	switch {
+	case failed > 0:
+		fmt.Fprintf(os.Stderr, "%d image(s) could not be checked\n", failed)
+		return 1
+	case *exitCode && len(stale) > 0:
+		return staleExit
+	}
+	return 0
+}
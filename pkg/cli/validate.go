@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+func runValidate(args []string) int {
+	fs := newFlagSet("validate")
+	paths := addPathFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return flagExit(err)
+	}
+	p := paths.Paths()
+
+	images, err := utils.LoadImages(p.ImagesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+	pipelines, err := utils.LoadPipelines(p.StepsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+
+	settings, err := utils.LoadSettings(p.SettingsFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		return 1
+	}
+
+	if err := utils.ValidateConfig(p, settings, images, pipelines); err != nil {
+		var errs utils.ValidationErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, style.Red(e.Error()))
+			}
+			fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(errs))
+		} else {
+			fmt.Fprintln(os.Stderr, style.Red(err.Error()))
+		}
+		return 1
+	}
+
+	fmt.Printf("%s: %d image(s)\n", p.ImagesFile, len(images))
+	for _, name := range utils.PipelineNames(pipelines) {
+		fmt.Printf("%s: pipeline %q, %d step(s)\n", p.StepsFile, name, len(pipelines[name]))
+	}
+	fmt.Println(style.Green("Configuration OK"))
+	return 0
+}
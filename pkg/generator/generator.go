@@ -1,133 +1,364 @@
 package generator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/aloks98/pve-ctgen/pkg/style"
-	"github.com/aloks98/pve-ctgen/pkg/ui"
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
 	"github.com/aloks98/pve-ctgen/pkg/utils"
-	"github.com/gdamore/tcell/v2"
-	"github.com/rivo/tview"
 )
 
-// Run is the main function for the generator.
-func Run(ui *ui.UI) {
-	isoFilePath := "/var/lib/vz/template/iso"
-	snippetsFilePath := "/var/lib/vz/snippets"
+// Options configures a generator run.
+type Options struct {
+	Paths types.Paths
+	// Selection restricts the run to a subset of the configured images.
+	Selection utils.Selection
+	// ChooseImages, if set, lets the user review the selected images before
+	// the run starts. It receives every configured image and the images
+	// picked by Selection, and returns the images to build.
+	ChooseImages func(all, selected []types.Image) ([]types.Image, error)
+	// DryRun renders and reports every step without modifying the host.
+	DryRun bool
+	// Parallel is the number of images processed concurrently.
+	Parallel int
+	// Locked builds exactly the artifacts recorded in the lock file.
+	Locked bool
+	// Force rebuilds templates whose fingerprint matches their last build.
+	Force bool
+	// SkipSpaceCheck starts the run without checking that the images fit
+	// on the disks they are downloaded to and imported into.
+	SkipSpaceCheck bool
+}
+
+// staticSteps are the steps executed for every image before the configured steps.
+var staticSteps = []string{"Download/Verify", "Prepare Image"}
+
+// Run is the main function for the generator. It returns an error if the
+// run could not start or if any image failed.
+func Run(opts Options, rep report.Reporter) error {
+	paths := opts.Paths
+	utils.LogDir = paths.LogDir
 
-	images, err := utils.LoadImages("config/os_list.json")
+	allImages, err := utils.LoadImages(paths.ImagesFile)
 	if err != nil {
-		ui.ShowErrorModal(fmt.Sprintf("Error loading images: %v", err))
-		return
+		return report.Fail(rep, fmt.Errorf("Error loading images: %w", err))
 	}
-	steps, err := utils.LoadSteps("config/steps.json")
+	pipelines, err := utils.LoadPipelines(paths.StepsFile)
 	if err != nil {
-		ui.ShowErrorModal(fmt.Sprintf("Error loading steps: %v", err))
-		return
+		return report.Fail(rep, fmt.Errorf("Error loading steps: %w", err))
 	}
-
-	uiImages := ui.BuildUITree(images, steps)
-
-	if err := os.MkdirAll(isoFilePath, 0755); err != nil {
-		ui.ShowErrorModal(fmt.Sprintf("Error creating iso folder: %v. Do you have proper permissions?", err))
-		return
+	settings, err := utils.LoadSettings(paths.SettingsFile)
+	if err != nil {
+		return report.Fail(rep, fmt.Errorf("Error loading settings: %w", err))
+	}
+	if err := utils.ValidateConfig(paths, settings, allImages, pipelines); err != nil {
+		return report.Fail(rep, err)
 	}
-	if err := os.MkdirAll(snippetsFilePath, 0755); err != nil {
-		ui.ShowErrorModal(fmt.Sprintf("Error creating snippets folder: %v. Do you have proper permissions?", err))
-		return
+	if err := utils.ConfigureHTTP(settings.HTTP); err != nil {
+		return report.Fail(rep, fmt.Errorf("Error configuring HTTP client: %w", err))
 	}
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		ui.ShowErrorModal(fmt.Sprintf("Error creating logs folder: %v", err))
-		return
+	backend, err := utils.NewBackend(settings)
+	if err != nil {
+		return report.Fail(rep, fmt.Errorf("Error configuring backend: %w", err))
 	}
 
-	var previousImageNode *tview.TreeNode
-	var failedImages []string
-	for _, uiImage := range uiImages {
-		ui.App.QueueUpdateDraw(func() {
-			if previousImageNode != nil {
-				previousImageNode.Collapse()
-			}
-			uiImage.Node.SetColor(tcell.ColorYellow)
-			ui.StepsTree.SetCurrentNode(uiImage.Node)
-			uiImage.Node.Expand()
-			previousImageNode = uiImage.Node
-		})
-
-		var hasFailed bool
-		var filePath string
-
-		// --- Download & Verify Step ---
-		downloadStep := uiImage.Steps[0]
-		filePath, err = utils.HandleDownloadAndChecksum(ui.App, ui.StepView, ui.CommandView, ui.OutputView, downloadStep, uiImage.Image, isoFilePath, ui.UpdateNodeStatus, ui.AppendOutput)
+	images, err := utils.SelectImages(allImages, opts.Selection)
+	if err != nil {
+		return report.Fail(rep, fmt.Errorf("Error selecting images: %w", err))
+	}
+	if opts.ChooseImages != nil {
+		if images, err = opts.ChooseImages(allImages, images); err != nil {
+			return report.Fail(rep, err)
+		}
+	}
+	if len(images) == 0 {
+		return report.Fail(rep, fmt.Errorf("No images selected"))
+	}
+	if opts.Locked {
+		lock, err := utils.LoadLock(paths.LockFile)
+		if err == nil {
+			images, err = utils.ApplyLock(images, lock)
+		}
 		if err != nil {
-			utils.LogError(uiImage.Image.Name, err)
-			ui.UpdateNodeStatus(downloadStep.Node, "failed")
-			hasFailed = true
-		} else {
-			ui.UpdateNodeStatus(downloadStep.Node, "success")
-			time.Sleep(1 * time.Second)
+			return report.Fail(rep, fmt.Errorf("Error applying lock file: %w", err))
 		}
+	}
 
-		// --- Copy Image Step ---
-		baseFilePath := "base.qcow2"
-		if !hasFailed {
-			copyStep := uiImage.Steps[1]
-			ui.UpdateNodeStatus(copyStep.Node, "running")
-			ui.App.QueueUpdateDraw(func() {
-				ui.StepView.Clear()
-				ui.CommandView.Clear()
-				ui.OutputView.Clear()
-				ui.StepView.SetText(copyStep.Name)
-				writer := tview.ANSIWriter(ui.CommandView)
-				fmt.Fprint(writer, style.Yellow(fmt.Sprintf("cp %s %s", filePath, baseFilePath)))
-			})
-			ui.AppendOutput(fmt.Sprintf("Copying %s to %s...\n", filePath, baseFilePath))
-			if err := utils.CopyFile(filePath, baseFilePath); err != nil {
-				utils.LogError(uiImage.Image.Name, err)
-				ui.UpdateNodeStatus(copyStep.Node, "failed")
-				hasFailed = true
-			} else {
-				ui.AppendOutput("Copy complete.\n")
-				ui.UpdateNodeStatus(copyStep.Node, "success")
-				time.Sleep(1 * time.Second)
+	// Each image may have its own pipeline; validation has already checked
+	// that every one of them resolves.
+	imageSteps := make([][]types.Step, len(images))
+	plan := make([]report.PlannedImage, len(images))
+	for i, img := range images {
+		if imageSteps[i], err = utils.ResolveSteps(pipelines, img); err != nil {
+			return report.Fail(rep, fmt.Errorf("Error resolving steps for %s: %w", img.Name, err))
+		}
+		stepNames := append([]string{}, staticSteps...)
+		for _, step := range imageSteps[i] {
+			stepNames = append(stepNames, step.Name)
+		}
+		plan[i] = report.PlannedImage{ID: img.ID, Name: img.Name, Steps: stepNames}
+	}
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	if parallel > len(images) {
+		parallel = len(images)
+	}
+	// Runs that would fill a disk halfway through fail before anything
+	// is downloaded.
+	if !opts.SkipSpaceCheck {
+		// Images are resolved once, for the check and their build.
+		if images, err = utils.CheckSpace(images, settings, paths, parallel, backend); err != nil {
+			var spaceErr *utils.SpaceError
+			if !errors.As(err, &spaceErr) {
+				err = fmt.Errorf("Error checking disk space: %w", err)
 			}
+			return report.Fail(rep, err)
 		}
+	}
+	report.Start(rep, plan, parallel)
+
+	if opts.DryRun {
+		// Nothing on the host is modified, not even the error logs.
+		utils.LogDir = ""
+	} else if err := createDirs(paths); err != nil {
+		return report.Fail(rep, err)
+	}
 
-		// --- Dynamic Execution Steps ---
-		if !hasFailed {
-			executionSteps := uiImage.Steps[2:]
-			if err := utils.ExecuteCommands(ui.App, ui.StepView, ui.CommandView, ui.OutputView, executionSteps, baseFilePath, uiImage.Image, steps, ui.UpdateNodeStatus, ui.AppendOutput, utils.LogError); err != nil {
-				utils.LogError(uiImage.Image.Name, err)
-				hasFailed = true
+	state, err := utils.LoadState(paths.StateFile)
+	if err != nil {
+		return report.Fail(rep, fmt.Errorf("Error loading state: %w", err))
+	}
+
+	r := &run{opts: opts, settings: settings, backend: backend, locks: utils.NewLocks(), built: utils.BuiltImages(state)}
+	failed := make([]bool, len(images))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				scope := report.NewScope(rep, plan, i)
+				scope.Started()
+				failed[i] = !r.buildImage(scope, images[i], imageSteps[i])
+				scope.Finished(failed[i])
 			}
+		}()
+	}
+	for i := range images {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if !opts.DryRun {
+		cache := utils.Cache{Dir: paths.ISODir}
+		if _, _, err := cache.Prune(settings.Cache, false); err != nil {
+			utils.LogError("cache", fmt.Errorf("pruning the image cache failed: %w", err))
+		}
+	}
+
+	var failedImages []string
+	for i, img := range images {
+		if failed[i] {
+			failedImages = append(failedImages, img.Name)
 		}
+	}
+
+	report.Finish(rep, failedImages)
+	if len(failedImages) > 0 {
+		return fmt.Errorf("%d image(s) failed", len(failedImages))
+	}
+	return nil
+}
 
-		// --- Final Status ---
-		if hasFailed {
-			failedImages = append(failedImages, uiImage.Image.Name)
-			ui.MarkRemainingStepsAsSkipped(uiImage.Steps)
-			uiImage.Node.SetText(fmt.Sprintf("❌ %s", uiImage.Image.Name))
-		} else {
-			uiImage.Node.SetText(fmt.Sprintf("✅ %s", uiImage.Image.Name))
+// createDirs creates the directories written to during a run.
+func createDirs(paths types.Paths) error {
+	if err := os.MkdirAll(paths.ISODir, 0755); err != nil {
+		return fmt.Errorf("Error creating iso folder: %w. Do you have proper permissions?", err)
+	}
+	if err := os.MkdirAll(paths.SnippetsDir, 0755); err != nil {
+		return fmt.Errorf("Error creating snippets folder: %w. Do you have proper permissions?", err)
+	}
+	if err := os.MkdirAll(paths.LogDir, 0755); err != nil {
+		return fmt.Errorf("Error creating logs folder: %w", err)
+	}
+	if err := os.MkdirAll(paths.WorkDir, 0755); err != nil {
+		return fmt.Errorf("Error creating work folder: %w", err)
+	}
+	return nil
+}
+
+// run holds the state shared by the workers of a single run.
+type run struct {
+	opts     Options
+	settings types.Settings
+	// backend performs the VM operations of steps.
+	backend pve.Backend
+	// locks serializes steps that must not overlap across images.
+	locks *utils.Locks
+	// built holds the last build of every image when the run started.
+	built map[string]types.BuiltImage
+	// stateMu serializes updates of the state file.
+	stateMu sync.Mutex
+}
+
+// buildImage runs every step for a single image and reports whether it
+// succeeded. It may be called concurrently for different images.
+func (r *run) buildImage(scope report.Scope, img types.Image, steps []types.Step) bool {
+	opts := r.opts
+	paths := opts.Paths
+	baseFilePath := utils.ScratchFile(paths, img)
+	data, err := utils.NewTemplateData(img, baseFilePath, r.settings, paths)
+	if err != nil {
+		utils.LogError(img.Name, err)
+		scope.StepStarted(0, "")
+		scope.StepFinished(0, report.StatusFailed, err)
+		return false
+	}
+
+	// In dry-run mode steps are reported as skipped since nothing is executed.
+	done := report.StatusSuccess
+	if opts.DryRun {
+		done = report.StatusSkipped
+	}
+
+	// --- Download & Verify Step ---
+	retry, err := utils.NewRetry(r.settings.Retry.Download)
+	if err != nil {
+		utils.LogError(img.Name, err)
+		scope.StepStarted(0, "")
+		scope.StepFinished(0, report.StatusFailed, err)
+		return false
+	}
+	scope.StepStarted(0, "")
+	if img.Resolver != nil {
+		if img, err = utils.ResolveLatest(scope, 0, img, retry); err != nil {
+			utils.LogError(img.Name, err)
+			scope.StepFinished(0, report.StatusFailed, err)
+			return false
 		}
-		uiImage.Node.SetColor(tcell.ColorDefault)
+		data.Image = img
 	}
+	// The build is fingerprinted from the published or pinned checksum, so
+	// that an up-to-date template is skipped without downloading its image.
+	var fingerprint string
+	upstreamURL, upstream, err := utils.UpstreamChecksum(img, paths.KeyringDir, retry)
+	if err == nil && upstream != "" {
+		fingerprint, err = utils.Fingerprint(upstream, steps, data)
+	}
+	if err != nil {
+		scope.Output(fmt.Sprintf("Cannot fingerprint the build (%v), rebuilding.\n", err))
+	} else if fingerprint != "" && !opts.Force && r.upToDate(img, fingerprint) {
+		scope.Output(fmt.Sprintf("⏭️ Template %d is up to date, skipping. Use --force to rebuild.\n", img.ID))
+		scope.StepFinished(0, done, nil)
+		for i := 1; i < len(staticSteps)+len(steps); i++ {
+			scope.StepFinished(i, report.StatusSkipped, nil)
+		}
+		return true
+	}
+	download, err := utils.HandleDownloadAndChecksum(scope, 0, img, paths, utils.Upstream{URL: upstreamURL, Checksum: upstream}, retry, r.locks, opts.DryRun)
+	if err != nil {
+		utils.LogError(img.Name, err)
+		scope.StepFinished(0, report.StatusFailed, err)
+		return false
+	}
+	if download.Checksum != "" && download.Checksum != upstream {
+		// The image changed upstream since its checksum was looked up, or
+		// has no published checksum and is fingerprinted from the file.
+		if fingerprint, err = utils.Fingerprint(download.Checksum, steps, data); err != nil {
+			fingerprint = ""
+		}
+	}
+	scope.StepFinished(0, done, nil)
+	pause(opts)
 
-	var finalMessage strings.Builder
-	if len(failedImages) == 0 {
-		finalMessage.WriteString(style.Green("\nAll steps completed successfully!\n"))
+	// --- Prepare Image Step ---
+	// Compressed and non-qcow2 images are unpacked and converted here.
+	packing, err := utils.DetectPacking(img, download.Path, download.URL)
+	if err != nil {
+		utils.LogError(img.Name, err)
+		scope.StepStarted(1, "")
+		scope.StepFinished(1, report.StatusFailed, err)
+		return false
+	}
+	source := download.Path
+	if source == "" {
+		// Not downloaded yet in dry-run mode.
+		source = download.URL
+	}
+	scope.StepStarted(1, packing.Command(source, baseFilePath))
+	if opts.DryRun {
+		scope.Output(fmt.Sprintf("Would prepare the %s as %s\n", packing, baseFilePath))
+		scope.StepFinished(1, done, nil)
 	} else {
-		finalMessage.WriteString(style.Red("\nThe following images failed:\n"))
-		for _, imgName := range failedImages {
-			finalMessage.WriteString(fmt.Sprintf("- %s\n", imgName))
+		// A concurrent build must not remove the cached image while it is
+		// copied out.
+		unlock := r.locks.Lock(utils.CacheLock(download.Checksum))
+		err := utils.PrepareImage(scope, packing, download.Path, baseFilePath)
+		unlock()
+		if err != nil {
+			utils.LogError(img.Name, err)
+			scope.StepFinished(1, report.StatusFailed, err)
+			return false
 		}
+		scope.StepFinished(1, done, nil)
+		pause(opts)
 	}
-	finalMessage.WriteString(style.Yellow("\nPress ESC to exit."))
 
-	writer := tview.ANSIWriter(ui.OutputView)
-	fmt.Fprint(writer, finalMessage.String())
+	// --- Dynamic Execution Steps ---
+	if err := utils.ExecuteCommands(scope, len(staticSteps), paths, data, steps, r.backend, r.locks, opts.DryRun, utils.LogError); err != nil {
+		utils.LogError(img.Name, err)
+		return false
+	}
+	if !opts.DryRun {
+		r.recordBuild(scope, img, download, fingerprint)
+	}
+	return true
+}
+
+// upToDate reports whether the template of an image was last built with
+// the same fingerprint and still exists.
+func (r *run) upToDate(img types.Image, fingerprint string) bool {
+	last, ok := r.built[img.Name]
+	if !ok || last.ID != img.ID || last.Fingerprint != fingerprint {
+		return false
+	}
+	exists, err := r.backend.VMExists(context.Background(), img.ID)
+	return err == nil && exists
+}
+
+// recordBuild records a successful build in the state file, with an empty
+// fingerprint if it has none. A failure to do so is logged but does not
+// fail the image.
+func (r *run) recordBuild(scope report.Scope, img types.Image, download utils.Download, fingerprint string) {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	built := types.BuiltImage{
+		Name:        img.Name,
+		ID:          img.ID,
+		URL:         download.URL,
+		Checksum:    download.Checksum,
+		Fingerprint: fingerprint,
+		BuiltAt:     time.Now().UTC(),
+	}
+	if err := utils.RecordBuild(r.opts.Paths.StateFile, built); err != nil {
+		scope.Output(fmt.Sprintf("⚠️ Could not record the build: %v\n", err))
+		utils.LogError(img.Name, err)
+	}
+}
+
+// pause gives the user a moment to read the output of a finished step.
+func pause(opts Options) {
+	if !opts.DryRun {
+		time.Sleep(1 * time.Second)
+	}
 }
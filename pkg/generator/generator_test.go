@@ -0,0 +1,63 @@
+package generator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+	"github.com/aloks98/pve-ctgen/pkg/utils"
+)
+
+func TestBuildWithoutChecksum(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("qcow2 image data", 1024)))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	paths := types.Paths{
+		ISODir:       filepath.Join(dir, "iso"),
+		SnippetsDir:  filepath.Join(dir, "snippets"),
+		CloudInitDir: dir,
+		LogDir:       filepath.Join(dir, "logs"),
+		WorkDir:      filepath.Join(dir, "work"),
+		StateFile:    filepath.Join(dir, "state.json"),
+	}
+	if err := createDirs(paths); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "vendor.yaml"), []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := types.Image{ID: 100, Name: "a", URL: srv.URL + "/a.qcow2", Format: "qcow2", Vendor: "vendor.yaml"}
+	settings := types.Settings{Hardware: utils.DefaultHardware, Retry: types.Retry{Download: types.RetryPolicy{Attempts: 1}}}
+	r := &run{opts: Options{Paths: paths}, settings: settings, locks: utils.NewLocks()}
+	rec := &report.Recorder{}
+	if !r.buildImage(report.Scope{Reporter: rec}, img, nil) {
+		t.Fatalf("build failed: %+v", rec.Events())
+	}
+
+	state, err := utils.LoadState(paths.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, ok := utils.BuiltImages(state)[img.Name]
+	if !ok {
+		t.Fatal("the build was not recorded")
+	}
+	if built.Checksum == "" || built.Fingerprint == "" {
+		t.Errorf("recorded %+v, want the checksum and fingerprint of the downloaded file", built)
+	}
+
+	check, err := utils.CheckUpdate(img, &built, paths, utils.Retry{Attempts: 1})
+	if err != nil {
+		t.Fatalf("CheckUpdate: %v", err)
+	}
+	if check.Template != utils.UpdateUnknown || check.Stale() {
+		t.Errorf("check-updates reports the template %s, want %s", check.Template, utils.UpdateUnknown)
+	}
+}
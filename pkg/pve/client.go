@@ -0,0 +1,354 @@
+package pve
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is the Backend using the REST API of a Proxmox VE node,
+// authenticated with an API token. Disk images are uploaded to the node
+// before they are imported, so builds can run from another machine.
+type Client struct {
+	// URL is the address of the API, e.g. "https://pve.example.com:8006".
+	URL string
+	// Node is the name of the node VMs are created on.
+	Node string
+	// TokenID identifies the API token, e.g. "root@pam!ctgen", and
+	// TokenSecret is its secret.
+	TokenID     string
+	TokenSecret string
+	// ImportStorage is the storage disk images are uploaded to before they
+	// are imported. It must allow the "import" content type.
+	ImportStorage string
+	// HTTP sends every request. Nil means http.DefaultClient.
+	HTTP *http.Client
+	// PollInterval is the delay between two checks of a running task.
+	// Zero means one second.
+	PollInterval time.Duration
+}
+
+// APIError is returned for a request the API answered with an error.
+type APIError struct {
+	Method string
+	Path   string
+	// StatusCode is the HTTP status of the response.
+	StatusCode int
+	// Message is the error message of the API.
+	Message string
+	// Errors holds the messages of invalid parameters by name.
+	Errors map[string]string
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Message)
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg += fmt.Sprintf("; %s: %s", name, strings.TrimSpace(e.Errors[name]))
+	}
+	return msg
+}
+
+// TaskError is returned for a task that did not finish successfully.
+type TaskError struct {
+	UPID string
+	// ExitStatus is the error message of the task.
+	ExitStatus string
+}
+
+// Error implements the error interface.
+func (e *TaskError) Error() string {
+	return fmt.Sprintf("task %s failed: %s", e.UPID, e.ExitStatus)
+}
+
+// VMExists implements Backend.
+func (c *Client) VMExists(ctx context.Context, vmid int) (bool, error) {
+	vm, err := c.findVM(ctx, vmid)
+	return vm != nil, err
+}
+
+// clusterVM is a VM as listed by /cluster/resources.
+type clusterVM struct {
+	VMID   int    `json:"vmid"`
+	Node   string `json:"node"`
+	Status string `json:"status"`
+}
+
+// findVM returns the VM with the given ID anywhere in the cluster, or nil.
+func (c *Client) findVM(ctx context.Context, vmid int) (*clusterVM, error) {
+	var vms []clusterVM
+	if err := c.do(ctx, http.MethodGet, "/cluster/resources", url.Values{"type": {"vm"}}, &vms); err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if vm.VMID == vmid {
+			return &vm, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateVM implements Backend.
+func (c *Client) CreateVM(ctx context.Context, vmid int, options Options) error {
+	params := options.values()
+	params.Set("vmid", strconv.Itoa(vmid))
+	return c.task(ctx, http.MethodPost, c.nodePath("/qemu"), params)
+}
+
+// DestroyVM implements Backend. The VM is destroyed on whichever node of
+// the cluster it is on.
+func (c *Client) DestroyVM(ctx context.Context, vmid int) error {
+	vm, err := c.findVM(ctx, vmid)
+	if err != nil || vm == nil {
+		return err
+	}
+	path := fmt.Sprintf("/nodes/%s/qemu/%d", url.PathEscape(vm.Node), vmid)
+	if vm.Status == "running" {
+		if err := c.task(ctx, http.MethodPost, path+"/status/stop", nil); err != nil {
+			return err
+		}
+	}
+	return c.task(ctx, http.MethodDelete, path, url.Values{"purge": {"1"}, "destroy-unreferenced-disks": {"1"}})
+}
+
+// ImportDisk implements Backend. The file is uploaded to ImportStorage,
+// imported from there and removed again.
+func (c *Client) ImportDisk(ctx context.Context, vmid int, disk, file, storage string, options Options) error {
+	volume, err := c.upload(ctx, file)
+	if err != nil {
+		return err
+	}
+	err = c.SetOptions(ctx, vmid, Options{disk: importSpec(storage, volume, options)})
+	path := c.nodePath(fmt.Sprintf("/storage/%s/content/%s", url.PathEscape(c.ImportStorage), url.PathEscape(volume)))
+	if cleanupErr := c.task(ctx, http.MethodDelete, path, nil); err == nil && cleanupErr != nil {
+		return fmt.Errorf("removing the uploaded %s: %w", volume, cleanupErr)
+	}
+	return err
+}
+
+// upload uploads a disk image to ImportStorage and returns its volume ID.
+func (c *Client) upload(ctx context.Context, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(file)
+
+	// The multipart framing is built up front so that the request has a
+	// Content-Length; the API refuses chunked uploads.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("content", "import")
+	if _, err := mw.CreateFormFile("filename", name); err != nil {
+		return "", err
+	}
+	head := bytes.Clone(buf.Bytes())
+	buf.Reset()
+	mw.Close()
+	tail := buf.Bytes()
+
+	body := io.MultiReader(bytes.NewReader(head), f, bytes.NewReader(tail))
+	path := c.nodePath(fmt.Sprintf("/storage/%s/upload", url.PathEscape(c.ImportStorage)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiURL(path), body)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = int64(len(head)) + info.Size() + int64(len(tail))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var upid string
+	if err := c.send(req, &upid); err != nil {
+		return "", fmt.Errorf("uploading %s: %w", name, err)
+	}
+	if err := c.wait(ctx, upid); err != nil {
+		return "", fmt.Errorf("uploading %s: %w", name, err)
+	}
+	return fmt.Sprintf("%s:import/%s", c.ImportStorage, name), nil
+}
+
+// ResizeDisk implements Backend.
+func (c *Client) ResizeDisk(ctx context.Context, vmid int, disk, size string) error {
+	return c.task(ctx, http.MethodPut, c.vmPath(vmid, "/resize"), url.Values{"disk": {disk}, "size": {size}})
+}
+
+// SetOptions implements Backend.
+func (c *Client) SetOptions(ctx context.Context, vmid int, options Options) error {
+	return c.task(ctx, http.MethodPost, c.vmPath(vmid, "/config"), options.values())
+}
+
+// ConvertToTemplate implements Backend.
+func (c *Client) ConvertToTemplate(ctx context.Context, vmid int) error {
+	return c.task(ctx, http.MethodPost, c.vmPath(vmid, "/template"), nil)
+}
+
+// StorageStatus implements Backend.
+func (c *Client) StorageStatus(ctx context.Context) (map[string]Storage, error) {
+	var list []struct {
+		Storage string `json:"storage"`
+		Type    string `json:"type"`
+		Avail   int64  `json:"avail"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.nodePath("/storage"), nil, &list); err != nil {
+		return nil, err
+	}
+	storages := make(map[string]Storage, len(list))
+	for _, s := range list {
+		storages[s.Storage] = Storage{Type: s.Type, Available: s.Avail}
+	}
+	return storages, nil
+}
+
+// task sends a request starting a task and waits for the task to finish.
+// Requests the API completes without a task return at once.
+func (c *Client) task(ctx context.Context, method, path string, params url.Values) error {
+	var upid string
+	if err := c.do(ctx, method, path, params, &upid); err != nil {
+		return err
+	}
+	return c.wait(ctx, upid)
+}
+
+// wait polls a task until it stops. Tasks finishing with warnings
+// succeed.
+func (c *Client) wait(ctx context.Context, upid string) error {
+	if upid == "" {
+		return nil
+	}
+	// UPIDs name the node running the task: "UPID:<node>:...".
+	node := c.Node
+	if parts := strings.Split(upid, ":"); len(parts) > 2 {
+		node = parts[1]
+	}
+	path := fmt.Sprintf("/nodes/%s/tasks/%s/status", url.PathEscape(node), url.PathEscape(upid))
+	interval := c.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		var status struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := c.do(ctx, http.MethodGet, path, nil, &status); err != nil {
+			return err
+		}
+		if status.Status == "stopped" {
+			if status.ExitStatus != "OK" && !strings.HasPrefix(status.ExitStatus, "WARNINGS") {
+				return &TaskError{UPID: upid, ExitStatus: status.ExitStatus}
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// do sends a request with form parameters, in the query string for GET
+// and DELETE, and decodes the data of the response into out.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, out any) error {
+	target := c.apiURL(path)
+	var body io.Reader
+	if method == http.MethodGet || method == http.MethodDelete {
+		if len(params) > 0 {
+			target += "?" + params.Encode()
+		}
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return c.send(req, out)
+}
+
+// send authenticates and sends a request, and decodes the data of the
+// response into out.
+func (c *Client) send(req *http.Request, out any) error {
+	req.Header.Set("Authorization", fmt.Sprintf("PVEAPIToken=%s=%s", c.TokenID, c.TokenSecret))
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data    json.RawMessage   `json:"data"`
+		Message string            `json:"message"`
+		Errors  map[string]string `json:"errors"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+	path := strings.TrimPrefix(req.URL.Path, "/api2/json")
+	if resp.StatusCode != http.StatusOK {
+		// The API puts its error message in the status line.
+		message := strings.TrimSpace(result.Message)
+		if message == "" {
+			message = strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)))
+		}
+		return &APIError{Method: req.Method, Path: path, StatusCode: resp.StatusCode, Message: message, Errors: result.Errors}
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("%s %s: decoding the response: %w", req.Method, path, decodeErr)
+	}
+	if out == nil || len(result.Data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(result.Data, out); err != nil {
+		return fmt.Errorf("%s %s: decoding the response: %w", req.Method, path, err)
+	}
+	return nil
+}
+
+// apiURL returns the URL of an API path such as "/nodes".
+func (c *Client) apiURL(path string) string {
+	return strings.TrimSuffix(c.URL, "/") + "/api2/json" + path
+}
+
+// nodePath returns the API path of a resource of Node.
+func (c *Client) nodePath(path string) string {
+	return "/nodes/" + url.PathEscape(c.Node) + path
+}
+
+// vmPath returns the API path of a resource of a VM on Node.
+func (c *Client) vmPath(vmid int, path string) string {
+	return c.nodePath(fmt.Sprintf("/qemu/%d%s", vmid, path))
+}
+
+// values returns the options as form parameters.
+func (o Options) values() url.Values {
+	params := url.Values{}
+	for k, v := range o {
+		params.Set(k, v)
+	}
+	return params
+}
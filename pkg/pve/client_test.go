@@ -0,0 +1,350 @@
+package pve_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/pve/pvetest"
+)
+
+// newClient returns a client for the stand-in server.
+func newClient(url string) *pve.Client {
+	return &pve.Client{
+		URL:           url,
+		Node:          pvetest.Node,
+		TokenID:       pvetest.TokenID,
+		TokenSecret:   pvetest.TokenSecret,
+		ImportStorage: "local",
+		PollInterval:  time.Millisecond,
+	}
+}
+
+// stub is an API answering fixed data by "METHOD path" and recording the
+// requests it receives.
+type stub struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func newStub(t *testing.T, routes map[string]any) (*httptest.Server, *stub) {
+	t.Helper()
+	st := &stub{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + strings.TrimPrefix(r.URL.Path, "/api2/json")
+		st.mu.Lock()
+		st.requests = append(st.requests, key)
+		st.mu.Unlock()
+		data, ok := routes[key]
+		if !ok {
+			http.Error(w, `{"data":null}`, http.StatusNotImplemented)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, st
+}
+
+func (st *stub) Requests() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]string(nil), st.requests...)
+}
+
+func TestImportDisk(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	c := newClient(srv.URL)
+	ctx := context.Background()
+
+	// An odd size catches a Content-Length that is off by the framing.
+	file := filepath.Join(t.TempDir(), "disk.qcow2")
+	data := make([]byte, 3<<20+17)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateVM(ctx, 100, pve.Options{"name": "test"}); err != nil {
+		t.Fatalf("CreateVM: %v", err)
+	}
+	created := len(srv.Requests())
+	if err := c.ImportDisk(ctx, 100, "virtio0", file, "local-lvm", pve.Options{"discard": "on"}); err != nil {
+		t.Fatalf("ImportDisk: %v", err)
+	}
+
+	vm, ok := srv.VM(100)
+	if !ok {
+		t.Fatal("VM 100 does not exist")
+	}
+	if got, want := vm.Config["virtio0"], "local-lvm:vm-100-disk-0,discard=on"; got != want {
+		t.Errorf("virtio0 = %q, want %q", got, want)
+	}
+	if size, ok := srv.VolumeSize("local-lvm", "vm-100-disk-0"); !ok || size != int64(len(data)) {
+		t.Errorf("imported disk size = %d (exists %v), want %d", size, ok, len(data))
+	}
+	if volumes := srv.Volumes("local"); len(volumes) != 0 {
+		t.Errorf("uploads left behind: %v", volumes)
+	}
+
+	want := []string{
+		"POST /nodes/pve/storage/local/upload",
+		"POST /nodes/pve/qemu/100/config",
+		"DELETE /nodes/pve/storage/local/content/local:import/disk.qcow2",
+	}
+	var got []string
+	for _, r := range srv.Requests()[created:] {
+		if !strings.Contains(r, "/tasks/") {
+			got = append(got, r)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestImportDiskFailureRemovesUpload(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	c := newClient(srv.URL)
+	ctx := context.Background()
+
+	file := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(file, []byte("qcow2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The VM does not exist, so attaching the disk fails.
+	err := c.ImportDisk(ctx, 100, "virtio0", file, "local-lvm", nil)
+	var apiErr *pve.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("ImportDisk error = %v, want an APIError with status 500", err)
+	}
+	if volumes := srv.Volumes("local"); len(volumes) != 0 {
+		t.Errorf("uploads left behind: %v", volumes)
+	}
+}
+
+func TestImportDiskTaskFailure(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	c := newClient(srv.URL)
+	ctx := context.Background()
+
+	if err := c.CreateVM(ctx, 100, nil); err != nil {
+		t.Fatalf("CreateVM: %v", err)
+	}
+	// Importing from a volume that does not exist fails in the task.
+	err := c.SetOptions(ctx, 100, pve.Options{"virtio0": "local-lvm:0,import-from=local:import/missing.qcow2"})
+	var taskErr *pve.TaskError
+	if !errors.As(err, &taskErr) || !strings.Contains(taskErr.ExitStatus, "does not exist") {
+		t.Fatalf("SetOptions error = %v, want a TaskError", err)
+	}
+}
+
+func TestUploadRejectsUnsupportedStorage(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	c := newClient(srv.URL)
+	c.ImportStorage = "local-lvm"
+
+	file := filepath.Join(t.TempDir(), "disk.qcow2")
+	if err := os.WriteFile(file, []byte("qcow2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateVM(context.Background(), 100, nil); err != nil {
+		t.Fatalf("CreateVM: %v", err)
+	}
+	err := c.ImportDisk(context.Background(), 100, "virtio0", file, "local-lvm", nil)
+	if err == nil || !strings.Contains(err.Error(), "does not support 'import' content") {
+		t.Fatalf("ImportDisk error = %v, want the storage to refuse the upload", err)
+	}
+}
+
+func TestWaitUsesNodeOfUPID(t *testing.T) {
+	const upid = "UPID:other:0001:0002:0003:qmtemplate:100:root@pam!test:"
+	tests := []struct {
+		exitStatus string
+		wantErr    bool
+	}{
+		{"OK", false},
+		{"WARNINGS: 2", false},
+		{"VM 100 is locked", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.exitStatus, func(t *testing.T) {
+			srv, st := newStub(t, map[string]any{
+				"POST /nodes/pve/qemu/100/template":          upid,
+				"GET /nodes/other/tasks/" + upid + "/status": map[string]any{"status": "stopped", "exitstatus": tt.exitStatus},
+			})
+			err := newClient(srv.URL).ConvertToTemplate(context.Background(), 100)
+			var taskErr *pve.TaskError
+			switch {
+			case tt.wantErr && (!errors.As(err, &taskErr) || taskErr.ExitStatus != tt.exitStatus || taskErr.UPID != upid):
+				t.Errorf("ConvertToTemplate error = %v, want a TaskError with %q", err, tt.exitStatus)
+			case !tt.wantErr && err != nil:
+				t.Errorf("ConvertToTemplate error = %v", err)
+			}
+			if requests := st.Requests(); len(requests) != 2 {
+				t.Errorf("requests = %q, want the template request and one status query", requests)
+			}
+		})
+	}
+}
+
+func TestWaitPollsRunningTasks(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	if err := newClient(srv.URL).CreateVM(context.Background(), 100, nil); err != nil {
+		t.Fatalf("CreateVM: %v", err)
+	}
+	// The stand-in reports every task as running once.
+	var polls int
+	for _, r := range srv.Requests() {
+		if strings.HasSuffix(r, "/status") {
+			polls++
+		}
+	}
+	if polls != 2 {
+		t.Errorf("task polled %d times, want 2", polls)
+	}
+}
+
+func TestDestroyVM(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	c := newClient(srv.URL)
+	ctx := context.Background()
+
+	srv.AddVM(100, pvetest.VM{Config: map[string]string{"name": "old"}, Running: true})
+	if err := c.DestroyVM(ctx, 100); err != nil {
+		t.Fatalf("DestroyVM: %v", err)
+	}
+	if _, ok := srv.VM(100); ok {
+		t.Error("VM 100 still exists")
+	}
+	var stop, destroy int
+	for i, r := range srv.Requests() {
+		switch r {
+		case "POST /nodes/pve/qemu/100/status/stop":
+			stop = i
+		case "DELETE /nodes/pve/qemu/100":
+			destroy = i
+		}
+	}
+	if stop == 0 || destroy < stop {
+		t.Errorf("requests = %q, want the VM stopped before it is destroyed", srv.Requests())
+	}
+
+	// A missing VM is not an error.
+	if err := c.DestroyVM(ctx, 100); err != nil {
+		t.Errorf("DestroyVM of a missing VM: %v", err)
+	}
+}
+
+func TestDestroyVMOnOtherNode(t *testing.T) {
+	srv, st := newStub(t, map[string]any{
+		"GET /cluster/resources":                []map[string]any{{"vmid": 101, "node": "pve", "status": "stopped"}, {"vmid": 100, "node": "pve2", "status": "running"}},
+		"POST /nodes/pve2/qemu/100/status/stop": nil,
+		"DELETE /nodes/pve2/qemu/100":           nil,
+	})
+	if err := newClient(srv.URL).DestroyVM(context.Background(), 100); err != nil {
+		t.Fatalf("DestroyVM: %v", err)
+	}
+	want := []string{"GET /cluster/resources", "POST /nodes/pve2/qemu/100/status/stop", "DELETE /nodes/pve2/qemu/100"}
+	if got := st.Requests(); !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		call   func(*pve.Client) error
+		status int
+		want   string
+	}{
+		{
+			name: "authentication",
+			call: func(c *pve.Client) error {
+				c.TokenSecret = "wrong"
+				_, err := c.VMExists(ctx, 100)
+				return err
+			},
+			status: http.StatusUnauthorized,
+			want:   "GET /cluster/resources: 401 authentication failure",
+		},
+		{
+			name: "parameters",
+			call: func(c *pve.Client) error {
+				if err := c.CreateVM(ctx, 100, pve.Options{"virtio0": "local-lvm:4"}); err != nil {
+					return err
+				}
+				return c.ResizeDisk(ctx, 100, "virtio0", "big")
+			},
+			status: http.StatusBadRequest,
+			want:   "PUT /nodes/pve/qemu/100/resize: 400 Parameter verification failed.; size: value does not match the regex pattern",
+		},
+		{
+			name: "status line",
+			call: func(c *pve.Client) error {
+				c.Node = "elsewhere"
+				return c.ConvertToTemplate(ctx, 100)
+			},
+			status: http.StatusInternalServerError,
+			want:   "POST /nodes/elsewhere/qemu/100/template: 500 hostname lookup 'elsewhere' failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call(newClient(srv.URL))
+			var apiErr *pve.APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want an APIError", err)
+			}
+			if apiErr.StatusCode != tt.status || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("error = %q (status %d), want %q (status %d)", err, apiErr.StatusCode, tt.want, tt.status)
+			}
+		})
+	}
+}
+
+func TestAPIErrorFromStatusLine(t *testing.T) {
+	// The real API only sends its message in the status line.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"data":null}`))
+	}))
+	defer srv.Close()
+	_, err := newClient(srv.URL).StorageStatus(context.Background())
+	if got, want := err.Error(), "GET /nodes/pve/storage: 500 Internal Server Error"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestStorageStatus(t *testing.T) {
+	srv := pvetest.NewServer()
+	defer srv.Close()
+	storages, err := newClient(srv.URL).StorageStatus(context.Background())
+	if err != nil {
+		t.Fatalf("StorageStatus: %v", err)
+	}
+	if got, want := storages["local-lvm"], (pve.Storage{Type: "lvmthin", Available: 200 << 30}); got != want {
+		t.Errorf("local-lvm = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+// Package pve performs the Proxmox VE operations of a template build,
+// either by running qm on the node itself or through the REST API of a
+// remote node.
+package pve
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// Backend performs VM operations on a Proxmox VE node. Implementations
+// must be safe for concurrent use.
+type Backend interface {
+	// VMExists reports whether a VM with the given ID exists.
+	VMExists(ctx context.Context, vmid int) (bool, error)
+	// CreateVM creates a VM with the given options.
+	CreateVM(ctx context.Context, vmid int, options Options) error
+	// DestroyVM stops and removes a VM and its disks. A missing VM is not
+	// an error.
+	DestroyVM(ctx context.Context, vmid int) error
+	// ImportDisk imports the local disk image file into storage and
+	// attaches it to the VM as disk, with extra disk options.
+	ImportDisk(ctx context.Context, vmid int, disk, file, storage string, options Options) error
+	// ResizeDisk sets the size of a disk, e.g. "32G", or grows it, e.g.
+	// "+10G".
+	ResizeDisk(ctx context.Context, vmid int, disk, size string) error
+	// SetOptions changes options of a VM.
+	SetOptions(ctx context.Context, vmid int, options Options) error
+	// ConvertToTemplate turns a VM into a template.
+	ConvertToTemplate(ctx context.Context, vmid int) error
+	// StorageStatus returns the storages of the node by name.
+	StorageStatus(ctx context.Context) (map[string]Storage, error)
+}
+
+// Storage is the status of a Proxmox storage.
+type Storage struct {
+	// Type is the storage type, e.g. "dir" or "lvmthin".
+	Type string
+	// Available is the free space in bytes.
+	Available int64
+}
+
+// Redacted is shown instead of the value of a secret.
+const Redacted = "********"
+
+// SecretOptions are the VM options whose values String hides.
+var SecretOptions = map[string]bool{"cipassword": true}
+
+// Options are VM or disk options, such as {"memory": "2048"}.
+type Options map[string]string
+
+// Keys returns the names of the options in order.
+func (o Options) Keys() []string {
+	keys := make([]string, 0, len(o))
+	for k := range o {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Args returns the options as qm command-line arguments.
+func (o Options) Args() []string {
+	var args []string
+	for _, k := range o.Keys() {
+		args = append(args, "--"+k, o[k])
+	}
+	return args
+}
+
+// List returns the options as a comma-separated list of key=value pairs,
+// as used by disk options.
+func (o Options) List() string {
+	var pairs []string
+	for _, k := range o.Keys() {
+		pairs = append(pairs, k+"="+o[k])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Operation is a rendered VM operation of a step.
+type Operation struct {
+	// Op is one of the types.Op constants.
+	Op   string
+	VMID int
+	// Options are the VM options of create and set, or the extra disk
+	// options of import_disk.
+	Options Options
+	// Disk names the disk of import_disk and resize, e.g. "virtio0".
+	Disk string
+	// Size is the size of resize.
+	Size string
+	// File is the local disk image of import_disk, Storage the storage it
+	// is imported into.
+	File    string
+	Storage string
+}
+
+// Args returns the qm command line equivalent to the operation.
+func (o Operation) Args() []string {
+	id := strconv.Itoa(o.VMID)
+	switch o.Op {
+	case types.OpDestroy:
+		return []string{"destroy", id, "--purge"}
+	case types.OpCreate:
+		return append([]string{"create", id}, o.Options.Args()...)
+	case types.OpImportDisk:
+		return []string{"set", id, "--" + o.Disk, importSpec(o.Storage, o.File, o.Options)}
+	case types.OpResize:
+		return []string{"resize", id, o.Disk, o.Size}
+	case types.OpSet:
+		return append([]string{"set", id}, o.Options.Args()...)
+	case types.OpTemplate:
+		return []string{"template", id}
+	}
+	return []string{o.Op, id}
+}
+
+// String returns the qm command equivalent to the operation, for display.
+// The values of SecretOptions are replaced by Redacted.
+func (o Operation) String() string {
+	if len(o.Options) > 0 {
+		options := make(Options, len(o.Options))
+		for k, v := range o.Options {
+			if SecretOptions[k] {
+				v = Redacted
+			}
+			options[k] = v
+		}
+		o.Options = options
+	}
+	args := o.Args()
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \t'\"$&;|<>()") {
+			args[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return "qm " + strings.Join(args, " ")
+}
+
+// importSpec returns the value of a disk option importing source into
+// storage, e.g. "local-lvm:0,import-from=/tmp/disk.qcow2,discard=on".
+func importSpec(storage, source string, options Options) string {
+	spec := fmt.Sprintf("%s:0,import-from=%s", storage, source)
+	if len(options) > 0 {
+		spec += "," + options.List()
+	}
+	return spec
+}
+
+// Run performs an operation with a backend.
+func Run(ctx context.Context, b Backend, op Operation) error {
+	switch op.Op {
+	case types.OpDestroy:
+		return b.DestroyVM(ctx, op.VMID)
+	case types.OpCreate:
+		return b.CreateVM(ctx, op.VMID, op.Options)
+	case types.OpImportDisk:
+		return b.ImportDisk(ctx, op.VMID, op.Disk, op.File, op.Storage, op.Options)
+	case types.OpResize:
+		return b.ResizeDisk(ctx, op.VMID, op.Disk, op.Size)
+	case types.OpSet:
+		return b.SetOptions(ctx, op.VMID, op.Options)
+	case types.OpTemplate:
+		return b.ConvertToTemplate(ctx, op.VMID)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
@@ -0,0 +1,79 @@
+package pve_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+)
+
+func TestOperationString(t *testing.T) {
+	tests := []struct {
+		op   pve.Operation
+		want string
+	}{
+		{pve.Operation{Op: "destroy", VMID: 100}, "qm destroy 100 --purge"},
+		{pve.Operation{Op: "create", VMID: 100, Options: pve.Options{"name": "a b", "memory": "1024"}}, "qm create 100 --memory 1024 --name 'a b'"},
+		{pve.Operation{Op: "import_disk", VMID: 100, Disk: "virtio0", File: "/w/d.qcow2", Storage: "lvm", Options: pve.Options{"discard": "on"}}, "qm set 100 --virtio0 lvm:0,import-from=/w/d.qcow2,discard=on"},
+		{pve.Operation{Op: "resize", VMID: 100, Disk: "virtio0", Size: "+2G"}, "qm resize 100 virtio0 +2G"},
+		{pve.Operation{Op: "template", VMID: 100}, "qm template 100"},
+		{pve.Operation{Op: "set", VMID: 100, Options: pve.Options{"ciuser": "root", "cipassword": "pa$$"}}, "qm set 100 --cipassword ******** --ciuser root"},
+	}
+	for _, tt := range tests {
+		if got := tt.op.String(); got != tt.want {
+			t.Errorf("%s: String() = %q, want %q", tt.op.Op, got, tt.want)
+		}
+	}
+
+	op := pve.Operation{Op: "set", VMID: 100, Options: pve.Options{"cipassword": "pa$$"}}
+	_ = op.String()
+	if args := strings.Join(op.Args(), " "); args != "set 100 --cipassword pa$$" {
+		t.Errorf("Args() = %q, want the password", args)
+	}
+}
+
+// fakeCommand puts a shell script named name first on the PATH.
+func fakeCommand(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestShellStorageStatus(t *testing.T) {
+	fakeCommand(t, "pvesm", `cat <<'EOF'
+Name             Type     Status           Total            Used       Available        %
+local             dir     active        98497780        17417192        81080588   17.68%
+local-lvm     lvmthin     active       832888832       104857600       728031232   12.59%
+EOF
+`)
+	storages, err := pve.Shell{}.StorageStatus(context.Background())
+	if err != nil {
+		t.Fatalf("StorageStatus: %v", err)
+	}
+	want := map[string]pve.Storage{
+		"local":     {Type: "dir", Available: 81080588 * 1024},
+		"local-lvm": {Type: "lvmthin", Available: 728031232 * 1024},
+	}
+	if fmt.Sprint(storages) != fmt.Sprint(want) {
+		t.Errorf("StorageStatus = %v, want %v", storages, want)
+	}
+
+	fakeCommand(t, "pvesm", "echo 'storage status failed' >&2\nexit 2\n")
+	if _, err := (pve.Shell{}).StorageStatus(context.Background()); err == nil || !strings.Contains(err.Error(), "pvesm status failed: exit status 2: storage status failed") {
+		t.Errorf("StorageStatus error = %v, want pvesm to fail", err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := (pve.Shell{}).StorageStatus(context.Background()); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("StorageStatus error = %v, want pvesm not to be found", err)
+	}
+}
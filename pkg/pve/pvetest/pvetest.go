@@ -0,0 +1,531 @@
+// Package pvetest provides an in-memory stand-in for the parts of the
+// Proxmox VE API used by pve.Client, for trying builds without a node.
+package pvetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Defaults of a new Server.
+const (
+	Node        = "pve"
+	TokenID     = "root@pam!test"
+	TokenSecret = "00000000-0000-0000-0000-000000000000"
+)
+
+// VM is the state of a VM of the stand-in.
+type VM struct {
+	// Config holds the options of the VM, with imported disks rewritten to
+	// volumes, e.g. "local-lvm:vm-100-disk-0,discard=on".
+	Config   map[string]string
+	Running  bool
+	Template bool
+}
+
+// Storage is a storage of the stand-in.
+type Storage struct {
+	Type string
+	// Content lists the content types allowed, e.g. "import".
+	Content []string
+	// Available is the free space reported, in bytes.
+	Available int64
+	// Volumes maps the volumes of the storage, e.g. "import/disk.qcow2",
+	// to their size.
+	Volumes map[string]int64
+}
+
+// Server is an HTTP server mimicking the /api2/json endpoints of a single
+// Proxmox VE node. Tasks finish at once but report "running" to the first
+// status query.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	vms      map[int]*VM
+	storages map[string]*Storage
+	tasks    map[string]*task
+	requests []string
+}
+
+// task is a task started by a request.
+type task struct {
+	exitStatus string
+	polled     bool
+}
+
+// NewServer starts a stand-in for node Node accepting the token TokenID
+// with TokenSecret. It has a "local" storage for uploads and a "local-lvm"
+// storage for disks. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		vms: make(map[int]*VM),
+		storages: map[string]*Storage{
+			"local":     {Type: "dir", Content: []string{"iso", "import", "snippets"}, Available: 100 << 30, Volumes: map[string]int64{}},
+			"local-lvm": {Type: "lvmthin", Content: []string{"images"}, Available: 200 << 30, Volumes: map[string]int64{}},
+		},
+		tasks: make(map[string]*task),
+	}
+	mux := http.NewServeMux()
+	routes := map[string]func(*http.Request) (any, error){
+		"GET /cluster/resources":                                  s.resources,
+		"POST /nodes/{node}/qemu":                                 s.create,
+		"DELETE /nodes/{node}/qemu/{vmid}":                        s.destroy,
+		"POST /nodes/{node}/qemu/{vmid}/status/stop":              s.stop,
+		"POST /nodes/{node}/qemu/{vmid}/config":                   s.config,
+		"PUT /nodes/{node}/qemu/{vmid}/resize":                    s.resize,
+		"POST /nodes/{node}/qemu/{vmid}/template":                 s.template,
+		"GET /nodes/{node}/storage":                               s.storageList,
+		"POST /nodes/{node}/storage/{storage}/upload":             s.upload,
+		"DELETE /nodes/{node}/storage/{storage}/content/{volume}": s.deleteVolume,
+		"GET /nodes/{node}/tasks/{upid}/status":                   s.taskStatus,
+	}
+	for pattern, handler := range routes {
+		method, path, _ := strings.Cut(pattern, " ")
+		mux.HandleFunc(method+" /api2/json"+path, s.handle(handler))
+	}
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddVM adds a VM, e.g. a template left by an earlier build.
+func (s *Server) AddVM(vmid int, vm VM) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm.Config = maps.Clone(vm.Config)
+	s.vms[vmid] = &vm
+}
+
+// VM returns a copy of a VM and whether it exists.
+func (s *Server) VM(vmid int) (VM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, ok := s.vms[vmid]
+	if !ok {
+		return VM{}, false
+	}
+	copied := *vm
+	copied.Config = maps.Clone(vm.Config)
+	return copied, true
+}
+
+// Volumes returns the volumes of a storage, sorted.
+func (s *Server) Volumes(storage string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var volumes []string
+	if st, ok := s.storages[storage]; ok {
+		for volume := range st.Volumes {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// VolumeSize returns the size of a volume of a storage and whether it
+// exists.
+func (s *Server) VolumeSize(storage, volume string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.storages[storage]
+	if !ok {
+		return 0, false
+	}
+	size, ok := st.Volumes[volume]
+	return size, ok
+}
+
+// Requests returns every request received so far, as "METHOD path".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// apiError is an error answered with an HTTP status.
+type apiError struct {
+	status  int
+	message string
+	errors  map[string]string
+}
+
+func (e *apiError) Error() string { return e.message }
+
+// errorf returns an internal server error, the status the API uses for
+// most failures.
+func errorf(format string, args ...any) error {
+	return &apiError{status: http.StatusInternalServerError, message: fmt.Sprintf(format, args...)}
+}
+
+// paramError returns a parameter verification error.
+func paramError(param, format string, args ...any) error {
+	return &apiError{status: http.StatusBadRequest, message: "Parameter verification failed.", errors: map[string]string{param: fmt.Sprintf(format, args...)}}
+}
+
+// handle authenticates a request, checks its node, runs handler with the
+// server locked and writes the result in the API's {"data": ...} envelope.
+func (s *Server) handle(handler func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api2/json"))
+
+		var data any
+		var err error
+		switch {
+		case r.Header.Get("Authorization") != fmt.Sprintf("PVEAPIToken=%s=%s", TokenID, TokenSecret):
+			err = &apiError{status: http.StatusUnauthorized, message: "authentication failure"}
+		case r.PathValue("node") != "" && r.PathValue("node") != Node:
+			err = errorf("hostname lookup '%s' failed - failed to get address info for: %s: Name or service not known", r.PathValue("node"), r.PathValue("node"))
+		default:
+			data, err = handler(r)
+		}
+
+		w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+		if err != nil {
+			apiErr, ok := err.(*apiError)
+			if !ok {
+				apiErr = &apiError{status: http.StatusInternalServerError, message: err.Error()}
+			}
+			w.WriteHeader(apiErr.status)
+			json.NewEncoder(w).Encode(map[string]any{"data": nil, "message": apiErr.message + "\n", "errors": apiErr.errors})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data})
+	}
+}
+
+// startTask records a task and returns its UPID. A non-empty failure makes
+// the task fail with it.
+func (s *Server) startTask(kind, id, failure string) string {
+	upid := fmt.Sprintf("UPID:%s:%08X:00000000:00000000:%s:%s:%s:", Node, len(s.tasks)+1, kind, id, TokenID)
+	exitStatus := "OK"
+	if failure != "" {
+		exitStatus = failure
+	}
+	s.tasks[upid] = &task{exitStatus: exitStatus}
+	return upid
+}
+
+// vm returns the VM of the request's {vmid}.
+func (s *Server) vm(r *http.Request) (int, *VM, error) {
+	vmid, err := strconv.Atoi(r.PathValue("vmid"))
+	if err != nil {
+		return 0, nil, paramError("vmid", "type check ('integer') failed - got '%s'", r.PathValue("vmid"))
+	}
+	vm, ok := s.vms[vmid]
+	if !ok {
+		return vmid, nil, errorf("Configuration file 'nodes/%s/qemu-server/%d.conf' does not exist", Node, vmid)
+	}
+	return vmid, vm, nil
+}
+
+// options returns the form parameters of a request, excluding names.
+func options(r *http.Request, exclude ...string) (map[string]string, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, paramError("body", "%v", err)
+	}
+	opts := make(map[string]string)
+	for k, v := range r.PostForm {
+		if !slices.Contains(exclude, k) {
+			opts[k] = v[len(v)-1]
+		}
+	}
+	return opts, nil
+}
+
+func (s *Server) resources(r *http.Request) (any, error) {
+	if t := r.URL.Query().Get("type"); t != "" && t != "vm" {
+		return []any{}, nil
+	}
+	ids := make([]int, 0, len(s.vms))
+	for vmid := range s.vms {
+		ids = append(ids, vmid)
+	}
+	sort.Ints(ids)
+	var list []map[string]any
+	for _, vmid := range ids {
+		vm := s.vms[vmid]
+		status := "stopped"
+		if vm.Running {
+			status = "running"
+		}
+		template := 0
+		if vm.Template {
+			template = 1
+		}
+		list = append(list, map[string]any{
+			"id": fmt.Sprintf("qemu/%d", vmid), "type": "qemu", "vmid": vmid,
+			"node": Node, "status": status, "template": template, "name": vm.Config["name"],
+		})
+	}
+	return list, nil
+}
+
+func (s *Server) create(r *http.Request) (any, error) {
+	opts, err := options(r, "vmid")
+	if err != nil {
+		return nil, err
+	}
+	vmid, err := strconv.Atoi(r.PostForm.Get("vmid"))
+	if err != nil {
+		return nil, paramError("vmid", "type check ('integer') failed - got '%s'", r.PostForm.Get("vmid"))
+	}
+	if _, ok := s.vms[vmid]; ok {
+		return nil, errorf("unable to create VM %d - VM %d already exists on node '%s'", vmid, vmid, Node)
+	}
+	vm := &VM{Config: make(map[string]string)}
+	if failure := s.applyConfig(vmid, vm, opts); failure != "" {
+		return nil, errorf("%s", failure)
+	}
+	s.vms[vmid] = vm
+	return s.startTask("qmcreate", strconv.Itoa(vmid), ""), nil
+}
+
+func (s *Server) destroy(r *http.Request) (any, error) {
+	vmid, vm, err := s.vm(r)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Running {
+		return nil, errorf("VM %d is running - destroy failed", vmid)
+	}
+	if r.URL.Query().Get("purge") == "1" || r.URL.Query().Get("destroy-unreferenced-disks") == "1" {
+		for _, st := range s.storages {
+			for volume := range st.Volumes {
+				if strings.HasPrefix(volume, fmt.Sprintf("vm-%d-", vmid)) {
+					delete(st.Volumes, volume)
+				}
+			}
+		}
+	}
+	delete(s.vms, vmid)
+	return s.startTask("qmdestroy", strconv.Itoa(vmid), ""), nil
+}
+
+func (s *Server) stop(r *http.Request) (any, error) {
+	vmid, vm, err := s.vm(r)
+	if err != nil {
+		return nil, err
+	}
+	vm.Running = false
+	return s.startTask("qmstop", strconv.Itoa(vmid), ""), nil
+}
+
+func (s *Server) config(r *http.Request) (any, error) {
+	vmid, vm, err := s.vm(r)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Template {
+		return nil, errorf("VM %d is a template", vmid)
+	}
+	opts, err := options(r, "delete")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Split(r.PostForm.Get("delete"), ",") {
+		delete(vm.Config, strings.TrimSpace(key))
+	}
+	// Imports run in the task, so their failures fail the task.
+	return s.startTask("qmconfig", strconv.Itoa(vmid), s.applyConfig(vmid, vm, opts)), nil
+}
+
+// diskPattern matches a disk option allocating a new volume,
+// "<storage>:<size in GiB>[,<options>]", or importing one with the
+// import-from option, or a cloud-init drive, "<storage>:cloudinit".
+var diskPattern = regexp.MustCompile(`^([^:,]+):([0-9]+|cloudinit)(,.*)?$`)
+
+// applyConfig sets options of a VM, allocating and importing disks, and
+// returns the reason it failed, if any.
+func (s *Server) applyConfig(vmid int, vm *VM, opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := opts[key]
+		if m := diskPattern.FindStringSubmatch(value); m != nil {
+			target, ok := s.storages[m[1]]
+			if !ok {
+				return fmt.Sprintf("storage '%s' does not exist", m[1])
+			}
+			size, _ := strconv.ParseInt(m[2], 10, 64)
+			size <<= 30
+			var rest []string
+			for _, opt := range strings.Split(strings.TrimPrefix(m[3], ","), ",") {
+				source, ok := strings.CutPrefix(opt, "import-from=")
+				if !ok {
+					if opt != "" {
+						rest = append(rest, opt)
+					}
+					continue
+				}
+				storage, volume, _ := strings.Cut(source, ":")
+				st, ok := s.storages[storage]
+				if !ok || !strings.HasPrefix(volume, "import/") {
+					return fmt.Sprintf("'import-from' must be an absolute path or a volume of content type import, got '%s'", source)
+				}
+				if size, ok = st.Volumes[volume]; !ok {
+					return fmt.Sprintf("volume '%s' does not exist", source)
+				}
+			}
+			disk := fmt.Sprintf("vm-%d-cloudinit", vmid)
+			if m[2] != "cloudinit" {
+				for n := 0; ; n++ {
+					disk = fmt.Sprintf("vm-%d-disk-%d", vmid, n)
+					if _, taken := target.Volumes[disk]; !taken {
+						break
+					}
+				}
+			}
+			target.Volumes[disk] = size
+			value = strings.Join(append([]string{m[1] + ":" + disk}, rest...), ",")
+		}
+		vm.Config[key] = value
+	}
+	return ""
+}
+
+func (s *Server) resize(r *http.Request) (any, error) {
+	vmid, vm, err := s.vm(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, paramError("body", "%v", err)
+	}
+	disk, size := r.PostForm.Get("disk"), r.PostForm.Get("size")
+	value, ok := vm.Config[disk]
+	if !ok {
+		return nil, errorf("disk '%s' does not exist", disk)
+	}
+	if !regexp.MustCompile(`^\+?\d+(\.\d+)?[KMGT]?$`).MatchString(size) {
+		return nil, paramError("size", "value does not match the regex pattern")
+	}
+	var kept []string
+	for _, part := range strings.Split(value, ",") {
+		if !strings.HasPrefix(part, "size=") {
+			kept = append(kept, part)
+		}
+	}
+	vm.Config[disk] = strings.Join(append(kept, "size="+strings.TrimPrefix(size, "+")), ",")
+	return s.startTask("resize", strconv.Itoa(vmid), ""), nil
+}
+
+func (s *Server) template(r *http.Request) (any, error) {
+	vmid, vm, err := s.vm(r)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Running {
+		return nil, errorf("you can't convert a VM to template if VM is running")
+	}
+	vm.Template = true
+	vm.Config["template"] = "1"
+	return s.startTask("qmtemplate", strconv.Itoa(vmid), ""), nil
+}
+
+func (s *Server) storageList(r *http.Request) (any, error) {
+	names := make([]string, 0, len(s.storages))
+	for name := range s.storages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var list []map[string]any
+	for _, name := range names {
+		st := s.storages[name]
+		list = append(list, map[string]any{
+			"storage": name, "type": st.Type, "content": strings.Join(st.Content, ","),
+			"avail": st.Available, "active": 1, "enabled": 1,
+		})
+	}
+	return list, nil
+}
+
+func (s *Server) upload(r *http.Request) (any, error) {
+	st, ok := s.storages[r.PathValue("storage")]
+	if !ok {
+		return nil, errorf("storage '%s' does not exist", r.PathValue("storage"))
+	}
+	if r.ContentLength < 0 {
+		return nil, errorf("missing Content-Length")
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, paramError("filename", "%v", err)
+	}
+	content := ""
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, paramError("filename", "property is missing and it is not optional")
+		}
+		if err != nil {
+			return nil, paramError("filename", "%v", err)
+		}
+		switch part.FormName() {
+		case "content":
+			value, _ := io.ReadAll(part)
+			content = string(value)
+			continue
+		case "filename":
+		default:
+			continue
+		}
+		// The file is the last part.
+		if !slices.Contains(st.Content, content) {
+			return nil, errorf("storage '%s' does not support '%s' content", r.PathValue("storage"), content)
+		}
+		name := part.FileName()
+		if content == "import" && !regexp.MustCompile(`\.(qcow2|raw|vmdk)$`).MatchString(name) {
+			return nil, paramError("filename", "wrong file extension")
+		}
+		size, err := io.Copy(io.Discard, part)
+		if err != nil {
+			return nil, errorf("upload failed: %v", err)
+		}
+		st.Volumes[content+"/"+name] = size
+		return s.startTask("imgcopy", "", ""), nil
+	}
+}
+
+func (s *Server) deleteVolume(r *http.Request) (any, error) {
+	st, ok := s.storages[r.PathValue("storage")]
+	if !ok {
+		return nil, errorf("storage '%s' does not exist", r.PathValue("storage"))
+	}
+	storage, volume, _ := strings.Cut(r.PathValue("volume"), ":")
+	if storage != r.PathValue("storage") {
+		volume = r.PathValue("volume")
+	}
+	if _, ok := st.Volumes[volume]; !ok {
+		return nil, errorf("volume '%s' does not exist", r.PathValue("volume"))
+	}
+	delete(st.Volumes, volume)
+	return s.startTask("imgdel", "", ""), nil
+}
+
+func (s *Server) taskStatus(r *http.Request) (any, error) {
+	t, ok := s.tasks[r.PathValue("upid")]
+	if !ok {
+		return nil, errorf("no such task")
+	}
+	if !t.polled {
+		t.polled = true
+		return map[string]any{"status": "running", "upid": r.PathValue("upid")}, nil
+	}
+	return map[string]any{"status": "stopped", "exitstatus": t.exitStatus, "upid": r.PathValue("upid")}, nil
+}
@@ -0,0 +1,137 @@
+package pve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Shell is the Backend running qm and pvesm on the node itself, as root.
+type Shell struct{}
+
+// run runs a command and returns its output. A failure carries the output.
+func (Shell) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return out, fmt.Errorf("%s %s: %w: %s", name, args[0], err, msg)
+		}
+		return out, fmt.Errorf("%s %s: %w", name, args[0], err)
+	}
+	return out, nil
+}
+
+// status returns the status of a VM as reported by qm status, e.g.
+// "running", or "" if the VM does not exist.
+func (s Shell) status(ctx context.Context, vmid int) (string, error) {
+	out, err := exec.CommandContext(ctx, "qm", "status", strconv.Itoa(vmid)).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(out)), "status:")), nil
+}
+
+// VMExists implements Backend.
+func (s Shell) VMExists(ctx context.Context, vmid int) (bool, error) {
+	status, err := s.status(ctx, vmid)
+	return status != "", err
+}
+
+// CreateVM implements Backend.
+func (s Shell) CreateVM(ctx context.Context, vmid int, options Options) error {
+	return s.qm(ctx, Operation{Op: "create", VMID: vmid, Options: options})
+}
+
+// DestroyVM implements Backend.
+func (s Shell) DestroyVM(ctx context.Context, vmid int) error {
+	status, err := s.status(ctx, vmid)
+	if err != nil || status == "" {
+		return err
+	}
+	if status == "running" {
+		if _, err := s.run(ctx, "qm", "stop", strconv.Itoa(vmid)); err != nil {
+			return err
+		}
+	}
+	return s.qm(ctx, Operation{Op: "destroy", VMID: vmid})
+}
+
+// ImportDisk implements Backend.
+func (s Shell) ImportDisk(ctx context.Context, vmid int, disk, file, storage string, options Options) error {
+	// qm only imports from absolute paths.
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	return s.qm(ctx, Operation{Op: "import_disk", VMID: vmid, Disk: disk, File: file, Storage: storage, Options: options})
+}
+
+// ResizeDisk implements Backend.
+func (s Shell) ResizeDisk(ctx context.Context, vmid int, disk, size string) error {
+	return s.qm(ctx, Operation{Op: "resize", VMID: vmid, Disk: disk, Size: size})
+}
+
+// SetOptions implements Backend.
+func (s Shell) SetOptions(ctx context.Context, vmid int, options Options) error {
+	return s.qm(ctx, Operation{Op: "set", VMID: vmid, Options: options})
+}
+
+// ConvertToTemplate implements Backend.
+func (s Shell) ConvertToTemplate(ctx context.Context, vmid int) error {
+	return s.qm(ctx, Operation{Op: "template", VMID: vmid})
+}
+
+// qm runs the qm command line of an operation.
+func (s Shell) qm(ctx context.Context, op Operation) error {
+	_, err := s.run(ctx, "qm", op.Args()...)
+	return err
+}
+
+// StorageStatus implements Backend with pvesm status.
+func (s Shell) StorageStatus(ctx context.Context) (map[string]Storage, error) {
+	out, err := exec.CommandContext(ctx, "pvesm", "status").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("pvesm status failed: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return parseStorageStatus(out)
+}
+
+// parseStorageStatus parses the output of pvesm status, whose sizes are in
+// KiB:
+//
+//	Name        Type     Status     Total      Used  Available       %
+//	local        dir     active  98497780  12345678   81080588  12.54%
+func parseStorageStatus(out []byte) (map[string]Storage, error) {
+	storages := make(map[string]Storage)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for first := true; scanner.Scan(); first = false {
+		fields := strings.Fields(scanner.Text())
+		if first || len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 6 {
+			return nil, fmt.Errorf("unexpected pvesm status line %q", scanner.Text())
+		}
+		available, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected pvesm status line %q", scanner.Text())
+		}
+		storages[fields[0]] = Storage{Type: fields[1], Available: available * 1024}
+	}
+	return storages, scanner.Err()
+}
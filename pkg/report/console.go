@@ -0,0 +1,133 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+)
+
+// Console is a Reporter that prints line-oriented progress, suitable for
+// cron jobs, systemd units and CI logs.
+type Console struct {
+	Out io.Writer
+	Err io.Writer
+
+	mu      sync.Mutex
+	total   int
+	percent map[int]int64
+	partial map[int]string
+}
+
+// NewConsole creates a Console reporter writing to the given streams.
+func NewConsole(out, err io.Writer) *Console {
+	return &Console{
+		Out:     out,
+		Err:     err,
+		percent: make(map[int]int64),
+		partial: make(map[int]string),
+	}
+}
+
+// Report implements Reporter.
+func (c *Console) Report(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch e.Kind {
+	case RunStarted:
+		c.total = len(e.Plan)
+		fmt.Fprintf(c.Out, "Processing %d image(s)\n", len(e.Plan))
+	case ImageStarted:
+		fmt.Fprintf(c.Out, "==> [%d/%d] %s\n", e.Image+1, c.total, e.Name)
+	case StepStarted:
+		c.flush(e)
+		fmt.Fprintf(c.Out, "[%s] %s\n", e.Name, e.StepName)
+		if e.Command != "" {
+			fmt.Fprintf(c.Out, "[%s] $ %s\n", e.Name, style.Yellow(e.Command))
+		}
+	case StepFinished:
+		c.flush(e)
+		switch e.Status {
+		case StatusSuccess:
+			fmt.Fprintf(c.Out, "[%s] %s: %s\n", e.Name, e.StepName, style.Green("ok"))
+		case StatusFailed:
+			fmt.Fprintf(c.Out, "[%s] %s: %s\n", e.Name, e.StepName, style.Red("failed"))
+			if e.Error != "" {
+				fmt.Fprintf(c.Err, "[%s] %s: %s\n", e.Name, e.StepName, e.Error)
+			}
+		default:
+			fmt.Fprintf(c.Out, "[%s] %s: %s\n", e.Name, e.StepName, e.Status)
+		}
+	case StepRetrying:
+		c.flush(e)
+		fmt.Fprintf(c.Out, "[%s] %s: %s, retrying in %s\n", e.Name, e.StepName,
+			style.Yellow(fmt.Sprintf("attempt %d/%d failed", e.Attempt, e.Attempts)), e.Delay.Round(time.Second/10))
+		if e.Error != "" {
+			fmt.Fprintf(c.Err, "[%s] %s: %s\n", e.Name, e.StepName, e.Error)
+		}
+	case Output:
+		// Text is buffered until a full line is available.
+		buf := c.partial[e.Image] + e.Text
+		for {
+			i := strings.IndexByte(buf, '\n')
+			if i < 0 {
+				break
+			}
+			fmt.Fprintf(c.Out, "[%s] | %s\n", e.Name, buf[:i])
+			buf = buf[i+1:]
+		}
+		c.partial[e.Image] = buf
+	case DownloadProgress:
+		// Progress is printed in 10% increments.
+		if e.Total <= 0 {
+			return
+		}
+		pct := e.Done * 100 / e.Total
+		if pct/10 == c.percent[e.Image]/10 && e.Done != e.Total {
+			return
+		}
+		c.percent[e.Image] = pct
+		fmt.Fprintf(c.Out, "[%s] downloaded %d%% (%d/%d bytes)\n", e.Name, pct, e.Done, e.Total)
+	case CopyProgress:
+		if e.Total <= 0 {
+			return
+		}
+		pct := e.Done * 100 / e.Total
+		if pct/10 == c.percent[e.Image]/10 && e.Done != e.Total {
+			return
+		}
+		c.percent[e.Image] = pct
+		fmt.Fprintf(c.Out, "[%s] copied %d%% (%d/%d bytes, %.1f MiB/s)\n", e.Name, pct, e.Done, e.Total, e.Rate/(1<<20))
+	case ImageFinished:
+		c.flush(e)
+		delete(c.percent, e.Image)
+		if e.Status == StatusFailed {
+			fmt.Fprintf(c.Out, "<== %s %s\n", e.Name, style.Red("FAILED"))
+		} else {
+			fmt.Fprintf(c.Out, "<== %s %s\n", e.Name, style.Green("done"))
+		}
+	case RunFinished:
+		if len(e.Failed) == 0 {
+			fmt.Fprintln(c.Out, style.Green("All steps completed successfully!"))
+			return
+		}
+		fmt.Fprintln(c.Err, style.Red("The following images failed:"))
+		for _, name := range e.Failed {
+			fmt.Fprintf(c.Err, "- %s\n", name)
+		}
+	case RunFailed:
+		fmt.Fprintln(c.Err, style.Red(e.Error))
+	}
+}
+
+// flush prints any buffered partial output line of the event's image.
+func (c *Console) flush(e Event) {
+	if rest := c.partial[e.Image]; rest != "" {
+		fmt.Fprintf(c.Out, "[%s] | %s\n", e.Name, rest)
+		c.partial[e.Image] = ""
+	}
+}
@@ -0,0 +1,26 @@
+package report
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// JSON is a Reporter that writes every event as a single line of JSON.
+type JSON struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSON creates a JSON reporter writing to w.
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{enc: json.NewEncoder(w)}
+}
+
+// Report implements Reporter. Encoding errors are ignored so that a broken
+// log sink never aborts a run.
+func (j *JSON) Report(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_ = j.enc.Encode(e)
+}
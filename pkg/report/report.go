@@ -0,0 +1,232 @@
+package report
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is the state of a single step in the pipeline.
+type Status string
+
+const (
+	// StatusPending is the state of a step that has not started yet.
+	StatusPending Status = "pending"
+	// StatusRunning is the state of the step currently being executed.
+	StatusRunning Status = "running"
+	// StatusSuccess is the state of a step that completed successfully.
+	StatusSuccess Status = "success"
+	// StatusFailed is the state of a step that returned an error.
+	StatusFailed Status = "failed"
+	// StatusSkipped is the state of a step that was not executed.
+	StatusSkipped Status = "skipped"
+)
+
+// Kind identifies the type of an Event.
+type Kind string
+
+const (
+	// RunStarted announces the plan: the images and steps about to be processed.
+	RunStarted Kind = "run_started"
+	// ImageStarted is emitted when processing of an image begins.
+	ImageStarted Kind = "image_started"
+	// StepStarted is emitted when a step begins, with the command being run.
+	StepStarted Kind = "step_started"
+	// StepFinished is emitted when a step succeeds, fails or is skipped.
+	StepFinished Kind = "step_finished"
+	// StepRetrying is emitted when an attempt of a step failed and the step
+	// is about to be retried after Delay.
+	StepRetrying Kind = "step_retrying"
+	// Output carries a chunk of command or informational output.
+	Output Kind = "output"
+	// DownloadProgress reports the number of bytes downloaded so far.
+	DownloadProgress Kind = "download_progress"
+	// CopyProgress reports the number of bytes of an image copied so far,
+	// with the throughput in Rate.
+	CopyProgress Kind = "copy_progress"
+	// ImageFinished is emitted once all steps of an image are done.
+	ImageFinished Kind = "image_finished"
+	// RunFinished is emitted at the end of the run with the failed images.
+	RunFinished Kind = "run_finished"
+	// RunFailed reports an error that aborts the whole run.
+	RunFailed Kind = "run_failed"
+)
+
+// PlannedImage describes an image and the steps that will be run for it.
+type PlannedImage struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Steps []string `json:"steps"`
+}
+
+// Event is a single progress notification. Images and steps are identified
+// by their index in the plan; run-level events use -1 for both.
+type Event struct {
+	Kind     Kind           `json:"kind"`
+	Time     time.Time      `json:"time"`
+	Image    int            `json:"image"`
+	Name     string         `json:"name,omitempty"`
+	Step     int            `json:"step"`
+	StepName string         `json:"step_name,omitempty"`
+	Status   Status         `json:"status,omitempty"`
+	Command  string         `json:"command,omitempty"`
+	Text     string         `json:"text,omitempty"`
+	Done     int64          `json:"done,omitempty"`
+	Total    int64          `json:"total,omitempty"`
+	Rate     float64        `json:"rate,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Attempt  int            `json:"attempt,omitempty"`
+	Attempts int            `json:"attempts,omitempty"`
+	Delay    time.Duration  `json:"delay,omitempty"`
+	Plan     []PlannedImage `json:"plan,omitempty"`
+	Parallel int            `json:"parallel,omitempty"`
+	Failed   []string       `json:"failed,omitempty"`
+}
+
+// Reporter receives progress events from the generator. Implementations
+// must be safe for concurrent use.
+type Reporter interface {
+	Report(Event)
+}
+
+// Multi fans events out to several reporters.
+type Multi []Reporter
+
+// Report implements Reporter.
+func (m Multi) Report(e Event) {
+	for _, r := range m {
+		r.Report(e)
+	}
+}
+
+// Recorder is a Reporter that keeps every event in memory.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Report implements Reporter.
+func (r *Recorder) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+// Events returns a copy of the recorded events.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// --- Run-level helpers ---
+
+// Start emits a RunStarted event for the given plan, processed by parallel
+// workers.
+func Start(r Reporter, plan []PlannedImage, parallel int) {
+	r.Report(Event{Kind: RunStarted, Time: time.Now(), Image: -1, Step: -1, Plan: plan, Parallel: parallel})
+}
+
+// Finish emits a RunFinished event with the names of the failed images.
+func Finish(r Reporter, failed []string) {
+	r.Report(Event{Kind: RunFinished, Time: time.Now(), Image: -1, Step: -1, Failed: failed})
+}
+
+// Fail emits a RunFailed event and returns err.
+func Fail(r Reporter, err error) error {
+	r.Report(Event{Kind: RunFailed, Time: time.Now(), Image: -1, Step: -1, Error: err.Error()})
+	return err
+}
+
+// --- Image-level helpers ---
+
+// Scope binds a Reporter to a single planned image so that callers do not
+// have to fill in the image fields of every event.
+type Scope struct {
+	Reporter Reporter
+	Index    int
+	Image    PlannedImage
+}
+
+// NewScope returns a Scope for the image at index in plan.
+func NewScope(r Reporter, plan []PlannedImage, index int) Scope {
+	return Scope{Reporter: r, Index: index, Image: plan[index]}
+}
+
+func (s Scope) event(kind Kind, step int) Event {
+	e := Event{Kind: kind, Time: time.Now(), Image: s.Index, Name: s.Image.Name, Step: step}
+	if step >= 0 && step < len(s.Image.Steps) {
+		e.StepName = s.Image.Steps[step]
+	}
+	return e
+}
+
+// Started emits an ImageStarted event.
+func (s Scope) Started() {
+	s.Reporter.Report(s.event(ImageStarted, -1))
+}
+
+// Finished emits an ImageFinished event.
+func (s Scope) Finished(failed bool) {
+	e := s.event(ImageFinished, -1)
+	e.Status = StatusSuccess
+	if failed {
+		e.Status = StatusFailed
+	}
+	s.Reporter.Report(e)
+}
+
+// StepStarted emits a StepStarted event. An empty command means the step is
+// performed by the generator itself.
+func (s Scope) StepStarted(step int, command string) {
+	e := s.event(StepStarted, step)
+	e.Status = StatusRunning
+	e.Command = command
+	s.Reporter.Report(e)
+}
+
+// StepFinished emits a StepFinished event with the final status of a step.
+func (s Scope) StepFinished(step int, status Status, err error) {
+	e := s.event(StepFinished, step)
+	e.Status = status
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.Reporter.Report(e)
+}
+
+// StepRetrying emits a StepRetrying event for a failed attempt of a step.
+func (s Scope) StepRetrying(step, attempt, attempts int, err error, delay time.Duration) {
+	e := s.event(StepRetrying, step)
+	e.Status = StatusRunning
+	e.Attempt = attempt
+	e.Attempts = attempts
+	e.Delay = delay
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.Reporter.Report(e)
+}
+
+// Output emits an Output event.
+func (s Scope) Output(text string) {
+	e := s.event(Output, -1)
+	e.Text = text
+	s.Reporter.Report(e)
+}
+
+// DownloadProgress emits a DownloadProgress event.
+func (s Scope) DownloadProgress(done, total int64) {
+	e := s.event(DownloadProgress, -1)
+	e.Done = done
+	e.Total = total
+	s.Reporter.Report(e)
+}
+
+// CopyProgress emits a CopyProgress event; rate is in bytes per second.
+func (s Scope) CopyProgress(done, total int64, rate float64) {
+	e := s.event(CopyProgress, -1)
+	e.Done = done
+	e.Total = total
+	e.Rate = rate
+	s.Reporter.Report(e)
+}
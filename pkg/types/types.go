@@ -1,6 +1,6 @@
 package types
 
-import "github.com/rivo/tview"
+import "time"
 
 // Image represents a cloud image to be processed.
 type Image struct {
@@ -8,25 +8,411 @@ type Image struct {
 	Name        string `json:"name"`
 	URL         string `json:"url"`
 	ChecksumURL string `json:"checksum_url"`
-	Tags        string `json:"tags"`
-	Vendor      string `json:"vendor"`
+	// Checksum pins the expected checksum of the image, e.g.
+	// "sha256:5a1b...". It takes precedence over ChecksumURL.
+	Checksum string `json:"checksum,omitempty"`
+	Tags     string `json:"tags"`
+	Vendor   string `json:"vendor"`
+	// Format is the disk format of the image, one of the Format constants.
+	// It is detected from the image when empty.
+	Format string `json:"format,omitempty"`
+	// Compression is how the downloaded file is packed, one of the
+	// Compression constants, or "tar.<compression>" for a compressed tar
+	// archive such as "tar.xz". It is detected from the file when empty.
+	// Checksums always apply to the downloaded file.
+	Compression string `json:"compression,omitempty"`
+	// ArchiveMember is the name, or a shell pattern such as "*.raw", of the
+	// disk inside a tar archive. Empty means the first regular file.
+	ArchiveMember string `json:"archive_member,omitempty"`
+	// Mirrors are base URLs the image is also available from, tried in
+	// order after URL. The image is at Path below each of them.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Path is the location of the image relative to each mirror.
+	Path string `json:"path,omitempty"`
+	// ChecksumPath is the location of the checksum file relative to each
+	// mirror. Empty means ChecksumURL is used for every mirror.
+	ChecksumPath string `json:"checksum_path,omitempty"`
+	// ProbeMirrors tries the fastest responding source first.
+	ProbeMirrors bool `json:"probe_mirrors,omitempty"`
+	// Resolver, if set, finds the newest build of the image at build time
+	// instead of URL and ChecksumURL.
+	Resolver *Resolver `json:"resolver,omitempty"`
+	// GPG, if set, requires the checksum file to be signed by a key of
+	// the given keyring.
+	GPG *GPG `json:"gpg,omitempty"`
+	// Profile names a hardware profile from the settings file.
+	Profile string `json:"profile,omitempty"`
+	// Hardware overrides individual values of the profile and defaults.
+	Hardware *Hardware `json:"hardware,omitempty"`
+	// Vars override the global variables of the settings file.
+	Vars map[string]string `json:"vars,omitempty"`
+	// Pipeline names the step pipeline from steps.json. Empty means "default".
+	Pipeline string `json:"pipeline,omitempty"`
+	// Steps adds, removes or replaces individual steps of the pipeline.
+	Steps *StepOverrides `json:"steps,omitempty"`
+}
+
+// Disk formats of an image. Anything but FormatQcow2 is converted with
+// qemu-img before the steps run.
+const (
+	FormatQcow2 = "qcow2"
+	FormatRaw   = "raw"
+	FormatVMDK  = "vmdk"
+	FormatVHDX  = "vhdx"
+	FormatVDI   = "vdi"
+	FormatVPC   = "vpc"
+)
+
+// Compressions of a downloaded image.
+const (
+	CompressionNone  = "none"
+	CompressionGzip  = "gz"
+	CompressionXZ    = "xz"
+	CompressionZstd  = "zst"
+	CompressionBzip2 = "bz2"
+	// CompressionTar is an uncompressed tar archive.
+	CompressionTar = "tar"
+)
+
+// Resolver types.
+const (
+	// ResolverSimplestreams reads an Ubuntu simplestreams product catalog.
+	ResolverSimplestreams = "simplestreams"
+	// ResolverIndex picks the newest file matching a pattern from an HTTP
+	// directory listing.
+	ResolverIndex = "index"
+	// ResolverLatest follows a stable "latest" URL to the file it points to.
+	ResolverLatest = "latest"
+)
+
+// Resolver describes how to find the newest build of an image.
+type Resolver struct {
+	// Type is one of ResolverSimplestreams, ResolverIndex or ResolverLatest.
+	Type string `json:"type"`
+	// URL is the simplestreams catalog, the directory listing or the
+	// latest file, depending on Type.
+	URL string `json:"url"`
+	// Product and Item select the file of a simplestreams catalog, e.g.
+	// "com.ubuntu.cloud:server:24.04:amd64" and "disk1.img".
+	Product string `json:"product,omitempty"`
+	Item    string `json:"item,omitempty"`
+	// Pattern is the regular expression file names of a directory
+	// listing must match. The highest version wins.
+	Pattern string `json:"pattern,omitempty"`
+	// ChecksumFile is the name of the checksum file in the directory of
+	// the resolved image.
+	ChecksumFile string `json:"checksum_file,omitempty"`
+	// ChecksumPattern picks the newest checksum file matching it from the
+	// directory listing instead of ChecksumFile.
+	ChecksumPattern string `json:"checksum_pattern,omitempty"`
+}
+
+// GPG configures the signature verification of an image's checksum file.
+// The signature is either detached, at SignatureURL or SignaturePath, or
+// wrapped around the checksum file itself when Clearsigned is set.
+type GPG struct {
+	// Keyring is the name of a keyring file in the keyring directory.
+	Keyring string `json:"keyring"`
+	// SignatureURL is the URL of the detached signature.
+	SignatureURL string `json:"signature_url,omitempty"`
+	// SignaturePath is the location of the detached signature relative
+	// to each mirror. Empty means SignatureURL is used for every mirror.
+	SignaturePath string `json:"signature_path,omitempty"`
+	// Clearsigned means the checksum file carries its own signature.
+	Clearsigned bool `json:"clearsigned,omitempty"`
+}
+
+// LockFile pins the artifacts of every image for reproducible builds.
+type LockFile struct {
+	Version int           `json:"version"`
+	Images  []LockedImage `json:"images"`
+}
+
+// LockedImage is the artifact an image resolved to when the lock file was
+// written.
+type LockedImage struct {
+	Name string `json:"name"`
+	// URLs are the sources of the image, in the order they are tried.
+	URLs []string `json:"urls"`
+	// Checksum is the checksum of the image, e.g. "sha256:5a1b...".
+	Checksum string `json:"checksum"`
+}
+
+// StateFile records the templates built by previous runs.
+type StateFile struct {
+	Version int          `json:"version"`
+	Images  []BuiltImage `json:"images"`
+}
+
+// BuiltImage is the last successful build of an image.
+type BuiltImage struct {
+	Name string `json:"name"`
+	// ID is the VM ID of the template.
+	ID int `json:"id"`
+	// URL is the source the image was downloaded from.
+	URL string `json:"url"`
+	// Checksum identifies the image the template was built from, e.g.
+	// "sha256:5a1b...".
+	Checksum string `json:"checksum,omitempty"`
+	// Fingerprint identifies the inputs of the build, see
+	// utils.Fingerprint. It is empty if the image has no checksum.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// BuiltAt is when the template was built.
+	BuiltAt time.Time `json:"built_at"`
+}
+
+// Hardware describes the virtual hardware of a template. Zero values are
+// inherited from the image's profile and then from the global defaults.
+type Hardware struct {
+	DiskSize string `json:"disk_size,omitempty"`
+	Memory   int    `json:"memory,omitempty"`
+	Cores    int    `json:"cores,omitempty"`
+	BIOS     string `json:"bios,omitempty"`
+	Machine  string `json:"machine,omitempty"`
+	Bridge   string `json:"bridge,omitempty"`
+	Storage  string `json:"storage,omitempty"`
 }
 
 // Step represents a command to be executed.
 type Step struct {
 	Name    string `json:"name"`
-	Command string `json:"command"`
+	Command string `json:"command,omitempty"`
+	// VM, instead of Command, is an operation on the VM of the image
+	// performed by the configured backend.
+	VM *VMOperation `json:"vm,omitempty"`
+	// Lock names a lock held while the step runs. Steps with the same lock
+	// never run concurrently, even when images are built in parallel.
+	Lock string `json:"lock,omitempty"`
+	// Retry overrides the global retry policy of steps for this step.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+// VMOperation is a typed operation on the VM of an image. Its values are
+// templates rendered like step commands.
+type VMOperation struct {
+	// Op is one of the Op constants.
+	Op string `json:"op"`
+	// Options are the VM options of create and set, e.g.
+	// {"memory": "{{.Hardware.Memory}}"}, or the extra disk options of
+	// import_disk, e.g. {"discard": "on"}.
+	Options map[string]string `json:"options,omitempty"`
+	// Disk names the disk of import_disk and resize, e.g. "virtio0".
+	Disk string `json:"disk,omitempty"`
+	// Size is the new size of the disk of resize, e.g. "32G" or "+10G".
+	Size string `json:"size,omitempty"`
+	// Storage is the storage import_disk imports the scratch disk image
+	// into. Empty means the storage of the image's hardware.
+	Storage string `json:"storage,omitempty"`
+}
+
+// VM operations.
+const (
+	// OpDestroy stops and removes the VM and its disks, if it exists.
+	OpDestroy = "destroy"
+	// OpCreate creates the VM.
+	OpCreate = "create"
+	// OpImportDisk imports the scratch disk image and attaches it.
+	OpImportDisk = "import_disk"
+	// OpResize resizes a disk.
+	OpResize = "resize"
+	// OpSet changes options of the VM.
+	OpSet = "set"
+	// OpTemplate converts the VM into a template.
+	OpTemplate = "template"
+)
+
+// RetryPolicy controls how a failing operation is retried. Zero values are
+// inherited from the global policy and then from the defaults.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, including the first one.
+	Attempts int `json:"attempts,omitempty"`
+	// Backoff is the delay before the first retry, e.g. "2s". It doubles
+	// for every further retry.
+	Backoff string `json:"backoff,omitempty"`
+	// MaxBackoff caps the delay between two attempts.
+	MaxBackoff string `json:"max_backoff,omitempty"`
+	// Jitter randomizes every delay by up to this fraction of it.
+	Jitter float64 `json:"jitter,omitempty"`
+	// HTTPStatuses lists the HTTP response statuses that are retried.
+	// Network errors are always retried.
+	HTTPStatuses []int `json:"http_statuses,omitempty"`
+	// ExitCodes lists the command exit codes that are retried. Empty means
+	// any failing exit code.
+	ExitCodes []int `json:"exit_codes,omitempty"`
+}
+
+// Retry holds the global retry policies.
+type Retry struct {
+	// Download applies to image downloads and checksum fetches.
+	Download RetryPolicy `json:"download"`
+	// Steps applies to the commands of every step.
+	Steps RetryPolicy `json:"steps"`
+}
+
+// Pipelines maps a pipeline name to its ordered steps.
+type Pipelines map[string][]Step
+
+// StepOverrides customizes the pipeline of a single image. Steps are
+// referred to by name. Removals are applied first, then replacements,
+// then additions.
+type StepOverrides struct {
+	// Remove lists the names of the steps to drop.
+	Remove []string `json:"remove,omitempty"`
+	// Replace swaps the steps with the same name for these.
+	Replace []Step `json:"replace,omitempty"`
+	// Add inserts new steps.
+	Add []StepInsert `json:"add,omitempty"`
+}
+
+// StepInsert is a step added to a pipeline, placed before or after an
+// existing step. Without either it is appended to the end.
+type StepInsert struct {
+	Step
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Paths holds the file system locations used by a run.
+type Paths struct {
+	// ImagesFile is the JSON file listing the images to build.
+	ImagesFile string
+	// StepsFile is the JSON file listing the steps executed for each image.
+	StepsFile string
+	// SettingsFile is the optional JSON file holding global settings.
+	SettingsFile string
+	// LockFile pins the URL and checksum of every image.
+	LockFile string
+	// StateFile records the checksum of every built template.
+	StateFile string
+	// ISODir holds the cache of downloaded images.
+	ISODir string
+	// SnippetsDir is where cloud-init vendor files are copied for Proxmox.
+	SnippetsDir string
+	// CloudInitDir contains the cloud-init vendor files referenced by images.
+	CloudInitDir string
+	// KeyringDir contains the GPG keyrings referenced by images.
+	KeyringDir string
+	// LogDir receives the per-image error logs.
+	LogDir string
+	// WorkDir holds scratch disk images while they are being imported.
+	WorkDir string
+}
+
+// Settings holds global options shared by every image.
+type Settings struct {
+	// Hardware holds the default hardware of every template.
+	Hardware Hardware `json:"hardware"`
+	// Profiles are named hardware presets images can refer to.
+	Profiles map[string]Hardware `json:"profiles"`
+	// Vars are free-form variables available to step commands as {{.Vars.name}}.
+	Vars map[string]string `json:"vars"`
+	// Secrets are variables whose values are only read when steps run,
+	// and are shown as pve.Redacted wherever commands are displayed.
+	Secrets map[string]Secret `json:"secrets,omitempty"`
+	// Retry holds the retry policies of downloads and steps.
+	Retry Retry `json:"retry"`
+	// HTTP configures the client used for every download.
+	HTTP HTTPSettings `json:"http"`
+	// Cache holds the retention rules of the image cache.
+	Cache CacheSettings `json:"cache"`
+	// Backend selects how VM operations are performed.
+	Backend BackendSettings `json:"backend"`
+}
+
+// Secret tells where the value of a secret variable is read from. Env takes
+// precedence over File.
+type Secret struct {
+	// Env names the environment variable holding the value.
+	Env string `json:"env,omitempty"`
+	// File is a file holding the value. Surrounding white space is
+	// ignored.
+	File string `json:"file,omitempty"`
+}
+
+// Backends performing the VM operations of steps.
+const (
+	// BackendShell runs qm on the node itself.
+	BackendShell = "shell"
+	// BackendAPI uses the REST API of a, possibly remote, node.
+	BackendAPI = "api"
+)
+
+// BackendSettings configure the backend performing VM operations. Every
+// value but Type only applies to BackendAPI.
+type BackendSettings struct {
+	// Type is BackendShell or BackendAPI.
+	Type string `json:"type,omitempty"`
+	// URL is the address of the API, e.g. "https://pve.example.com:8006".
+	URL string `json:"url,omitempty"`
+	// Node is the name of the node templates are built on.
+	Node string `json:"node,omitempty"`
+	// TokenID identifies the API token, e.g. "root@pam!ctgen".
+	TokenID string `json:"token_id,omitempty"`
+	// TokenSecretFile is a file holding the secret of the token. The
+	// PVE_CTGEN_TOKEN_SECRET environment variable takes precedence.
+	TokenSecretFile string `json:"token_secret_file,omitempty"`
+	// ImportStorage is the storage disk images are uploaded to before
+	// they are imported. It must allow the "import" content type.
+	ImportStorage string `json:"import_storage,omitempty"`
+	// CABundle is a PEM file of certificates trusted for the API, e.g.
+	// the node's /etc/pve/pve-root-ca.pem.
+	CABundle string `json:"ca_bundle,omitempty"`
+	// PollInterval is the delay between two checks of a running task,
+	// e.g. "1s".
+	PollInterval string `json:"poll_interval,omitempty"`
+}
+
+// CacheSettings are the retention rules applied to the image cache at the
+// end of every run.
+type CacheSettings struct {
+	// Keep is the number of images kept per image name, most recently
+	// used first.
+	Keep int `json:"keep,omitempty"`
+	// MaxSize bounds the total size of the cache, e.g. "20G". The most
+	// recently used image of every name is always kept. Empty means no
+	// limit.
+	MaxSize string `json:"max_size,omitempty"`
+}
+
+// CacheIndex maps image names to the cached files they used.
+type CacheIndex struct {
+	Version int          `json:"version"`
+	Entries []CacheEntry `json:"entries"`
 }
 
-// UISTep represents a step in the UI tree.
-type UISTep struct {
-	Node *tview.TreeNode
-	Name string
+// CacheEntry is a cached file used by an image. Files are stored by
+// checksum, so images sharing a source share an entry's file.
+type CacheEntry struct {
+	Name string `json:"name"`
+	// Checksum identifies the file, e.g. "sha256:5a1b...".
+	Checksum string `json:"checksum"`
+	// URL is the source the file was downloaded from.
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	// AddedAt is when the file was first used by the image, UsedAt the
+	// last time.
+	AddedAt time.Time `json:"added_at"`
+	UsedAt  time.Time `json:"used_at"`
 }
 
-// UIImage represents an image and its UI components.
-type UIImage struct {
-	Node  *tview.TreeNode
-	Image Image
-	Steps []*UISTep
+// HTTPSettings configures the HTTP client used for downloads and checksum
+// fetches. Durations are strings such as "30s".
+type HTTPSettings struct {
+	// ConnectTimeout bounds establishing a connection, including TLS.
+	ConnectTimeout string `json:"connect_timeout,omitempty"`
+	// ResponseTimeout bounds waiting for the response headers.
+	ResponseTimeout string `json:"response_timeout,omitempty"`
+	// IdleTimeout aborts a response when no data arrives for this long.
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	// Proxy is the URL of the proxy for every request. Empty means the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables are used, "direct"
+	// means no proxy at all.
+	Proxy string `json:"proxy,omitempty"`
+	// NoProxy lists the hosts and domains reached without Proxy.
+	NoProxy []string `json:"no_proxy,omitempty"`
+	// CABundle is a PEM file of certificates trusted in addition to the
+	// system ones, e.g. for internal mirrors.
+	CABundle string `json:"ca_bundle,omitempty"`
+	// UserAgent is sent with every request.
+	UserAgent string `json:"user_agent,omitempty"`
 }
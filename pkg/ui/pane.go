@@ -0,0 +1,76 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/aloks98/pve-ctgen/pkg/style"
+
+	"github.com/rivo/tview"
+)
+
+// pane shows the current step, command and live output of one image. When
+// images are built in parallel there is one pane per worker and the step
+// name is shown in the title of the output view to save space.
+type pane struct {
+	Flex        *tview.Flex
+	StepView    *tview.TextView
+	CommandView *tview.TextView
+	OutputView  *tview.TextView
+
+	compact bool
+	// image is the index of the image shown, or -1 if the pane is free.
+	image int
+}
+
+// newPane creates the views of a pane.
+func newPane(compact bool) *pane {
+	stepView := tview.NewTextView()
+	stepView.SetBorder(true)
+	stepView.SetTitle("Current Step")
+	stepView.SetDynamicColors(true)
+
+	commandView := tview.NewTextView()
+	commandView.SetBorder(true)
+	commandView.SetTitle("Command")
+	commandView.SetDynamicColors(true)
+	commandView.SetWrap(true)
+
+	outputView := tview.NewTextView()
+	outputView.SetBorder(true)
+	outputView.SetTitle("Live Output")
+	outputView.SetDynamicColors(true)
+	outputView.SetScrollable(true)
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow)
+	if !compact {
+		flex.AddItem(stepView, 3, 1, false)
+	}
+	flex.AddItem(commandView, 3, 1, false).
+		AddItem(outputView, 0, 1, true)
+
+	return &pane{
+		Flex:        flex,
+		StepView:    stepView,
+		CommandView: commandView,
+		OutputView:  outputView,
+		compact:     compact,
+		image:       -1,
+	}
+}
+
+// startStep clears the pane and shows a new step and its command.
+func (p *pane) startStep(imageName, stepName, command string) {
+	p.StepView.Clear()
+	p.CommandView.Clear()
+	p.OutputView.Clear()
+	p.StepView.SetText(stepName)
+	if p.compact {
+		p.OutputView.SetTitle(fmt.Sprintf("%s: %s", imageName, stepName))
+	}
+	if command == "" {
+		p.CommandView.SetText("No command")
+		return
+	}
+	writer := tview.ANSIWriter(p.CommandView)
+	fmt.Fprint(writer, style.Yellow(command))
+}
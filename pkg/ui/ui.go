@@ -2,20 +2,45 @@ package ui
 
 import (
 	"fmt"
-	"github.com/aloks98/pve-ctgen/pkg/types"
 	"strings"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/types"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-// UI holds all the UI components.
+// uiStep represents a step in the UI tree.
+type uiStep struct {
+	Node   *tview.TreeNode
+	Name   string
+	Status report.Status
+	// Attempt describes the current attempt of a retried step, e.g. "2/3".
+	Attempt string
+}
+
+// uiImage represents an image and its UI components.
+type uiImage struct {
+	Node  *tview.TreeNode
+	Name  string
+	Steps []*uiStep
+}
+
+// UI holds all the UI components. It implements report.Reporter.
 type UI struct {
-	App        *tview.Application
-	StepsTree  *tview.TreeView
-	StepView   *tview.TextView
-	CommandView *tview.TextView
-	OutputView *tview.TextView
+	App       *tview.Application
+	StepsTree *tview.TreeView
+
+	pages      *tview.Pages
+	rightPanel *tview.Flex
+	panes      []*pane
+	images     []*uiImage
+	// paneOf maps the index of an in-flight image to its pane.
+	paneOf   map[int]*pane
+	parallel bool
 }
 
 // NewUI creates and initializes a new UI.
@@ -28,119 +53,340 @@ func NewUI() *UI {
 	stepsTree.SetCurrentNode(stepsTree.GetRoot())
 	stepsTree.SetBorder(true).SetTitle("Progress")
 
-	stepView := tview.NewTextView()
-	stepView.SetBorder(true)
-	stepView.SetTitle("Current Step")
-	stepView.SetDynamicColors(true)
-
-	commandView := tview.NewTextView()
-	commandView.SetBorder(true)
-	commandView.SetTitle("Command")
-	commandView.SetDynamicColors(true)
-	commandView.SetWrap(true)
-
-	outputView := tview.NewTextView()
-	outputView.SetBorder(true)
-	outputView.SetTitle("Live Output")
-	outputView.SetDynamicColors(true)
-	outputView.SetScrollable(true)
+	single := newPane(false)
+	rightPanel := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(single.Flex, 0, 1, true)
 
 	return &UI{
 		App:        app,
 		StepsTree:  stepsTree,
-		StepView:   stepView,
-		CommandView: commandView,
-		OutputView: outputView,
+		rightPanel: rightPanel,
+		panes:      []*pane{single},
+		paneOf:     make(map[int]*pane),
 	}
 }
 
-// BuildUITree creates the tree structure in the UI.
-func (ui *UI) BuildUITree(images []types.Image, steps []types.Step) []*types.UIImage {
-	rootNode := ui.StepsTree.GetRoot()
-	uiImages := make([]*types.UIImage, len(images))
+// Run lays out the UI, starts work in the background and blocks until the
+// user exits. The error returned by work is returned once the UI stops.
+func (ui *UI) Run(work func() error) error {
+	layout := tview.NewFlex().
+		AddItem(ui.StepsTree, 0, 1, true).AddItem(ui.rightPanel, 0, 3, true)
 
-	staticSteps := []string{"Download/Verify", "Copy Image"}
+	ui.pages = tview.NewPages().
+		AddPage("main", layout, true, true)
 
-	for i, img := range images {
-		imgNode := tview.NewTreeNode(fmt.Sprintf("🖼️  %s", img.Name)).SetColor(tcell.ColorGrey)
-		rootNode.AddChild(imgNode)
+	doneChan := make(chan struct{})
 
-		uiImage := &types.UIImage{Node: imgNode, Image: img}
+	layout.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyEscape {
+			select {
+			case <-doneChan:
+				ui.App.Stop()
+			default:
+				confirm := tview.NewModal().
+					SetText("Are you sure you want to quit?").
+					AddButtons([]string{"Quit", "Cancel"}).
+					SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+						if buttonLabel == "Quit" {
+							ui.App.Stop()
+						}
+						ui.pages.RemovePage("confirm")
+					})
+				ui.pages.AddPage("confirm", confirm, true, true)
+			}
+
+		}
+		return event
+	})
+
+	var workErr error
+	go func() {
+		workErr = work()
+		close(doneChan)
+	}()
+
+	if err := ui.App.SetRoot(ui.pages, true).Run(); err != nil {
+		return err
+	}
+	select {
+	case <-doneChan:
+		return workErr
+	default:
+		return fmt.Errorf("interrupted by user")
+	}
+}
+
+// ChooseImages shows a checklist of all images, with the selected ones
+// checked, and blocks until the user starts the run or cancels it. It must
+// be called from outside the application's event loop.
+func (ui *UI) ChooseImages(all, selected []types.Image) ([]types.Image, error) {
+	checked := make([]bool, len(all))
+	for i, img := range all {
+		for _, sel := range selected {
+			if sel.Name == img.Name {
+				checked[i] = true
+			}
+		}
+	}
 
-		for _, stepName := range staticSteps {
+	type result struct {
+		images []types.Image
+		err    error
+	}
+	done := make(chan result, 1)
+
+	ui.App.QueueUpdateDraw(func() {
+		form := tview.NewForm()
+		for i, img := range all {
+			i := i
+			label := fmt.Sprintf("%d  %-14s %s", img.ID, img.Name, img.Tags)
+			form.AddCheckbox(label, checked[i], func(state bool) {
+				checked[i] = state
+			})
+		}
+		form.AddButton("Start", func() {
+			var chosen []types.Image
+			for i, img := range all {
+				if checked[i] {
+					chosen = append(chosen, img)
+				}
+			}
+			ui.pages.RemovePage("select")
+			done <- result{images: chosen}
+		})
+		form.AddButton("Cancel", func() {
+			ui.pages.RemovePage("select")
+			done <- result{err: fmt.Errorf("Run cancelled")}
+		})
+		form.SetCancelFunc(func() {
+			ui.pages.RemovePage("select")
+			done <- result{err: fmt.Errorf("Run cancelled")}
+		})
+		form.SetBorder(true).SetTitle("Select images to build")
+		ui.pages.AddPage("select", form, true, true)
+	})
+
+	r := <-done
+	return r.images, r.err
+}
+
+// Report implements report.Reporter. All UI updates are queued on the
+// application's event loop, so Report may be called from any goroutine.
+func (ui *UI) Report(e report.Event) {
+	switch e.Kind {
+	case report.RunStarted:
+		ui.buildTree(e.Plan)
+		if e.Parallel > 1 {
+			ui.App.QueueUpdateDraw(func() {
+				ui.buildPanes(e.Parallel)
+			})
+		}
+	case report.ImageStarted:
+		ui.App.QueueUpdateDraw(func() {
+			uiImage := ui.images[e.Image]
+			uiImage.Node.SetColor(tcell.ColorYellow)
+			ui.StepsTree.SetCurrentNode(uiImage.Node)
+			uiImage.Node.Expand()
+			for _, p := range ui.panes {
+				if p.image < 0 {
+					p.image = e.Image
+					ui.paneOf[e.Image] = p
+					break
+				}
+			}
+		})
+	case report.StepStarted:
+		ui.App.QueueUpdateDraw(func() {
+			uiStep := ui.images[e.Image].Steps[e.Step]
+			uiStep.Status = report.StatusRunning
+			setNodeStatus(uiStep)
+			if p := ui.paneOf[e.Image]; p != nil {
+				p.startStep(e.Name, uiStep.Name, e.Command)
+			}
+		})
+	case report.StepRetrying:
+		ui.App.QueueUpdateDraw(func() {
+			uiStep := ui.images[e.Image].Steps[e.Step]
+			uiStep.Attempt = fmt.Sprintf("%d/%d", e.Attempt+1, e.Attempts)
+			setNodeStatus(uiStep)
+			if p := ui.paneOf[e.Image]; p != nil {
+				writer := tview.ANSIWriter(p.OutputView)
+				fmt.Fprint(writer, style.Red(fmt.Sprintf("\nAttempt %d/%d failed: %s\n", e.Attempt, e.Attempts, e.Error)))
+				fmt.Fprint(writer, style.Yellow(fmt.Sprintf("Retrying in %s...\n", e.Delay.Round(time.Second/10))))
+			}
+		})
+	case report.StepFinished:
+		ui.App.QueueUpdateDraw(func() {
+			uiStep := ui.images[e.Image].Steps[e.Step]
+			uiStep.Status = e.Status
+			setNodeStatus(uiStep)
+		})
+	case report.Output:
+		ui.App.QueueUpdateDraw(func() {
+			if p := ui.paneOf[e.Image]; p != nil {
+				p.OutputView.Write([]byte(e.Text))
+			}
+		})
+	case report.DownloadProgress:
+		if e.Total <= 0 {
+			return
+		}
+		percentage := float64(e.Done) / float64(e.Total) * 100
+		ui.App.QueueUpdateDraw(func() {
+			if p := ui.paneOf[e.Image]; p != nil {
+				p.OutputView.Clear()
+				p.OutputView.SetText(fmt.Sprintf("Downloading: %.2f%%", percentage))
+			}
+		})
+	case report.CopyProgress:
+		if e.Total <= 0 {
+			return
+		}
+		percentage := float64(e.Done) / float64(e.Total) * 100
+		ui.App.QueueUpdateDraw(func() {
+			if p := ui.paneOf[e.Image]; p != nil {
+				p.OutputView.Clear()
+				p.OutputView.SetText(fmt.Sprintf("Copying: %.2f%% (%d/%d MiB, %.1f MiB/s)", percentage, e.Done>>20, e.Total>>20, e.Rate/(1<<20)))
+			}
+		})
+	case report.ImageFinished:
+		ui.App.QueueUpdateDraw(func() {
+			ui.finishImage(ui.images[e.Image], e.Status == report.StatusFailed)
+			if p := ui.paneOf[e.Image]; p != nil {
+				p.image = -1
+				delete(ui.paneOf, e.Image)
+			}
+		})
+	case report.RunFinished:
+		ui.showSummary(e.Failed)
+	case report.RunFailed:
+		ui.showErrorModal(e.Error)
+	}
+}
+
+// buildPanes replaces the single output pane with a grid of n compact
+// panes, one per worker.
+func (ui *UI) buildPanes(n int) {
+	ui.parallel = true
+	ui.panes = make([]*pane, n)
+	ui.rightPanel.Clear()
+	var row *tview.Flex
+	for i := range ui.panes {
+		ui.panes[i] = newPane(true)
+		if i%2 == 0 {
+			row = tview.NewFlex()
+			ui.rightPanel.AddItem(row, 0, 1, i == 0)
+		}
+		row.AddItem(ui.panes[i].Flex, 0, 1, i == 0)
+	}
+}
+
+// buildTree creates the tree structure in the UI.
+func (ui *UI) buildTree(plan []report.PlannedImage) {
+	images := make([]*uiImage, len(plan))
+	for i, img := range plan {
+		imgNode := tview.NewTreeNode(fmt.Sprintf("🖼️  %s", img.Name)).SetColor(tcell.ColorGrey)
+		uiImage := &uiImage{Node: imgNode, Name: img.Name}
+		for _, stepName := range img.Steps {
 			stepNode := tview.NewTreeNode(stepName)
-			uiStep := &types.UISTep{Node: stepNode, Name: stepName}
+			uiStep := &uiStep{Node: stepNode, Name: stepName, Status: report.StatusPending}
 			stepNode.SetReference(uiStep)
-			ui.UpdateNodeStatus(stepNode, "pending")
+			setNodeStatus(uiStep)
 			imgNode.AddChild(stepNode)
 			uiImage.Steps = append(uiImage.Steps, uiStep)
 		}
+		images[i] = uiImage
+	}
 
-		for _, step := range steps {
-			stepNode := tview.NewTreeNode(step.Name)
-			uiStep := &types.UISTep{Node: stepNode, Name: step.Name}
-			stepNode.SetReference(uiStep)
-			ui.UpdateNodeStatus(stepNode, "pending")
-			imgNode.AddChild(stepNode)
-			uiImage.Steps = append(uiImage.Steps, uiStep)
+	ui.App.QueueUpdateDraw(func() {
+		ui.images = images
+		rootNode := ui.StepsTree.GetRoot()
+		for _, uiImage := range images {
+			rootNode.AddChild(uiImage.Node)
+		}
+	})
+}
+
+// finishImage marks the remaining steps of a failed image as skipped and
+// sets the final status of the image. Successful images are collapsed so
+// that the images still in flight stay visible.
+func (ui *UI) finishImage(uiImage *uiImage, failed bool) {
+	if failed {
+		for _, uiStep := range uiImage.Steps {
+			if uiStep.Status == report.StatusPending {
+				uiStep.Status = report.StatusSkipped
+				setNodeStatus(uiStep)
+			}
+		}
+		uiImage.Node.SetText(fmt.Sprintf("❌ %s", uiImage.Name))
+	} else {
+		uiImage.Node.SetText(fmt.Sprintf("✅ %s", uiImage.Name))
+		uiImage.Node.Collapse()
+	}
+	uiImage.Node.SetColor(tcell.ColorDefault)
+}
+
+// showSummary writes the final result to the output view.
+func (ui *UI) showSummary(failed []string) {
+	var finalMessage strings.Builder
+	if len(failed) == 0 {
+		finalMessage.WriteString(style.Green("\nAll steps completed successfully!\n"))
+	} else {
+		finalMessage.WriteString(style.Red("\nThe following images failed:\n"))
+		for _, imgName := range failed {
+			finalMessage.WriteString(fmt.Sprintf("- %s\n", imgName))
 		}
-		uiImages[i] = uiImage
 	}
-	ui.App.QueueUpdateDraw(func() {})
-	return uiImages
+	finalMessage.WriteString(style.Yellow("\nPress ESC to exit."))
+
+	ui.App.QueueUpdateDraw(func() {
+		output := ui.panes[0].OutputView
+		if ui.parallel {
+			output.Clear()
+			output.SetTitle("Summary")
+		}
+		writer := tview.ANSIWriter(output)
+		fmt.Fprint(writer, finalMessage.String())
+	})
 }
 
-// UpdateNodeStatus updates the icon and color of a node in the tree.
-func (ui *UI) UpdateNodeStatus(node *tview.TreeNode, status string) {
+// showErrorModal displays a modal with an error message.
+func (ui *UI) showErrorModal(message string) {
+	ui.App.QueueUpdateDraw(func() {
+		modal := tview.NewModal().
+			SetText(message).
+			AddButtons([]string{"Quit"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				ui.App.Stop()
+			})
+		ui.App.SetRoot(modal, false)
+	})
+}
+
+// setNodeStatus updates the icon and color of a step node.
+func setNodeStatus(step *uiStep) {
 	var icon string
 	var color tcell.Color
-	switch status {
-	case "running":
+	switch step.Status {
+	case report.StatusRunning:
 		icon = "⚙️"
 		color = tcell.ColorYellow
-	case "success":
+	case report.StatusSuccess:
 		icon = "✅"
 		color = tcell.ColorGreen
-	case "failed":
+	case report.StatusFailed:
 		icon = "❌"
 		color = tcell.ColorRed
-	case "skipped":
+	case report.StatusSkipped:
 		icon = "➖"
 		color = tcell.ColorDarkGrey
 	default: // pending
 		icon = "❔"
 		color = tcell.ColorGrey
 	}
-	text := strings.TrimLeft(node.GetText(), "✅⚙️❌➖❔ ")
-	ui.App.QueueUpdateDraw(func() {
-		node.SetText(fmt.Sprintf("%s %s", icon, text)).SetColor(color)
-	})
-}
-
-// MarkRemainingStepsAsSkipped marks all pending steps as skipped.
-func (ui *UI) MarkRemainingStepsAsSkipped(steps []*types.UISTep) {
-	for _, step := range steps {
-		text := step.Node.GetText()
-		if strings.HasPrefix(text, "❔") {
-			ui.UpdateNodeStatus(step.Node, "skipped")
-		}
+	text := fmt.Sprintf("%s %s", icon, step.Name)
+	if step.Attempt != "" {
+		text += fmt.Sprintf(" (attempt %s)", step.Attempt)
 	}
-}
-
-// AppendOutput appends text to the output view.
-func (ui *UI) AppendOutput(text string) {
-	ui.App.QueueUpdateDraw(func() {
-		ui.OutputView.Write([]byte(text))
-	})
-}
-
-// ShowErrorModal displays a modal with an error message.
-func (ui *UI) ShowErrorModal(message string) {
-	modal := tview.NewModal().
-		SetText(message).
-		AddButtons([]string{"Quit"}).
-		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-			ui.App.Stop()
-		})
-	ui.App.SetRoot(modal, false)
+	step.Node.SetText(text).SetColor(color)
 }
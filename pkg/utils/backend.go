@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// DefaultBackend is the backend configuration used for any value missing
+// from the settings file.
+var DefaultBackend = types.BackendSettings{
+	Type:          types.BackendShell,
+	ImportStorage: "local",
+	PollInterval:  "1s",
+}
+
+// TokenSecretEnv is the environment variable holding the secret of the API
+// token. It takes precedence over the token_secret_file setting.
+const TokenSecretEnv = "PVE_CTGEN_TOKEN_SECRET"
+
+// NewBackend returns the backend performing VM operations configured in
+// settings. The API backend uses an HTTP client built from the HTTP
+// settings, trusting the backend's CA bundle instead of the global one.
+func NewBackend(settings types.Settings) (pve.Backend, error) {
+	cfg := settings.Backend
+	if field, err := checkBackend(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	if cfg.Type == types.BackendShell {
+		return pve.Shell{}, nil
+	}
+
+	secret, err := tokenSecret(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("token_secret_file: %w", err)
+	}
+	httpCfg := settings.HTTP
+	if cfg.CABundle != "" {
+		httpCfg.CABundle = cfg.CABundle
+	}
+	client, err := NewHTTPClient(httpCfg)
+	if err != nil {
+		return nil, err
+	}
+	pollInterval, _ := time.ParseDuration(cfg.PollInterval)
+	return &pve.Client{
+		URL:           cfg.URL,
+		Node:          cfg.Node,
+		TokenID:       cfg.TokenID,
+		TokenSecret:   secret,
+		ImportStorage: cfg.ImportStorage,
+		HTTP:          client,
+		PollInterval:  pollInterval,
+	}, nil
+}
+
+// tokenSecret returns the secret of the API token, from TokenSecretEnv or
+// the token secret file.
+func tokenSecret(cfg types.BackendSettings) (string, error) {
+	secret, err := ReadSecret(types.Secret{Env: TokenSecretEnv, File: cfg.TokenSecretFile})
+	if errors.Is(err, errNoSecret) {
+		return "", fmt.Errorf("token_secret_file or %s is required", TokenSecretEnv)
+	}
+	return secret, err
+}
+
+// checkBackend reports the first invalid value of a backend configuration,
+// with the JSON name of the offending field.
+func checkBackend(cfg types.BackendSettings) (string, error) {
+	switch cfg.Type {
+	case types.BackendShell:
+		return "", nil
+	case types.BackendAPI:
+	default:
+		return "type", fmt.Errorf("unknown backend %q, expected %s or %s", cfg.Type, types.BackendShell, types.BackendAPI)
+	}
+	if err := checkURL(cfg.URL); err != nil {
+		return "url", err
+	}
+	switch {
+	case cfg.Node == "":
+		return "node", fmt.Errorf("node is required")
+	case !strings.Contains(cfg.TokenID, "@") || !strings.Contains(cfg.TokenID, "!"):
+		return "token_id", fmt.Errorf("token_id must look like user@realm!name, got %q", cfg.TokenID)
+	case cfg.ImportStorage == "":
+		return "import_storage", fmt.Errorf("import_storage is required")
+	}
+	if _, err := tokenSecret(cfg); err != nil {
+		return "token_secret_file", err
+	}
+	if cfg.CABundle != "" {
+		if _, err := loadCABundle(cfg.CABundle); err != nil {
+			return "ca_bundle", err
+		}
+	}
+	if v, err := time.ParseDuration(cfg.PollInterval); err != nil || v <= 0 {
+		return "poll_interval", fmt.Errorf("invalid duration %q", cfg.PollInterval)
+	}
+	return "", nil
+}
+
+// mergeBackend returns base with every non-zero value of override applied.
+func mergeBackend(base, override types.BackendSettings) types.BackendSettings {
+	if override.Type != "" {
+		base.Type = override.Type
+	}
+	if override.URL != "" {
+		base.URL = override.URL
+	}
+	if override.Node != "" {
+		base.Node = override.Node
+	}
+	if override.TokenID != "" {
+		base.TokenID = override.TokenID
+	}
+	if override.TokenSecretFile != "" {
+		base.TokenSecretFile = override.TokenSecretFile
+	}
+	if override.ImportStorage != "" {
+		base.ImportStorage = override.ImportStorage
+	}
+	if override.CABundle != "" {
+		base.CABundle = override.CABundle
+	}
+	if override.PollInterval != "" {
+		base.PollInterval = override.PollInterval
+	}
+	return base
+}
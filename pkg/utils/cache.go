@@ -0,0 +1,374 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// CacheVersion is the version of the cache index format.
+const CacheVersion = 1
+
+// cacheIndexFile is the name of the index in the cache directory.
+const cacheIndexFile = "cache.json"
+
+// DefaultCache is the retention used for any value missing from the
+// settings file: the current and the previous image of every name.
+var DefaultCache = types.CacheSettings{Keep: 2}
+
+// cacheMu serializes updates of the cache index by concurrent builds.
+var cacheMu sync.Mutex
+
+// Cache stores downloaded images by checksum, as <dir>/<algorithm>/<digest>,
+// with an index of the files used by every image.
+type Cache struct {
+	Dir string
+}
+
+// Path returns where the file with the given checksum is stored.
+func (c Cache) Path(sum string) (string, error) {
+	algo, digest, err := checksum.Parse(sum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.Dir, algo, digest), nil
+}
+
+// CacheLock returns the name of the lock held in Locks while the cached
+// file with the given checksum is verified, removed or copied, so that
+// concurrent builds of the same image never remove it under each other.
+func CacheLock(sum string) string {
+	return "cache:" + sum
+}
+
+// Lookup returns the path of the cached file with the given checksum and
+// whether it exists.
+func (c Cache) Lookup(sum string) (string, bool) {
+	path, err := c.Path(sum)
+	if err != nil {
+		return "", false
+	}
+	info, err := os.Stat(path)
+	return path, err == nil && info.Mode().IsRegular()
+}
+
+// Store moves a verified file into the cache and returns its new path.
+func (c Cache) Store(file, sum string) (string, error) {
+	path, err := c.Path(sum)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Remove deletes the cached file with the given checksum.
+func (c Cache) Remove(sum string) error {
+	path, err := c.Path(sum)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// LoadIndex loads the cache index. A missing index is empty.
+func (c Cache) LoadIndex() (types.CacheIndex, error) {
+	index := types.CacheIndex{Version: CacheVersion}
+	path := filepath.Join(c.Dir, cacheIndexFile)
+	file, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("error reading cache index: %w", err)
+	}
+	if err := decodeJSON(file, &index); err != nil {
+		return index, fmt.Errorf("error parsing cache index JSON %s: %w", path, err)
+	}
+	if index.Version != CacheVersion {
+		return index, fmt.Errorf("cache index %s has unsupported version %d", path, index.Version)
+	}
+	return index, nil
+}
+
+// writeIndex atomically replaces the cache index.
+func (c Cache) writeIndex(index types.CacheIndex) error {
+	index.Version = CacheVersion
+	if err := writeJSONFile(filepath.Join(c.Dir, cacheIndexFile), index); err != nil {
+		return fmt.Errorf("error writing cache index: %w", err)
+	}
+	return nil
+}
+
+// Use records that an image used the cached file with the given checksum,
+// downloaded from url.
+func (c Cache) Use(name, sum, url string) error {
+	path, err := c.Path(sum)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	index, err := c.LoadIndex()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for i, entry := range index.Entries {
+		if entry.Name == name && entry.Checksum == sum {
+			entry.URL, entry.Size, entry.UsedAt = url, info.Size(), now
+			index.Entries[i] = entry
+			return c.writeIndex(index)
+		}
+	}
+	index.Entries = append(index.Entries, types.CacheEntry{
+		Name:     name,
+		Checksum: sum,
+		URL:      url,
+		Size:     info.Size(),
+		AddedAt:  now,
+		UsedAt:   now,
+	})
+	return c.writeIndex(index)
+}
+
+// Latest returns the most recently used entry of an image whose file is
+// still cached.
+func (c Cache) Latest(name string) (types.CacheEntry, bool) {
+	index, err := c.LoadIndex()
+	if err != nil {
+		return types.CacheEntry{}, false
+	}
+	var latest types.CacheEntry
+	found := false
+	for _, entry := range index.Entries {
+		if entry.Name != name || (found && !entry.UsedAt.After(latest.UsedAt)) {
+			continue
+		}
+		if _, ok := c.Lookup(entry.Checksum); ok {
+			latest, found = entry, true
+		}
+	}
+	return latest, found
+}
+
+// Prune applies the retention rules of policy: only the Keep most recently
+// used files of every image are kept, then the least recently used files
+// are evicted until the cache fits in MaxSize, always keeping the most
+// recent file of every image. Files no entry refers to are removed as well.
+// It returns the removed entries, with an empty name for unreferenced files,
+// and the number of bytes freed. In dry-run mode nothing is removed.
+func (c Cache) Prune(policy types.CacheSettings, dryRun bool) ([]types.CacheEntry, int64, error) {
+	maxSize, err := ParseSize(policy.MaxSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	index, err := c.LoadIndex()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Most recently used first; entries whose file is gone are dropped.
+	entries := append([]types.CacheEntry(nil), index.Entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].UsedAt.After(entries[j].UsedAt) })
+	var kept, removed []types.CacheEntry
+	count := make(map[string]int)
+	for _, entry := range entries {
+		if _, ok := c.Lookup(entry.Checksum); !ok {
+			continue
+		}
+		count[entry.Name]++
+		if policy.Keep > 0 && count[entry.Name] > policy.Keep {
+			removed = append(removed, entry)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+
+	if maxSize > 0 {
+		newest := make(map[string]string)
+		for _, entry := range kept {
+			if _, ok := newest[entry.Name]; !ok {
+				newest[entry.Name] = entry.Checksum
+			}
+		}
+		for i := len(kept) - 1; i >= 0 && CacheSize(kept) > maxSize; i-- {
+			if newest[kept[i].Name] == kept[i].Checksum {
+				continue
+			}
+			removed = append(removed, kept[i])
+			kept = append(kept[:i], kept[i+1:]...)
+		}
+	}
+
+	inUse := make(map[string]bool)
+	for _, entry := range kept {
+		inUse[entry.Checksum] = true
+	}
+	referenced := make(map[string]bool)
+	for _, entry := range removed {
+		referenced[entry.Checksum] = true
+	}
+	for sum := range inUse {
+		referenced[sum] = true
+	}
+	orphans, err := c.orphans(referenced)
+	if err != nil {
+		return nil, 0, err
+	}
+	removed = append(removed, orphans...)
+
+	var freed int64
+	for _, entry := range removed {
+		if inUse[entry.Checksum] {
+			continue
+		}
+		// Several removed entries may share a file.
+		inUse[entry.Checksum] = true
+		freed += entry.Size
+		if dryRun {
+			continue
+		}
+		if err := c.Remove(entry.Checksum); err != nil {
+			return removed, freed, err
+		}
+	}
+	if dryRun {
+		return removed, freed, nil
+	}
+	index.Entries = kept
+	return removed, freed, c.writeIndex(index)
+}
+
+// orphans returns the cached files no entry refers to, as entries without
+// a name.
+func (c Cache) orphans(referenced map[string]bool) ([]types.CacheEntry, error) {
+	var orphans []types.CacheEntry
+	for _, algo := range []string{checksum.MD5, checksum.SHA1, checksum.SHA224, checksum.SHA256, checksum.SHA384, checksum.SHA512} {
+		files, err := os.ReadDir(filepath.Join(c.Dir, algo))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			sum := checksum.Format(algo, file.Name())
+			if _, _, err := checksum.Parse(sum); err != nil || referenced[sum] || !file.Type().IsRegular() {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				return nil, err
+			}
+			orphans = append(orphans, types.CacheEntry{Checksum: sum, Size: info.Size(), UsedAt: info.ModTime()})
+		}
+	}
+	return orphans, nil
+}
+
+// CacheSize returns the total size of the files of entries, counting files
+// shared by several images once.
+func CacheSize(entries []types.CacheEntry) int64 {
+	seen := make(map[string]bool)
+	var total int64
+	for _, entry := range entries {
+		if !seen[entry.Checksum] {
+			seen[entry.Checksum] = true
+			total += entry.Size
+		}
+	}
+	return total
+}
+
+// sizePattern matches a size such as "512M" or "1.5T".
+var sizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([KMGT]?)$`)
+
+// ParseSize parses a size in bytes with an optional K, M, G or T suffix
+// (powers of 1024). An empty size is 0.
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m := sizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	for _, unit := range "KMGT" {
+		if m[2] == "" {
+			break
+		}
+		n *= 1024
+		if string(unit) == m[2] {
+			break
+		}
+	}
+	return int64(n), nil
+}
+
+// FormatSize returns a size in bytes for display, such as "1.5G".
+func FormatSize(n int64) string {
+	size := float64(n)
+	for _, unit := range []string{"", "K", "M", "G"} {
+		if size < 1024 {
+			if unit == "" {
+				return strconv.FormatInt(n, 10) + "B"
+			}
+			return strconv.FormatFloat(size, 'f', 1, 64) + unit
+		}
+		size /= 1024
+	}
+	return strconv.FormatFloat(size, 'f', 1, 64) + "T"
+}
+
+// checkCache reports the first invalid value of the cache settings, with the
+// JSON name of the offending field.
+func checkCache(cfg types.CacheSettings) (string, error) {
+	if cfg.Keep < 0 {
+		return "keep", fmt.Errorf("keep must not be negative")
+	}
+	if _, err := ParseSize(cfg.MaxSize); err != nil {
+		return "max_size", err
+	}
+	return "", nil
+}
+
+// mergeCache returns base with every non-zero value of override applied.
+func mergeCache(base, override types.CacheSettings) types.CacheSettings {
+	if override.Keep != 0 {
+		base.Keep = override.Keep
+	}
+	if override.MaxSize != "" {
+		base.MaxSize = override.MaxSize
+	}
+	return base
+}
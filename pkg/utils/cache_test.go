@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// describe returns entries as sorted "name:data" strings, with the data
+// looked up in files.
+func describe(entries []types.CacheEntry, files []cachedFile) []string {
+	var out []string
+	for _, entry := range entries {
+		for _, f := range files {
+			if sumOf(f.data) == entry.Checksum {
+				out = append(out, entry.Name+":"+f.data)
+				break
+			}
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestCachePrune(t *testing.T) {
+	big := strings.Repeat("x", 100)
+	tests := []struct {
+		name   string
+		policy types.CacheSettings
+		files  []cachedFile
+		// wantRemoved and wantKept are "name:data" of the removed entries
+		// and of the entries left in the index.
+		wantRemoved []string
+		wantKept    []string
+		wantFreed   int64
+	}{
+		{
+			name:   "keep the most recent files of every image",
+			policy: types.CacheSettings{Keep: 2},
+			files: []cachedFile{
+				{"a", "a1", 1}, {"a", "a3", 3}, {"a", "a2", 2},
+				{"b", "b1", 1},
+			},
+			wantRemoved: []string{"a:a1"},
+			wantKept:    []string{"a:a2", "a:a3", "b:b1"},
+			wantFreed:   2,
+		},
+		{
+			name:   "no limit",
+			policy: types.CacheSettings{},
+			files: []cachedFile{
+				{"a", "a1", 1}, {"a", "a2", 2}, {"a", "a3", 3},
+			},
+			wantKept: []string{"a:a1", "a:a2", "a:a3"},
+		},
+		{
+			name:   "file shared with a kept image",
+			policy: types.CacheSettings{Keep: 1},
+			files: []cachedFile{
+				{"a", "shared", 1}, {"a", "a2", 2},
+				{"b", "shared", 3},
+			},
+			wantRemoved: []string{"a:shared"},
+			wantKept:    []string{"a:a2", "b:shared"},
+		},
+		{
+			name:   "evict least recently used files to fit max_size",
+			policy: types.CacheSettings{MaxSize: "250"},
+			files: []cachedFile{
+				{"a", big + "1", 1}, {"a", big + "4", 4},
+				{"b", big + "2", 2}, {"b", big + "3", 3},
+			},
+			wantRemoved: []string{"a:" + big + "1", "b:" + big + "2"},
+			wantKept:    []string{"a:" + big + "4", "b:" + big + "3"},
+			wantFreed:   202,
+		},
+		{
+			name:   "max_size never evicts the newest file of an image",
+			policy: types.CacheSettings{Keep: 2, MaxSize: "50"},
+			files: []cachedFile{
+				{"a", big + "1", 1}, {"a", big + "2", 2}, {"a", big + "3", 3},
+				{"b", big + "4", 4},
+			},
+			wantRemoved: []string{"a:" + big + "1", "a:" + big + "2"},
+			wantKept:    []string{"a:" + big + "3", "b:" + big + "4"},
+			wantFreed:   202,
+		},
+		{
+			name:   "files no entry refers to",
+			policy: types.CacheSettings{Keep: 2},
+			files: []cachedFile{
+				{"a", "a1", 1},
+				{"", "orphan", 0},
+			},
+			wantRemoved: []string{":orphan"},
+			wantKept:    []string{"a:a1"},
+			wantFreed:   6,
+		},
+	}
+	for _, tt := range tests {
+		for _, dryRun := range []bool{false, true} {
+			name := tt.name
+			if dryRun {
+				name += " (dry run)"
+			}
+			t.Run(name, func(t *testing.T) {
+				c := fillCache(t, t.TempDir(), tt.files)
+				before, err := c.LoadIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				removed, freed, err := c.Prune(tt.policy, dryRun)
+				if err != nil {
+					t.Fatalf("Prune: %v", err)
+				}
+				if got := describe(removed, tt.files); !slices.Equal(got, tt.wantRemoved) {
+					t.Errorf("removed = %q, want %q", got, tt.wantRemoved)
+				}
+				if freed != tt.wantFreed {
+					t.Errorf("freed = %d, want %d", freed, tt.wantFreed)
+				}
+
+				index, err := c.LoadIndex()
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantKept := tt.wantKept
+				if dryRun {
+					wantKept = describe(before.Entries, tt.files)
+				}
+				if got := describe(index.Entries, tt.files); !slices.Equal(got, wantKept) {
+					t.Errorf("index = %q, want %q", got, wantKept)
+				}
+
+				// A file is gone once no kept entry refers to it.
+				for _, f := range tt.files {
+					_, cached := c.Lookup(sumOf(f.data))
+					want := dryRun || slices.ContainsFunc(wantKept, func(k string) bool { return strings.HasSuffix(k, ":"+f.data) })
+					if cached != want {
+						t.Errorf("%s cached = %v, want %v", f.data, cached, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCachePruneDropsMissingFiles(t *testing.T) {
+	files := []cachedFile{{"a", "a1", 1}, {"a", "a2", 2}}
+	c := fillCache(t, t.TempDir(), files)
+	if err := c.Remove(sumOf("a2")); err != nil {
+		t.Fatal(err)
+	}
+	removed, _, err := c.Prune(types.CacheSettings{Keep: 1}, false)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("removed = %q, want nothing", describe(removed, files))
+	}
+	index, err := c.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := describe(index.Entries, files); !slices.Equal(got, []string{"a:a1"}) {
+		t.Errorf("index = %q, want the entry whose file is still cached", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"512", 512},
+		{"1K", 1024},
+		{"1.5G", 3 << 29},
+		{"2T", 2 << 40},
+	}
+	for _, tt := range tests {
+		if got, err := ParseSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"1KB", "-1", "G", "1.5.0M"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded", in)
+		}
+	}
+}
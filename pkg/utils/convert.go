@@ -0,0 +1,508 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// Packing describes how the disk of a downloaded image is stored.
+type Packing struct {
+	// Compression is one of the types.Compression constants other than
+	// types.CompressionTar.
+	Compression string
+	// Tar reports whether the disk is a member of a tar archive.
+	Tar bool
+	// Member is the name or pattern of the disk in the tar archive. Empty
+	// means the first regular file.
+	Member string
+	// Format is the disk format, or empty if it is not known yet.
+	Format string
+}
+
+// Plain reports whether the image is a qcow2 disk that can be used as is.
+func (p Packing) Plain() bool {
+	return p.Compression == types.CompressionNone && !p.Tar && p.Format == types.FormatQcow2
+}
+
+// String describes the packing for display, e.g. "raw disk in a tar.xz archive".
+func (p Packing) String() string {
+	disk := "disk of unknown format"
+	if p.Format != "" {
+		disk = p.Format + " disk"
+	}
+	switch {
+	case p.Tar && p.Compression != types.CompressionNone:
+		return fmt.Sprintf("%s in a tar.%s archive", disk, p.Compression)
+	case p.Tar:
+		return disk + " in a tar archive"
+	case p.Compression != types.CompressionNone:
+		return fmt.Sprintf("%s compressed with %s", disk, p.Compression)
+	}
+	return disk
+}
+
+// Command returns the shell equivalent of preparing src as the qcow2 disk
+// dst, for display.
+func (p Packing) Command(src, dst string) string {
+	if p.Plain() {
+		return fmt.Sprintf("cp %s %s", src, dst)
+	}
+	convert := func(from string) string {
+		if p.Format == "" {
+			return fmt.Sprintf("qemu-img convert -O qcow2 %s %s", from, dst)
+		}
+		return fmt.Sprintf("qemu-img convert -f %s -O qcow2 %s %s", p.Format, from, dst)
+	}
+	if p.Compression == types.CompressionNone && !p.Tar {
+		return convert(src)
+	}
+
+	var cmd string
+	switch {
+	case p.Compression == types.CompressionNone:
+		cmd = fmt.Sprintf("tar -xOf %s", src)
+	case p.Tar:
+		cmd = fmt.Sprintf("%s -dc %s | tar -xOf -", decompressors[p.Compression], src)
+	default:
+		cmd = fmt.Sprintf("%s -dc %s", decompressors[p.Compression], src)
+	}
+	if p.Tar && p.Member != "" {
+		cmd += fmt.Sprintf(" --wildcards '%s'", p.Member)
+	}
+	if p.Format == types.FormatQcow2 {
+		return fmt.Sprintf("%s > %s", cmd, dst)
+	}
+	unpacked := dst + unpackedSuffix
+	return fmt.Sprintf("%s > %s && %s", cmd, unpacked, convert(unpacked))
+}
+
+// unpackedSuffix is appended to the scratch file to name the unpacked disk
+// while it is converted.
+const unpackedSuffix = ".unpacked"
+
+// decompressors are the tools reading each compression, used to decompress
+// xz and zstd and for display.
+var decompressors = map[string]string{
+	types.CompressionGzip:  "gzip",
+	types.CompressionXZ:    "xz",
+	types.CompressionZstd:  "zstd",
+	types.CompressionBzip2: "bzip2",
+}
+
+// compressionMagic are the leading bytes of each compression.
+var compressionMagic = []struct {
+	compression string
+	magic       []byte
+}{
+	{types.CompressionGzip, []byte{0x1f, 0x8b}},
+	{types.CompressionXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{types.CompressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{types.CompressionBzip2, []byte("BZh")},
+}
+
+// formatMagic are the bytes identifying each disk format at their offset.
+// Disks matching none of them are raw.
+var formatMagic = []struct {
+	format string
+	offset int
+	magic  []byte
+}{
+	{types.FormatQcow2, 0, []byte{'Q', 'F', 'I', 0xfb}},
+	{types.FormatVMDK, 0, []byte("KDMV")},
+	{types.FormatVMDK, 0, []byte("# Disk DescriptorFile")},
+	{types.FormatVHDX, 0, []byte("vhdxfile")},
+	{types.FormatVPC, 0, []byte("conectix")},
+	{types.FormatVDI, 64, []byte{0x7f, 0x10, 0xda, 0xbe}},
+}
+
+// sniffLength is how much of a file is read to detect its packing; a tar
+// header is one block.
+const sniffLength = 512
+
+// sniffCompression returns the compression of a file from its first bytes.
+func sniffCompression(head []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	return types.CompressionNone
+}
+
+// sniffTar reports whether the first bytes of a file are a tar header.
+func sniffTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+// sniffFormat returns the disk format of a file from its first bytes.
+func sniffFormat(head []byte) string {
+	for _, m := range formatMagic {
+		if len(head) >= m.offset+len(m.magic) && bytes.Equal(head[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format
+		}
+	}
+	return types.FormatRaw
+}
+
+// compressionExtensions and formatExtensions map the extensions of an image file name to a
+// compression or a disk format. ".img" is left out since it is used for
+// both raw and qcow2 disks.
+var (
+	compressionExtensions = map[string]string{
+		".gz":  types.CompressionGzip,
+		".xz":  types.CompressionXZ,
+		".zst": types.CompressionZstd,
+		".bz2": types.CompressionBzip2,
+	}
+	formatExtensions = map[string]string{
+		".qcow2": types.FormatQcow2,
+		".raw":   types.FormatRaw,
+		".vmdk":  types.FormatVMDK,
+		".vhdx":  types.FormatVHDX,
+		".vdi":   types.FormatVDI,
+		".vhd":   types.FormatVPC,
+	}
+)
+
+// ParseCompression splits the compression of an image, e.g. "tar.xz", into
+// the compression of the file and whether it is a tar archive.
+func ParseCompression(s string) (string, bool, error) {
+	compression, tar := s, false
+	if s == types.CompressionTar {
+		return types.CompressionNone, true, nil
+	}
+	if rest, ok := strings.CutPrefix(s, types.CompressionTar+"."); ok {
+		compression, tar = rest, true
+	}
+	if _, ok := decompressors[compression]; ok || (compression == types.CompressionNone && !tar) {
+		return compression, tar, nil
+	}
+	return "", false, fmt.Errorf("unknown compression %q, expected %s, %s, %s, %s, %s, %s or %s.<compression>", s,
+		types.CompressionNone, types.CompressionGzip, types.CompressionXZ, types.CompressionZstd, types.CompressionBzip2, types.CompressionTar, types.CompressionTar)
+}
+
+// DetectPacking returns the packing of an image. Values declared by the
+// image are used as is; the others are detected from the downloaded file
+// at path, or guessed from the extensions of the image's URL when path is
+// empty, as in a dry run before the download.
+func DetectPacking(img types.Image, path, url string) (Packing, error) {
+	p := Packing{Member: img.ArchiveMember, Format: img.Format}
+	declared := img.Compression != ""
+	if declared {
+		var err error
+		if p.Compression, p.Tar, err = ParseCompression(img.Compression); err != nil {
+			return p, err
+		}
+	}
+	if path == "" {
+		if !declared {
+			p.Compression, p.Tar = compressionFromName(url)
+		}
+		if p.Format == "" {
+			p.Format = formatFromName(url)
+		}
+		return p, nil
+	}
+
+	if !declared {
+		head, err := readHead(path, Packing{Compression: types.CompressionNone})
+		if err != nil {
+			return p, err
+		}
+		// A tar archive is recognized once decompressed.
+		if p.Compression = sniffCompression(head); p.Compression != types.CompressionNone {
+			if head, err = readHead(path, Packing{Compression: p.Compression}); err != nil {
+				return p, err
+			}
+		}
+		p.Tar = sniffTar(head)
+	}
+	if p.Format == "" {
+		head, err := readHead(path, p)
+		if err != nil {
+			return p, err
+		}
+		p.Format = sniffFormat(head)
+	}
+	return p, nil
+}
+
+// compressionFromName guesses the compression of a file from its name,
+// e.g. "tar.xz" for "debian-13-genericcloud-amd64.tar.xz".
+func compressionFromName(name string) (string, bool) {
+	name = strings.ToLower(path.Base(name))
+	compression := types.CompressionNone
+	if strings.HasSuffix(name, ".tgz") {
+		return types.CompressionGzip, true
+	}
+	if c, ok := compressionExtensions[path.Ext(name)]; ok {
+		compression = c
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	return compression, path.Ext(name) == ".tar"
+}
+
+// formatFromName guesses the disk format of a file from its name, ignoring
+// any compression extension. It returns "" if the name tells nothing.
+func formatFromName(name string) string {
+	name = strings.ToLower(path.Base(name))
+	if _, ok := compressionExtensions[path.Ext(name)]; ok {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	return formatExtensions[path.Ext(name)]
+}
+
+// readHead returns the first bytes of the disk of a file packed as p.
+func readHead(path string, p Packing) ([]byte, error) {
+	r, err := openDisk(path, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return head[:n], nil
+}
+
+// readCloser closes a reader with a custom function.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// openDecompressed opens a file, decompressing it as it is read. gzip and
+// bzip2 are read natively, xz and zstd with their command-line tools.
+func openDecompressed(path, compression string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case types.CompressionNone:
+		return file, nil
+	case types.CompressionGzip:
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error reading gzip header of %s: %w", path, err)
+		}
+		return readCloser{zr, func() error {
+			zr.Close()
+			return file.Close()
+		}}, nil
+	case types.CompressionBzip2:
+		return readCloser{bzip2.NewReader(file), file.Close}, nil
+	case types.CompressionXZ, types.CompressionZstd:
+		return startDecompressor(file, decompressors[compression])
+	}
+	file.Close()
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
+
+// commandReader reads the output of a decompression tool.
+type commandReader struct {
+	name   string
+	out    io.ReadCloser
+	cmd    *exec.Cmd
+	file   *os.File
+	stderr bytes.Buffer
+	eof    bool
+}
+
+// startDecompressor runs the named tool to decompress file.
+func startDecompressor(file *os.File, name string) (io.ReadCloser, error) {
+	r := &commandReader{name: name, file: file, cmd: exec.Command(name, "-dc")}
+	r.cmd.Stdin = file
+	r.cmd.Stderr = &r.stderr
+	out, err := r.cmd.StdoutPipe()
+	if err == nil {
+		err = r.cmd.Start()
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error starting %s: %w", name, err)
+	}
+	r.out = out
+	return r, nil
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.out.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// Close stops the tool. Its failure is only reported if the output was read
+// to the end; a reader closed early is expected to break the pipe.
+func (r *commandReader) Close() error {
+	r.out.Close()
+	err := r.cmd.Wait()
+	r.file.Close()
+	if err != nil && r.eof {
+		return fmt.Errorf("%s failed: %w: %s", r.name, err, strings.TrimSpace(r.stderr.String()))
+	}
+	return nil
+}
+
+// openDisk opens the disk of a file packed as p, decompressing it and
+// extracting it from its tar archive as it is read.
+func openDisk(path string, p Packing) (io.ReadCloser, error) {
+	r, err := openDecompressed(path, p.Compression)
+	if err != nil || !p.Tar {
+		return r, err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			r.Close()
+			if p.Member != "" {
+				return nil, fmt.Errorf("no file matching %q in the tar archive %s", p.Member, path)
+			}
+			return nil, fmt.Errorf("no file in the tar archive %s", path)
+		}
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("error reading the tar archive %s: %w", path, err)
+		}
+		if hdr.FileInfo().Mode().IsRegular() && matchMember(p.Member, hdr.Name) {
+			return readCloser{tr, r.Close}, nil
+		}
+	}
+}
+
+// matchMember reports whether the tar member name matches pattern, either
+// as a whole or by its base name. An empty pattern matches every member.
+func matchMember(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	if ok, _ := path.Match(pattern, name); ok {
+		return true
+	}
+	ok, _ := path.Match(pattern, path.Base(name))
+	return ok
+}
+
+// PrepareImage turns the downloaded image at src, packed as p, into the
+// qcow2 disk dst. The image is decompressed, extracted from its tar archive
+// and converted with qemu-img as needed; a plain qcow2 image is copied.
+func PrepareImage(rep report.Scope, p Packing, src, dst string) error {
+	if p.Plain() {
+		rep.Output(fmt.Sprintf("Copying %s to %s...\n", src, dst))
+		return CopyImage(rep, src, dst)
+	}
+
+	disk := src
+	if p.Compression != types.CompressionNone || p.Tar {
+		disk = dst + unpackedSuffix
+		if p.Format == types.FormatQcow2 {
+			disk = dst
+		} else {
+			defer os.Remove(disk)
+		}
+		rep.Output(fmt.Sprintf("Unpacking %s (%s) to %s...\n", src, p, disk))
+		size, err := unpack(src, p, disk)
+		if err != nil {
+			os.Remove(disk)
+			return err
+		}
+		rep.Output(fmt.Sprintf("Unpacked %s.\n", FormatSize(size)))
+		if p.Format == types.FormatQcow2 {
+			return nil
+		}
+	}
+
+	rep.Output(fmt.Sprintf("Converting %s disk to qcow2...\n", p.Format))
+	if err := ConvertImage(disk, p.Format, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	rep.Output("Conversion complete.\n")
+	return nil
+}
+
+// unpack writes the disk of src, packed as p, to dst and returns its size.
+func unpack(src string, p Packing, dst string) (int64, error) {
+	r, err := openDisk(src, p)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.Create(dst)
+	if err != nil {
+		r.Close()
+		return 0, fmt.Errorf("create destination file failed: %w", err)
+	}
+	size, err := writeSparse(file, r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return size, fmt.Errorf("unpacking %s failed: %w", src, err)
+	}
+	return size, nil
+}
+
+// ConvertImage converts the disk src of the given format to the qcow2 disk
+// dst with qemu-img.
+func ConvertImage(src, format, dst string) error {
+	cmd := exec.Command("qemu-img", "convert", "-f", format, "-O", "qcow2", src, dst)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("qemu-img is required to convert %s disks: %w", format, err)
+		}
+		return fmt.Errorf("qemu-img convert failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// checkPacking checks the declared format and compression of an image.
+func checkPacking(img types.Image) (string, error) {
+	switch img.Format {
+	case "", types.FormatQcow2, types.FormatRaw, types.FormatVMDK, types.FormatVHDX, types.FormatVDI, types.FormatVPC:
+	default:
+		return "format", fmt.Errorf("unknown format %q, expected %s, %s, %s, %s, %s or %s", img.Format,
+			types.FormatQcow2, types.FormatRaw, types.FormatVMDK, types.FormatVHDX, types.FormatVDI, types.FormatVPC)
+	}
+	tar := img.Compression == ""
+	if img.Compression != "" {
+		var err error
+		if _, tar, err = ParseCompression(img.Compression); err != nil {
+			return "compression", err
+		}
+	}
+	if img.ArchiveMember != "" {
+		if !tar {
+			return "archive_member", fmt.Errorf("archive_member is only used with tar archives")
+		}
+		if _, err := path.Match(img.ArchiveMember, ""); err != nil {
+			return "archive_member", fmt.Errorf("invalid pattern %q: %w", img.ArchiveMember, err)
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// disks are the first bytes of a disk of every format.
+var disks = map[string][]byte{
+	types.FormatQcow2: append([]byte{'Q', 'F', 'I', 0xfb, 0, 0, 0, 3}, make([]byte, 1024)...),
+	types.FormatVMDK:  append([]byte("KDMV"), make([]byte, 1024)...),
+	types.FormatVHDX:  append([]byte("vhdxfile"), make([]byte, 1024)...),
+	types.FormatVPC:   append([]byte("conectix"), make([]byte, 1024)...),
+	types.FormatVDI:   append(append([]byte("<<< Oracle VM VirtualBox Disk Image >>>\n"), make([]byte, 24)...), append([]byte{0x7f, 0x10, 0xda, 0xbe}, make([]byte, 1024)...)...),
+	types.FormatRaw:   append([]byte{0xeb, 0x63, 0x90}, make([]byte, 1024)...),
+}
+
+// pack writes disk to dir as name, in a tar archive if tarred, then
+// compressed. The tools of xz, zstd and bzip2 are required for those
+// compressions.
+func pack(t *testing.T, dir, name string, disk []byte, compression string, tarred bool) string {
+	t.Helper()
+	data := disk
+	if tarred {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+		tw.WriteHeader(&tar.Header{Name: "disk.raw", Mode: 0644, Size: int64(len(disk))})
+		tw.Write(disk)
+		tw.Close()
+		data = b.Bytes()
+	}
+	switch compression {
+	case types.CompressionNone:
+	case types.CompressionGzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write(data)
+		zw.Close()
+		data = b.Bytes()
+	default:
+		tool := decompressors[compression]
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not installed", tool)
+		}
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", tool, err)
+		}
+		data = out
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectPacking(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		compression string
+		tar         bool
+		want        string
+	}{
+		{"qcow2", types.FormatQcow2, types.CompressionNone, false, "qcow2 disk"},
+		{"raw", types.FormatRaw, types.CompressionNone, false, "raw disk"},
+		{"vmdk", types.FormatVMDK, types.CompressionNone, false, "vmdk disk"},
+		{"vhdx", types.FormatVHDX, types.CompressionNone, false, "vhdx disk"},
+		{"vhd", types.FormatVPC, types.CompressionNone, false, "vpc disk"},
+		{"vdi", types.FormatVDI, types.CompressionNone, false, "vdi disk"},
+		{"gzip", types.FormatQcow2, types.CompressionGzip, false, "qcow2 disk compressed with gz"},
+		{"xz", types.FormatRaw, types.CompressionXZ, false, "raw disk compressed with xz"},
+		{"zstd", types.FormatRaw, types.CompressionZstd, false, "raw disk compressed with zst"},
+		{"bzip2", types.FormatQcow2, types.CompressionBzip2, false, "qcow2 disk compressed with bz2"},
+		{"tar", types.FormatRaw, types.CompressionNone, true, "raw disk in a tar archive"},
+		{"tar.gz", types.FormatRaw, types.CompressionGzip, true, "raw disk in a tar.gz archive"},
+		{"tar.xz", types.FormatQcow2, types.CompressionXZ, true, "qcow2 disk in a tar.xz archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The file name tells nothing; the packing is sniffed.
+			path := pack(t, t.TempDir(), "image.img", disks[tt.format], tt.compression, tt.tar)
+			p, err := DetectPacking(types.Image{}, path, "https://example.com/image.img")
+			if err != nil {
+				t.Fatalf("DetectPacking: %v", err)
+			}
+			if p.String() != tt.want {
+				t.Errorf("DetectPacking = %s, want %s", p, tt.want)
+			}
+			if p.Plain() != (tt.want == "qcow2 disk") {
+				t.Errorf("Plain = %v for %s", p.Plain(), p)
+			}
+		})
+	}
+}
+
+func TestDetectPackingDeclared(t *testing.T) {
+	dir := t.TempDir()
+	path := pack(t, dir, "image.tar.gz", disks[types.FormatRaw], types.CompressionGzip, true)
+
+	// Declared values are used as is, even when they are wrong.
+	img := types.Image{Compression: "tar.gz", Format: types.FormatQcow2, ArchiveMember: "*.raw"}
+	p, err := DetectPacking(img, path, "")
+	if err != nil {
+		t.Fatalf("DetectPacking: %v", err)
+	}
+	want := Packing{Compression: types.CompressionGzip, Tar: true, Member: "*.raw", Format: types.FormatQcow2}
+	if p != want {
+		t.Errorf("DetectPacking = %+v, want %+v", p, want)
+	}
+
+	// A declared compression is used to sniff the format.
+	p, err = DetectPacking(types.Image{Compression: "tar.gz"}, path, "")
+	if err != nil {
+		t.Fatalf("DetectPacking: %v", err)
+	}
+	if p.Format != types.FormatRaw {
+		t.Errorf("format = %q, want %q", p.Format, types.FormatRaw)
+	}
+
+	if _, err := DetectPacking(types.Image{Compression: "tar.lz4"}, path, ""); err == nil || !strings.Contains(err.Error(), `unknown compression "tar.lz4"`) {
+		t.Errorf("DetectPacking error = %v, want an unknown compression", err)
+	}
+}
+
+func TestDetectPackingFromName(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Packing
+	}{
+		{"https://example.com/noble-server-cloudimg-amd64.img", Packing{Compression: types.CompressionNone}},
+		{"https://example.com/Rocky-9-GenericCloud.qcow2", Packing{Compression: types.CompressionNone, Format: types.FormatQcow2}},
+		{"https://example.com/Fedora-Cloud-Base.raw.xz", Packing{Compression: types.CompressionXZ, Format: types.FormatRaw}},
+		{"https://example.com/debian-13-genericcloud-amd64.tar.xz", Packing{Compression: types.CompressionXZ, Tar: true}},
+		{"https://example.com/openEuler.QCOW2.ZST", Packing{Compression: types.CompressionZstd, Format: types.FormatQcow2}},
+		{"https://example.com/image.tgz", Packing{Compression: types.CompressionGzip, Tar: true}},
+		{"https://example.com/image.tar", Packing{Compression: types.CompressionNone, Tar: true}},
+		{"https://example.com/image.vhd.bz2", Packing{Compression: types.CompressionBzip2, Format: types.FormatVPC}},
+	}
+	for _, tt := range tests {
+		// Without a file, as in a dry run, the packing is guessed.
+		p, err := DetectPacking(types.Image{}, "", tt.url)
+		if err != nil {
+			t.Errorf("DetectPacking(%s): %v", tt.url, err)
+			continue
+		}
+		if p != tt.want {
+			t.Errorf("DetectPacking(%s) = %+v, want %+v", tt.url, p, tt.want)
+		}
+	}
+}
+
+func TestPackingCommand(t *testing.T) {
+	tests := []struct {
+		p    Packing
+		want string
+	}{
+		{Packing{Compression: types.CompressionNone, Format: types.FormatQcow2}, "cp img w/d.qcow2"},
+		{Packing{Compression: types.CompressionNone, Format: types.FormatRaw}, "qemu-img convert -f raw -O qcow2 img w/d.qcow2"},
+		{Packing{Compression: types.CompressionXZ, Format: types.FormatQcow2}, "xz -dc img > w/d.qcow2"},
+		{Packing{Compression: types.CompressionXZ, Tar: true, Member: "*.raw", Format: types.FormatRaw},
+			"xz -dc img | tar -xOf - --wildcards '*.raw' > w/d.qcow2.unpacked && qemu-img convert -f raw -O qcow2 w/d.qcow2.unpacked w/d.qcow2"},
+		{Packing{Compression: types.CompressionNone, Tar: true}, "tar -xOf img > w/d.qcow2.unpacked && qemu-img convert -O qcow2 w/d.qcow2.unpacked w/d.qcow2"},
+	}
+	for _, tt := range tests {
+		if got := tt.p.Command("img", "w/d.qcow2"); got != tt.want {
+			t.Errorf("Command(%s) = %q, want %q", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+)
+
+// CopyImage copies the image src to dst, reporting the progress through
+// rep, and syncs dst to disk before returning. The blocks of src are shared
+// with dst where the file system supports it (reflink); otherwise only the
+// data of src is copied, with copy_file_range where possible, so the holes
+// of sparse images are preserved.
+func CopyImage(rep report.Scope, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open source file failed: %w", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("stat source file failed: %w", err)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("create destination file failed: %w", err)
+	}
+	defer out.Close()
+
+	progress := newCopyProgress(rep, info.Size())
+	method, err := copyData(out, in, info.Size(), progress)
+	if err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+	progress.report()
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync file failed: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("close destination file failed: %w", err)
+	}
+	elapsed := time.Since(progress.start)
+	rep.Output(fmt.Sprintf("Copied %s in %s using %s.\n", FormatSize(info.Size()), elapsed.Round(time.Millisecond), method))
+	return nil
+}
+
+// copyProgress reports the progress of a copy, at most every 100ms.
+type copyProgress struct {
+	rep   report.Scope
+	total int64
+	done  int64
+	start time.Time
+	last  time.Time
+}
+
+func newCopyProgress(rep report.Scope, total int64) *copyProgress {
+	return &copyProgress{rep: rep, total: total, start: time.Now()}
+}
+
+// add records n more bytes copied, or skipped as a hole.
+func (p *copyProgress) add(n int64) {
+	p.done += n
+	if time.Since(p.last) > 100*time.Millisecond {
+		p.report()
+	}
+}
+
+// report emits the current progress.
+func (p *copyProgress) report() {
+	p.last = time.Now()
+	var rate float64
+	if elapsed := p.last.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = float64(p.done) / elapsed
+	}
+	p.rep.CopyProgress(p.done, p.total, rate)
+}
+
+// reader returns r counting the bytes read from it as copied.
+func (p *copyProgress) reader(r io.Reader) io.Reader {
+	return progressReader{r: r, progress: p}
+}
+
+// progressReader adds the bytes read to a copyProgress.
+type progressReader struct {
+	r        io.Reader
+	progress *copyProgress
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+// sparseBlock is the size of the blocks of zeros copySparse leaves as holes.
+const sparseBlock = 64 * 1024
+
+// writeSparse writes r to the empty file, leaving blocks of zeros as holes
+// so that raw disks only take the space of their data, and returns the size
+// of the file.
+func writeSparse(file *os.File, r io.Reader) (int64, error) {
+	size, err := copySparse(file, r)
+	if err != nil {
+		return size, err
+	}
+	// A trailing hole is only part of the file once it is truncated to size.
+	return size, file.Truncate(size)
+}
+
+// copySparse copies r to file at its current offset, seeking over blocks
+// of zeros, and returns the number of bytes copied.
+func copySparse(file *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, 16*sparseBlock)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		for off := 0; off < n; off += sparseBlock {
+			block := buf[off:min(off+sparseBlock, n)]
+			if isZero(block) {
+				if _, err := file.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+					return size, err
+				}
+			} else if _, err := file.Write(block); err != nil {
+				return size, err
+			}
+			size += int64(len(block))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+	return size, nil
+}
+
+// isZero reports whether b only holds zeros.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
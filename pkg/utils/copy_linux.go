@@ -0,0 +1,112 @@
+//go:build linux
+
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRangeChunk bounds a single copy_file_range call so that progress is
+// reported while large extents are copied.
+const copyRangeChunk = 64 << 20
+
+// copyRange is copyFileRange, replaced in tests to take the fallback of
+// copyData.
+var copyRange = copyFileRange
+
+// copyData copies the size bytes of in to out and returns the name of the
+// method used. A reflink is tried first. Otherwise the data extents of in,
+// found with SEEK_DATA and SEEK_HOLE, are copied with copy_file_range,
+// falling back to reading and writing them when the kernel or the file
+// systems do not support it; holes are left as holes either way.
+func copyData(out, in *os.File, size int64, progress *copyProgress) (string, error) {
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		progress.add(size)
+		return "a reflink", nil
+	}
+
+	method := "copy_file_range"
+	useCopyRange := true
+	for offset := int64(0); offset < size; {
+		data, hole, err := nextExtent(in, offset, size)
+		if err != nil {
+			return "", err
+		}
+		progress.add(data - offset)
+		if data >= size {
+			break
+		}
+		if useCopyRange {
+			if useCopyRange, err = copyRange(out, in, data, hole-data, progress); err != nil {
+				return "", err
+			}
+			if !useCopyRange {
+				method = "a sparse copy"
+			}
+		}
+		if !useCopyRange {
+			if _, err := out.Seek(data, io.SeekStart); err != nil {
+				return "", err
+			}
+			if _, err := copySparse(out, progress.reader(io.NewSectionReader(in, data, hole-data))); err != nil {
+				return "", err
+			}
+		}
+		offset = hole
+	}
+	// A trailing hole is only part of the file once it is truncated to size.
+	return method, out.Truncate(size)
+}
+
+// nextExtent returns the start and end of the first data extent of in at
+// or after offset. Without SEEK_DATA support the rest of the file is a
+// single extent; after the last extent the start is size.
+func nextExtent(in *os.File, offset, size int64) (int64, int64, error) {
+	fd := int(in.Fd())
+	data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+	switch {
+	case errors.Is(err, unix.ENXIO):
+		// Only a hole is left.
+		return size, size, nil
+	case err != nil:
+		return offset, size, nil
+	}
+	hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+	if err != nil || hole > size {
+		hole = size
+	}
+	return data, hole, nil
+}
+
+// copyFileRange copies length bytes at offset of in to the same offset of
+// out with copy_file_range. It reports false, having copied nothing, if the
+// kernel cannot copy between the two files.
+func copyFileRange(out, in *os.File, offset, length int64, progress *copyProgress) (bool, error) {
+	roff, woff := offset, offset
+	for copied := int64(0); copied < length; {
+		n, err := unix.CopyFileRange(int(in.Fd()), &roff, int(out.Fd()), &woff, int(min(length-copied, copyRangeChunk)), 0)
+		if err != nil {
+			if copied == 0 && unsupportedCopy(err) {
+				return false, nil
+			}
+			return true, err
+		}
+		if n == 0 {
+			return true, io.ErrUnexpectedEOF
+		}
+		copied += int64(n)
+		progress.add(int64(n))
+	}
+	return true, nil
+}
+
+// unsupportedCopy reports whether a copy_file_range error means the call is
+// not supported for the files rather than that the copy failed.
+func unsupportedCopy(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) ||
+		errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+)
+
+// checkSparse fails the test if the file at path takes more space than its
+// data, leaving room for file system overhead.
+func checkSparse(t *testing.T, path string, data int64) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	if limit := data + 2*sparseBlock; allocated > limit && allocated > 0 {
+		t.Errorf("%s allocates %d bytes for %d bytes of data", filepath.Base(path), allocated, data)
+	}
+}
+
+func TestCopyDataFallback(t *testing.T) {
+	// The kernel cannot copy between the files.
+	copyRange = func(out, in *os.File, offset, length int64, progress *copyProgress) (bool, error) {
+		return false, nil
+	}
+	defer func() { copyRange = copyFileRange }()
+
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "image.raw"), filepath.Join(dir, "scratch.raw")
+	image := sparseImage()
+	writeImage(t, src, image)
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	progress := newCopyProgress(report.Scope{Reporter: &report.Recorder{}}, int64(len(image)))
+	method, err := copyData(out, in, int64(len(image)), progress)
+	if err != nil {
+		t.Fatalf("copyData: %v", err)
+	}
+	if method == "a reflink" {
+		t.Skip("the file system supports reflinks")
+	}
+	if method != "a sparse copy" {
+		t.Errorf("method = %q, want a sparse copy", method)
+	}
+	if progress.done != int64(len(image)) {
+		t.Errorf("progress = %d, want %d", progress.done, len(image))
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Errorf("copied %d bytes that differ from the %d bytes of the image", len(got), len(image))
+	}
+	// The zeros written out in the image are holes in the copy.
+	checkSparse(t, dst, 2*sparseBlock)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+)
+
+// sparseImage is the content of a sparse test image: data, zeros written
+// out, data, then a trailing hole.
+func sparseImage() []byte {
+	b := make([]byte, 3<<20)
+	copy(b, bytes.Repeat([]byte("data"), 1024))
+	copy(b[1<<20+100:], bytes.Repeat([]byte("more"), 1024))
+	return b
+}
+
+// writeImage writes b to path, leaving its trailing zeros as a hole but
+// writing out the zeros before its last data.
+func writeImage(t *testing.T, path string, b []byte) {
+	t.Helper()
+	end := len(bytes.TrimRight(b, "\x00"))
+	if err := os.WriteFile(path, b[:end], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteSparse(t *testing.T) {
+	image := sparseImage()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"sparse image", image},
+		{"zeros only", make([]byte, 5*sparseBlock+7)},
+		{"partial last block", image[:2*sparseBlock+100]},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "disk.raw")
+			file, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			size, err := writeSparse(file, bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatalf("writeSparse: %v", err)
+			}
+			if size != int64(len(tt.data)) {
+				t.Errorf("size = %d, want %d", size, len(tt.data))
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("wrote %d bytes that differ from the %d bytes read", len(got), len(tt.data))
+			}
+			checkSparse(t, path, int64(len(bytes.TrimRight(tt.data, "\x00"))))
+		})
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "image.qcow2"), filepath.Join(dir, "scratch.qcow2")
+	image := sparseImage()
+	writeImage(t, src, image)
+
+	rec := &report.Recorder{}
+	if err := CopyImage(report.Scope{Reporter: rec}, src, dst); err != nil {
+		t.Fatalf("CopyImage: %v", err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Errorf("copied %d bytes that differ from the %d bytes of the image", len(got), len(image))
+	}
+	var last report.Event
+	for _, e := range rec.Events() {
+		if e.Kind == report.CopyProgress {
+			last = e
+		}
+	}
+	if last.Done != int64(len(image)) || last.Total != int64(len(image)) {
+		t.Errorf("last progress = %d/%d, want %d/%d", last.Done, last.Total, len(image), len(image))
+	}
+	if out := outputs(rec); !strings.HasPrefix(out, "Copied 3.0M in ") {
+		t.Errorf("output = %q", out)
+	}
+}
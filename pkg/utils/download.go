@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+)
+
+// PartSuffix is appended to the final path of an image while it is being
+// downloaded.
+const PartSuffix = ".part"
+
+// partState records where a partial download came from, so that it is only
+// resumed if the remote file is still the same.
+type partState struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// ifRange returns the validator sent in an If-Range header, or "" if the
+// partial download cannot be validated. Weak ETags are not allowed there.
+func (s partState) ifRange() string {
+	if s.ETag != "" && !strings.HasPrefix(s.ETag, "W/") {
+		return s.ETag
+	}
+	return s.LastModified
+}
+
+// statePath returns the path of the file holding the state of a partial download.
+func statePath(partPath string) string {
+	return partPath + ".json"
+}
+
+// loadPartState reads the state of a partial download. ok is false if there
+// is no partial download or it cannot be resumed from url.
+func loadPartState(partPath, url string) (state partState, size int64, ok bool) {
+	info, err := os.Stat(partPath)
+	if err != nil || info.Size() == 0 {
+		return state, 0, false
+	}
+	data, err := os.ReadFile(statePath(partPath))
+	if err != nil || json.Unmarshal(data, &state) != nil {
+		return state, 0, false
+	}
+	if state.URL != url || state.ifRange() == "" {
+		return state, 0, false
+	}
+	return state, info.Size(), true
+}
+
+// savePartState records the validators of the response a partial download is
+// being written from.
+func savePartState(partPath, url string, resp *http.Response) error {
+	state := partState{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(partPath), data, 0644)
+}
+
+// PartialSize returns the number of bytes of url already downloaded to
+// partPath that a new download would resume from.
+func PartialSize(partPath, url string) int64 {
+	_, size, _ := loadPartState(partPath, url)
+	return size
+}
+
+// RemovePartial removes a partial download and its state.
+func RemovePartial(partPath string) {
+	os.Remove(partPath)
+	os.Remove(statePath(partPath))
+}
+
+// DownloadFile downloads a file from the given URL to the specified path.
+// If a partial download of the same URL is already at the path, it is
+// resumed with a Range request as long as the server still has the same
+// file, as told by its ETag or Last-Modified header. The partial file is
+// kept on failure so that the next attempt can resume it.
+func DownloadFile(rep report.Scope, filePath string, url string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	state, offset, resume := loadPartState(filePath, url)
+	if resume {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", state.ifRange())
+	}
+
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var file *os.File
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && resume && rangeStart(resp) == offset:
+		rep.Output(fmt.Sprintf("Resuming download of %s at %d bytes\n", url, offset))
+		file, err = os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0644)
+	case resp.StatusCode == http.StatusOK:
+		rep.Output(fmt.Sprintf("Downloading %s\n", url))
+		offset = 0
+		if err = savePartState(filePath, url, resp); err == nil {
+			file, err = os.Create(filePath)
+		}
+	case resume && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+		// The server did not return the rest of the partial file.
+		rep.Output("Partial download cannot be resumed, starting over.\n")
+		RemovePartial(filePath)
+		return DownloadFile(rep, filePath, url)
+	default:
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if err != nil {
+		return fmt.Errorf("create file failed: %w", err)
+	}
+	defer file.Close()
+
+	total := resp.ContentLength
+	if total >= 0 {
+		total += offset
+	}
+	progressWriter := &ProgressWriter{
+		Total:      total,
+		Downloaded: offset,
+		Reporter:   rep,
+	}
+
+	writer := io.MultiWriter(file, progressWriter)
+
+	_, err = io.Copy(writer, resp.Body)
+	if err != nil {
+		return fmt.Errorf("response body read failed: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("sync file failed: %w", err)
+	}
+
+	return nil
+}
+
+// rangeStart returns the first byte of a partial response, or -1 if its
+// Content-Range header is missing or invalid.
+func rangeStart(resp *http.Response) int64 {
+	cr := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	first, _, ok := strings.Cut(cr, "-")
+	if !ok {
+		return -1
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+)
+
+func TestDownloadFileResume(t *testing.T) {
+	lastModified := modTime.Format(http.TimeFormat)
+	tests := []struct {
+		name string
+		// etag is the current ETag of the remote file.
+		etag string
+		// state is recorded for the partial download; its URL is the
+		// server's unless stateURL is set.
+		state    partState
+		stateURL string
+		// wantHeaders are the range headers of the requests made.
+		wantHeaders []string
+		wantOutput  string
+	}{
+		{
+			name:        "same ETag",
+			etag:        `"v1"`,
+			state:       partState{ETag: `"v1"`},
+			wantHeaders: []string{`Range="bytes=1000-" If-Range="\"v1\""`},
+			wantOutput:  "Resuming download",
+		},
+		{
+			name:        "changed ETag",
+			etag:        `"v2"`,
+			state:       partState{ETag: `"v1"`},
+			wantHeaders: []string{`Range="bytes=1000-" If-Range="\"v1\""`},
+			wantOutput:  "Downloading",
+		},
+		{
+			name:        "weak ETag falls back to Last-Modified",
+			etag:        `W/"v1"`,
+			state:       partState{ETag: `W/"v1"`, LastModified: lastModified},
+			wantHeaders: []string{fmt.Sprintf(`Range="bytes=1000-" If-Range=%q`, lastModified)},
+			wantOutput:  "Resuming download",
+		},
+		{
+			name:        "no validator",
+			state:       partState{ETag: `W/"v1"`},
+			wantHeaders: []string{`Range="" If-Range=""`},
+			wantOutput:  "Downloading",
+		},
+		{
+			name:        "other URL",
+			etag:        `"v1"`,
+			state:       partState{ETag: `"v1"`},
+			stateURL:    "http://mirror.example.com/image.qcow2",
+			wantHeaders: []string{`Range="" If-Range=""`},
+			wantOutput:  "Downloading",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, serveImage(tt.etag))
+			url := srv.URL + "/image.qcow2"
+			partPath := filepath.Join(t.TempDir(), "image"+PartSuffix)
+			stateURL := url
+			if tt.stateURL != "" {
+				stateURL = tt.stateURL
+			}
+			writePartial(t, partPath, stateURL, 1000, tt.state)
+
+			rec := &report.Recorder{}
+			if err := DownloadFile(report.Scope{Reporter: rec}, partPath, url); err != nil {
+				t.Fatalf("DownloadFile: %v", err)
+			}
+			got, err := os.ReadFile(partPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, image) {
+				t.Errorf("downloaded %d bytes, want the %d bytes of the image", len(got), len(image))
+			}
+			if headers := srv.Headers(); fmt.Sprint(headers) != fmt.Sprint(tt.wantHeaders) {
+				t.Errorf("requests = %q, want %q", headers, tt.wantHeaders)
+			}
+			if out := outputs(rec); !strings.Contains(out, tt.wantOutput) {
+				t.Errorf("output = %q, want %q", out, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestDownloadFileStartsOver(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+	}{
+		{
+			name: "range not satisfiable",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") != "" {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Write(image)
+			},
+		},
+		{
+			name: "wrong range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("Range") != "" {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-99/%d", len(image)))
+					w.WriteHeader(http.StatusPartialContent)
+					w.Write(image[:100])
+					return
+				}
+				w.Write(image)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.handler)
+			url := srv.URL + "/image.qcow2"
+			partPath := filepath.Join(t.TempDir(), "image"+PartSuffix)
+			writePartial(t, partPath, url, 1000, partState{ETag: `"v1"`})
+
+			rec := &report.Recorder{}
+			if err := DownloadFile(report.Scope{Reporter: rec}, partPath, url); err != nil {
+				t.Fatalf("DownloadFile: %v", err)
+			}
+			got, err := os.ReadFile(partPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, image) {
+				t.Errorf("downloaded %d bytes, want the %d bytes of the image", len(got), len(image))
+			}
+			if headers := srv.Headers(); len(headers) != 2 || !strings.HasPrefix(headers[1], `Range=""`) {
+				t.Errorf("requests = %q, want a resumed request and a full one", headers)
+			}
+			if out := outputs(rec); !strings.Contains(out, "cannot be resumed, starting over") {
+				t.Errorf("output = %q, want the download to start over", out)
+			}
+		})
+	}
+}
+
+func TestDownloadFileKeepsPartial(t *testing.T) {
+	// The server drops the connection half way through the body.
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", fmt.Sprint(len(image)))
+		w.Write(image[:len(image)/2])
+		w.(http.Flusher).Flush()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	})
+	url := srv.URL + "/image.qcow2"
+	partPath := filepath.Join(t.TempDir(), "image"+PartSuffix)
+
+	if err := DownloadFile(report.Scope{Reporter: &report.Recorder{}}, partPath, url); err == nil {
+		t.Fatal("DownloadFile succeeded on a truncated body")
+	}
+	if size := PartialSize(partPath, url); size != int64(len(image)/2) {
+		t.Errorf("PartialSize = %d, want %d", size, len(image)/2)
+	}
+	RemovePartial(partPath)
+	if size := PartialSize(partPath, url); size != 0 {
+		t.Errorf("PartialSize after RemovePartial = %d, want 0", size)
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// Fingerprint returns a digest of everything a template is built from: the
+// checksum of its image and the disk picked from it, its rendered step
+// commands and VM operations and its cloud-init vendor file. Images without
+// a checksum have no fingerprint.
+func Fingerprint(sum string, steps []types.Step, data TemplateData) (string, error) {
+	if sum == "" {
+		return "", errors.New("image has no checksum")
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "checksum %s\n", sum)
+	if data.Image.ArchiveMember != "" {
+		fmt.Fprintf(h, "member %q\n", data.Image.ArchiveMember)
+	}
+	for _, step := range steps {
+		command, err := RenderStep(step, data)
+		if err != nil {
+			return "", fmt.Errorf("step '%s' failed to render: %w", step.Name, err)
+		}
+		fmt.Fprintf(h, "step %q %q\n", step.Name, command)
+	}
+	vendor, err := os.ReadFile(filepath.Join(data.Paths.CloudInitDir, data.Vendor))
+	if err != nil {
+		return "", fmt.Errorf("reading cloudinit config: %w", err)
+	}
+	fmt.Fprintf(h, "vendor %d\n", len(vendor))
+	h.Write(vendor)
+	return checksum.Format(checksum.SHA256, hex.EncodeToString(h.Sum(nil))), nil
+}
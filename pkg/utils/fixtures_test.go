@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// image is served by serveImage.
+var image = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+// modTime is the Last-Modified time of the files of test servers.
+var modTime = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// testServer serves the files of a test, and records the range headers of
+// the requests it receives.
+type testServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	headers []string
+}
+
+// newTestServer starts a server answering every request with handler,
+// closed when the test ends.
+func newTestServer(t *testing.T, handler http.HandlerFunc) *testServer {
+	t.Helper()
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.headers = append(s.headers, fmt.Sprintf("Range=%q If-Range=%q", r.Header.Get("Range"), r.Header.Get("If-Range")))
+		s.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Headers returns the range headers of the requests received so far.
+func (s *testServer) Headers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.headers...)
+}
+
+// serveContent returns a handler serving the content opened by open at
+// every path like a static file server, honoring Range and If-Range, with
+// etag as ETag when set.
+func serveContent(etag string, open func() io.ReadSeeker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "image.qcow2", modTime, open())
+	}
+}
+
+// serveImage returns a handler serving image.
+func serveImage(etag string) http.HandlerFunc {
+	return serveContent(etag, func() io.ReadSeeker { return bytes.NewReader(image) })
+}
+
+// serveZeros returns a handler serving size zero bytes, which are never
+// stored.
+func serveZeros(size int64) http.HandlerFunc {
+	return serveContent("", func() io.ReadSeeker { return io.NewSectionReader(zeros{}, 0, size) })
+}
+
+// zeros reads as an endless run of zero bytes.
+type zeros struct{}
+
+func (zeros) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// writePartial leaves a partial download of the first n bytes of image
+// from url, as an interrupted DownloadFile would.
+func writePartial(t *testing.T, partPath, url string, n int, state partState) {
+	t.Helper()
+	if err := os.WriteFile(partPath, image[:n], 0644); err != nil {
+		t.Fatal(err)
+	}
+	state.URL = url
+	header := http.Header{}
+	if state.ETag != "" {
+		header.Set("ETag", state.ETag)
+	}
+	if state.LastModified != "" {
+		header.Set("Last-Modified", state.LastModified)
+	}
+	if err := savePartState(partPath, url, &http.Response{Header: header}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// outputs returns the text reported by rec.
+func outputs(rec *report.Recorder) string {
+	var b strings.Builder
+	for _, e := range rec.Events() {
+		b.WriteString(e.Text)
+	}
+	return b.String()
+}
+
+// cachedFile is an image file in a test cache.
+type cachedFile struct {
+	// name is the image using the file, or "" for a file no entry refers
+	// to.
+	name string
+	// data is the content of the file; files with the same data are
+	// shared.
+	data string
+	// used is when the image last used the file, in hours after an
+	// arbitrary start.
+	used int
+}
+
+// fillCache stores files in a cache in dir and indexes them.
+func fillCache(t *testing.T, dir string, files []cachedFile) Cache {
+	t.Helper()
+	c := Cache{Dir: dir}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var index types.CacheIndex
+	for _, f := range files {
+		sum := sumOf(f.data)
+		path, err := c.Path(sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.name == "" {
+			continue
+		}
+		used := start.Add(time.Duration(f.used) * time.Hour)
+		index.Entries = append(index.Entries, types.CacheEntry{
+			Name:     f.name,
+			Checksum: sum,
+			Size:     int64(len(f.data)),
+			AddedAt:  used,
+			UsedAt:   used,
+		})
+	}
+	if err := c.writeIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// sumOf returns the checksum of data as stored in the cache.
+func sumOf(data string) string {
+	digest := sha256.Sum256([]byte(data))
+	return checksum.Format(checksum.SHA256, hex.EncodeToString(digest[:]))
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// GPGVerifier is the program used to check signatures. It must accept the
+// command line of gpgv.
+var GPGVerifier = "gpgv"
+
+// GetVerifiedChecksum fetches the checksum file of a source, checks its
+// signature if gpg is set and returns the expected checksum of filename.
+// A missing or invalid signature is an error.
+func GetVerifiedChecksum(src Source, gpg *types.GPG, keyringDir, filename string) (string, string, error) {
+	body, err := FetchURL(src.ChecksumURL)
+	if err != nil {
+		return "", "", err
+	}
+	if gpg != nil {
+		keyring := filepath.Join(keyringDir, gpg.Keyring)
+		if gpg.Clearsigned {
+			body, err = VerifyClearsigned(keyring, body)
+		} else {
+			var signature []byte
+			if signature, err = FetchURL(src.SignatureURL); err != nil {
+				return "", "", fmt.Errorf("fetching signature %s: %w", src.SignatureURL, err)
+			}
+			err = VerifySignature(keyring, body, signature)
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	algo, digest, err := checksum.Lookup(body, filename, src.ChecksumURL)
+	return digest, algo, err
+}
+
+// VerifySignature checks a detached signature of data against the keys of
+// keyring.
+func VerifySignature(keyring string, data, signature []byte) error {
+	dir, err := os.MkdirTemp("", "pve-ctgen-gpg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	dataFile := filepath.Join(dir, "data")
+	sigFile := filepath.Join(dir, "data.sig")
+	if err := os.WriteFile(dataFile, data, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sigFile, signature, 0600); err != nil {
+		return err
+	}
+	_, err = runGPGV(keyring, sigFile, dataFile)
+	return err
+}
+
+// VerifyClearsigned checks a clearsigned message against the keys of
+// keyring and returns the signed text. Anything outside the signed part of
+// the message is dropped.
+func VerifyClearsigned(keyring string, message []byte) ([]byte, error) {
+	if !bytes.Contains(message, []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		return nil, fmt.Errorf("checksum file is not clearsigned")
+	}
+	dir, err := os.MkdirTemp("", "pve-ctgen-gpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	msgFile := filepath.Join(dir, "message.asc")
+	if err := os.WriteFile(msgFile, message, 0600); err != nil {
+		return nil, err
+	}
+	return runGPGV(keyring, "--output", "-", msgFile)
+}
+
+// runGPGV runs gpgv with the given keyring and returns its standard output.
+func runGPGV(keyring string, args ...string) ([]byte, error) {
+	keyring, err := filepath.Abs(keyring)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(keyring); err != nil {
+		return nil, fmt.Errorf("keyring not found: %w", err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(GPGVerifier, append([]string{"--keyring", keyring}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// The last line of gpgv's output states why the check failed.
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			lines := strings.Split(msg, "\n")
+			return nil, fmt.Errorf("signature verification failed: %s", strings.TrimSpace(lines[len(lines)-1]))
+		}
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// DefaultHTTP is the HTTP configuration used for any value missing from the
+// settings file.
+var DefaultHTTP = types.HTTPSettings{
+	ConnectTimeout:  "30s",
+	ResponseTimeout: "1m",
+	IdleTimeout:     "2m",
+	UserAgent:       "pve-ctgen",
+}
+
+// HTTPClient is used for every request made by the package. ConfigureHTTP
+// replaces it with a client built from the settings file.
+var HTTPClient = mustHTTPClient(DefaultHTTP)
+
+// ConfigureHTTP replaces HTTPClient with a client built from cfg.
+func ConfigureHTTP(cfg types.HTTPSettings) error {
+	client, err := NewHTTPClient(cfg)
+	if err != nil {
+		return err
+	}
+	HTTPClient = client
+	return nil
+}
+
+// NewHTTPClient builds an HTTP client with the timeouts, proxy, extra CA
+// certificates and User-Agent of cfg.
+func NewHTTPClient(cfg types.HTTPSettings) (*http.Client, error) {
+	if field, err := checkHTTP(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", field, err)
+	}
+	connectTimeout, _ := time.ParseDuration(cfg.ConnectTimeout)
+	responseTimeout, _ := time.ParseDuration(cfg.ResponseTimeout)
+	idleTimeout, _ := time.ParseDuration(cfg.IdleTimeout)
+
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		pool, err := loadCABundle(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("ca_bundle: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(cfg),
+		DialContext:           (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          100,
+		ForceAttemptHTTP2:     true,
+		TLSClientConfig:       tlsConfig,
+	}
+	return &http.Client{Transport: &clientTransport{
+		base:        transport,
+		userAgent:   cfg.UserAgent,
+		idleTimeout: idleTimeout,
+	}}, nil
+}
+
+// mustHTTPClient is NewHTTPClient for configurations known to be valid.
+func mustHTTPClient(cfg types.HTTPSettings) *http.Client {
+	client, err := NewHTTPClient(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// proxyFunc returns the proxy selection of cfg: the environment's
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY by default, no proxy at all for
+// "direct", or the configured proxy. Hosts in NoProxy are reached directly
+// with either proxy.
+func proxyFunc(cfg types.HTTPSettings) func(*http.Request) (*url.URL, error) {
+	proxy := http.ProxyFromEnvironment
+	switch cfg.Proxy {
+	case "":
+	case "direct":
+		return nil
+	default:
+		proxyURL, _ := url.Parse(cfg.Proxy)
+		proxy = http.ProxyURL(proxyURL)
+	}
+	if len(cfg.NoProxy) == 0 {
+		return proxy
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		host := req.URL.Hostname()
+		for _, entry := range cfg.NoProxy {
+			entry = strings.TrimPrefix(entry, ".")
+			if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+				return nil, nil
+			}
+		}
+		return proxy(req)
+	}
+}
+
+// loadCABundle returns the system certificate pool with the PEM
+// certificates of path added.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// checkHTTP reports the first invalid value of an HTTP configuration, with
+// the JSON name of the offending field.
+func checkHTTP(cfg types.HTTPSettings) (string, error) {
+	durations := []struct{ field, value string }{
+		{"connect_timeout", cfg.ConnectTimeout},
+		{"response_timeout", cfg.ResponseTimeout},
+		{"idle_timeout", cfg.IdleTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return d.field, fmt.Errorf("invalid duration %q", d.value)
+		}
+	}
+	if cfg.Proxy != "" && cfg.Proxy != "direct" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil || u.Host == "" {
+			return "proxy", fmt.Errorf("invalid proxy URL %q", cfg.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return "proxy", fmt.Errorf("proxy URL %q must use http, https or socks5", cfg.Proxy)
+		}
+	}
+	if cfg.CABundle != "" {
+		if _, err := loadCABundle(cfg.CABundle); err != nil {
+			return "ca_bundle", err
+		}
+	}
+	return "", nil
+}
+
+// mergeHTTP returns base with every non-zero value of override applied.
+func mergeHTTP(base, override types.HTTPSettings) types.HTTPSettings {
+	if override.ConnectTimeout != "" {
+		base.ConnectTimeout = override.ConnectTimeout
+	}
+	if override.ResponseTimeout != "" {
+		base.ResponseTimeout = override.ResponseTimeout
+	}
+	if override.IdleTimeout != "" {
+		base.IdleTimeout = override.IdleTimeout
+	}
+	if override.Proxy != "" {
+		base.Proxy = override.Proxy
+	}
+	if override.NoProxy != nil {
+		base.NoProxy = override.NoProxy
+	}
+	if override.CABundle != "" {
+		base.CABundle = override.CABundle
+	}
+	if override.UserAgent != "" {
+		base.UserAgent = override.UserAgent
+	}
+	return base
+}
+
+// clientTransport sets the User-Agent of every request and aborts responses
+// whose body stalls for longer than idleTimeout.
+type clientTransport struct {
+	base        http.RoundTripper
+	userAgent   string
+	idleTimeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *clientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if t.idleTimeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body := &idleReader{ReadCloser: resp.Body, timeout: t.idleTimeout, cancel: cancel}
+	body.timer = time.AfterFunc(t.idleTimeout, body.expire)
+	resp.Body = body
+	return resp, nil
+}
+
+// idleReader cancels a response when no data arrives for timeout.
+type idleReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (r *idleReader) expire() {
+	r.mu.Lock()
+	r.expired = true
+	r.mu.Unlock()
+	r.cancel()
+}
+
+// Read implements io.Reader.
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.mu.Lock()
+	expired := r.expired
+	r.mu.Unlock()
+	if expired {
+		return n, &idleTimeoutError{timeout: r.timeout}
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// idleTimeoutError is returned when a response body stalls. It is a
+// net.Error so that the read is retried.
+type idleTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e *idleTimeoutError) Error() string {
+	return fmt.Sprintf("no data received for %s", e.timeout)
+}
+
+// Timeout implements net.Error.
+func (e *idleTimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error.
+func (e *idleTimeoutError) Temporary() bool { return true }
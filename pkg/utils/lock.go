@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// LockVersion is the version of the lock file format written by WriteLock.
+const LockVersion = 1
+
+// LoadLock loads a lock file.
+func LoadLock(path string) (types.LockFile, error) {
+	var lock types.LockFile
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return lock, fmt.Errorf("error reading lock file: %w", err)
+	}
+	if err := decodeJSON(file, &lock); err != nil {
+		return lock, fmt.Errorf("error parsing lock file JSON %s: %w", path, err)
+	}
+	if lock.Version != LockVersion {
+		return lock, fmt.Errorf("lock file %s has unsupported version %d", path, lock.Version)
+	}
+	return lock, nil
+}
+
+// WriteLock atomically replaces the lock file at path.
+func WriteLock(path string, lock types.LockFile) error {
+	lock.Version = LockVersion
+	if err := writeJSONFile(path, lock); err != nil {
+		return fmt.Errorf("error writing lock file: %w", err)
+	}
+	return nil
+}
+
+// writeJSONFile atomically replaces the file at path with the indented JSON
+// encoding of v.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LockImage resolves the sources and checksum of an image. The checksum is
+// the image's pinned one, else the one published in its checksum file,
+// verified like during a build. Images without either are downloaded and
+// hashed with SHA-256. Images with a resolver are locked to their newest
+// build.
+func LockImage(img types.Image, keyringDir string, retry Retry) (types.LockedImage, error) {
+	if img.Resolver != nil {
+		err := retry.Do(func() (err error) {
+			img, err = ResolveImage(img)
+			return err
+		}, nil)
+		if err != nil {
+			return types.LockedImage{Name: img.Name}, fmt.Errorf("resolving latest build failed: %w", err)
+		}
+	}
+	sources := ImageSources(img)
+	locked := types.LockedImage{Name: img.Name}
+	for _, src := range sources {
+		locked.URLs = append(locked.URLs, src.URL)
+	}
+
+	if img.Checksum != "" {
+		algo, digest, err := checksum.Parse(img.Checksum)
+		if err != nil {
+			return locked, fmt.Errorf("invalid checksum: %w", err)
+		}
+		locked.Checksum = checksum.Format(algo, digest)
+		return locked, nil
+	}
+
+	var errs []error
+	for _, src := range sources {
+		var digest, algo string
+		err := retry.Do(func() (err error) {
+			if src.ChecksumURL != "" {
+				digest, algo, err = GetVerifiedChecksum(src, img.GPG, keyringDir, filepath.Base(src.URL))
+			} else {
+				algo = checksum.SHA256
+				digest, err = HashURL(src.URL, algo)
+			}
+			return err
+		}, nil)
+		if err == nil {
+			locked.Checksum = checksum.Format(algo, digest)
+			return locked, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src.URL, err))
+	}
+	return locked, errors.Join(errs...)
+}
+
+// HashURL downloads a file without storing it and returns its hex digest.
+func HashURL(url, algorithm string) (string, error) {
+	h, err := checksum.New(algorithm)
+	if err != nil {
+		return "", err
+	}
+	resp, err := HTTPClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ApplyLock pins every image to the checksum recorded in the lock file. It
+// fails if an image is missing from the lock file or its sources or pinned
+// checksum changed since the lock file was written. Images with a resolver
+// use the URL they resolved to when the lock file was written.
+func ApplyLock(images []types.Image, lock types.LockFile) ([]types.Image, error) {
+	entries := make(map[string]types.LockedImage, len(lock.Images))
+	for _, entry := range lock.Images {
+		entries[entry.Name] = entry
+	}
+
+	var errs []error
+	locked := make([]types.Image, len(images))
+	for i, img := range images {
+		entry, ok := entries[img.Name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: not in lock file", img.Name))
+			continue
+		}
+		// A resolved image is pinned to the build it resolved to.
+		if img.Resolver != nil {
+			if len(entry.URLs) == 0 {
+				errs = append(errs, fmt.Errorf("%s: no URL in lock file", img.Name))
+				continue
+			}
+			img.URL, img.ChecksumURL, img.Resolver = entry.URLs[0], "", nil
+			img.Mirrors, img.Path, img.ChecksumPath = nil, "", ""
+		}
+		var urls []string
+		for _, src := range ImageSources(img) {
+			urls = append(urls, src.URL)
+		}
+		if !slices.Equal(urls, entry.URLs) {
+			errs = append(errs, fmt.Errorf("%s: sources changed since the lock file was written", img.Name))
+			continue
+		}
+		if img.Checksum != "" {
+			algo, digest, err := checksum.Parse(img.Checksum)
+			if err != nil || checksum.Format(algo, digest) != entry.Checksum {
+				errs = append(errs, fmt.Errorf("%s: checksum changed since the lock file was written", img.Name))
+				continue
+			}
+		}
+		img.Checksum = entry.Checksum
+		locked[i] = img
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("lock file is out of date, run 'pve-ctgen lock':\n%w", errors.Join(errs...))
+	}
+	return locked, nil
+}
@@ -0,0 +1,34 @@
+package utils
+
+import "sync"
+
+// Locks is a set of named mutexes used to serialize steps that must not run
+// concurrently across images, such as operations on shared storage, and
+// the use of cached images. A nil *Locks never blocks.
+type Locks struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewLocks creates an empty set of named mutexes.
+func NewLocks() *Locks {
+	return &Locks{locks: make(map[string]*sync.Mutex)}
+}
+
+// Lock acquires the mutex with the given name and returns the function that
+// releases it. An empty name does not lock anything.
+func (l *Locks) Lock(name string) (unlock func()) {
+	if l == nil || name == "" {
+		return func() {}
+	}
+	l.mu.Lock()
+	m, ok := l.locks[name]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[name] = m
+	}
+	l.mu.Unlock()
+
+	m.Lock()
+	return m.Unlock
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// probeTimeout bounds how long a mirror may take to answer a probe.
+const probeTimeout = 5 * time.Second
+
+// Source is a location an image can be downloaded from.
+type Source struct {
+	URL         string
+	ChecksumURL string
+	// SignatureURL is the detached signature of the checksum file, if any.
+	SignatureURL string
+}
+
+// ImageSources returns the locations of an image in the order they are
+// tried: its URL, then each of its mirrors.
+func ImageSources(img types.Image) []Source {
+	var sources []Source
+	var signatureURL, signaturePath string
+	if img.GPG != nil {
+		signatureURL, signaturePath = img.GPG.SignatureURL, img.GPG.SignaturePath
+	}
+	if img.URL != "" {
+		sources = append(sources, Source{URL: img.URL, ChecksumURL: img.ChecksumURL, SignatureURL: signatureURL})
+	}
+	for _, mirror := range img.Mirrors {
+		src := Source{URL: joinURL(mirror, img.Path), ChecksumURL: img.ChecksumURL, SignatureURL: signatureURL}
+		if img.ChecksumPath != "" {
+			src.ChecksumURL = joinURL(mirror, img.ChecksumPath)
+		}
+		if signaturePath != "" {
+			src.SignatureURL = joinURL(mirror, signaturePath)
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// ProbeSources sends a HEAD request to every source at once and returns them
+// ordered by response time. Sources that fail to answer keep their relative
+// order after the others.
+func ProbeSources(sources []Source) []Source {
+	latency := make([]time.Duration, len(sources))
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, src.URL, nil)
+			if err != nil {
+				latency[i] = -1
+				return
+			}
+			resp, err := HTTPClient.Do(req)
+			if err != nil {
+				latency[i] = -1
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				latency[i] = -1
+				return
+			}
+			latency[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	order := make([]int, len(sources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		la, lb := latency[order[a]], latency[order[b]]
+		if la < 0 || lb < 0 {
+			return lb < 0 && la >= 0
+		}
+		return la < lb
+	})
+	sorted := make([]Source, len(sources))
+	for i, j := range order {
+		sorted[i] = sources[j]
+	}
+	return sorted
+}
+
+// joinURL appends a relative path to a base URL.
+func joinURL(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// DefaultPipeline is the pipeline used by images that do not name one, and
+// the name given to the steps of a steps file holding a plain list.
+const DefaultPipeline = "default"
+
+// LoadPipelines loads step pipelines from a JSON file. The file holds either
+// a list of steps, which becomes the default pipeline, or an object mapping
+// pipeline names to lists of steps.
+func LoadPipelines(path string) (types.Pipelines, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading steps file: %w", err)
+	}
+	pipelines := types.Pipelines{}
+	if trimmed := bytes.TrimSpace(file); len(trimmed) > 0 && trimmed[0] == '[' {
+		var steps []types.Step
+		if err := decodeJSON(file, &steps); err != nil {
+			return nil, fmt.Errorf("error parsing steps JSON %s: %w", path, err)
+		}
+		pipelines[DefaultPipeline] = steps
+		return pipelines, nil
+	}
+	if err := decodeJSON(file, &pipelines); err != nil {
+		return nil, fmt.Errorf("error parsing steps JSON %s: %w", path, err)
+	}
+	return pipelines, nil
+}
+
+// PipelineNames returns the names of the pipelines in sorted order.
+func PipelineNames(pipelines types.Pipelines) []string {
+	names := make([]string, 0, len(pipelines))
+	for name := range pipelines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveSteps returns the steps of an image: its pipeline with the image's
+// step overrides applied.
+func ResolveSteps(pipelines types.Pipelines, img types.Image) ([]types.Step, error) {
+	name := img.Pipeline
+	if name == "" {
+		name = DefaultPipeline
+	}
+	base, ok := pipelines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pipeline %q", name)
+	}
+	steps := append([]types.Step(nil), base...)
+	if img.Steps == nil {
+		return steps, nil
+	}
+
+	for _, remove := range img.Steps.Remove {
+		i := stepIndex(steps, remove)
+		if i < 0 {
+			return nil, fmt.Errorf("cannot remove step %q: not in pipeline %q", remove, name)
+		}
+		steps = append(steps[:i], steps[i+1:]...)
+	}
+	for _, replace := range img.Steps.Replace {
+		i := stepIndex(steps, replace.Name)
+		if i < 0 {
+			return nil, fmt.Errorf("cannot replace step %q: not in pipeline %q", replace.Name, name)
+		}
+		steps[i] = replace
+	}
+	for _, add := range img.Steps.Add {
+		if stepIndex(steps, add.Name) >= 0 {
+			return nil, fmt.Errorf("cannot add step %q: a step with that name already exists", add.Name)
+		}
+		at := len(steps)
+		switch {
+		case add.Before != "" && add.After != "":
+			return nil, fmt.Errorf("step %q sets both before and after", add.Name)
+		case add.Before != "":
+			if at = stepIndex(steps, add.Before); at < 0 {
+				return nil, fmt.Errorf("cannot add step %q before %q: no such step", add.Name, add.Before)
+			}
+		case add.After != "":
+			if at = stepIndex(steps, add.After); at < 0 {
+				return nil, fmt.Errorf("cannot add step %q after %q: no such step", add.Name, add.After)
+			}
+			at++
+		}
+		steps = append(steps[:at], append([]types.Step{add.Step}, steps[at:]...)...)
+	}
+	return steps, nil
+}
+
+// stepIndex returns the index of the step with the given name, or -1.
+func stepIndex(steps []types.Step, name string) int {
+	for i, step := range steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
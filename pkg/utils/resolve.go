@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// ResolveLatest resolves an image with a resolver to its newest build,
+// retrying according to retry, and reports what it picked.
+func ResolveLatest(rep report.Scope, step int, img types.Image, retry Retry) (types.Image, error) {
+	rep.Output(fmt.Sprintf("Resolving latest build from %s (%s)...\n", img.Resolver.URL, img.Resolver.Type))
+	resolved := img
+	err := retry.Do(func() (err error) {
+		resolved, err = ResolveImage(img)
+		return err
+	}, reportRetry(rep, step, retry.Attempts, LogError))
+	if err != nil {
+		return img, fmt.Errorf("resolving latest build failed: %w", err)
+	}
+	rep.Output(fmt.Sprintf("📦 Resolved %s\n", resolved.URL))
+	if resolved.ChecksumURL != "" {
+		rep.Output(fmt.Sprintf("📦 Checksum file %s\n", resolved.ChecksumURL))
+	}
+	return resolved, nil
+}
+
+// ResolveImage returns img with the URL and checksum of the newest build
+// found by its resolver, and the resolver removed.
+func ResolveImage(img types.Image) (types.Image, error) {
+	r := img.Resolver
+	var err error
+	switch r.Type {
+	case types.ResolverSimplestreams:
+		img.URL, img.Checksum, err = resolveSimplestreams(r)
+	case types.ResolverIndex:
+		img.URL, img.ChecksumURL, err = resolveIndex(r)
+	case types.ResolverLatest:
+		img.URL, img.ChecksumURL, err = resolveLatest(r)
+	default:
+		err = fmt.Errorf("unknown resolver type %q", r.Type)
+	}
+	if err != nil {
+		return img, err
+	}
+	img.Resolver = nil
+	return img, nil
+}
+
+// simplestreams is the part of a simplestreams product catalog used to
+// find an image.
+type simplestreams struct {
+	Products map[string]struct {
+		Versions map[string]struct {
+			Items map[string]struct {
+				Path   string `json:"path"`
+				SHA256 string `json:"sha256"`
+			} `json:"items"`
+		} `json:"versions"`
+	} `json:"products"`
+}
+
+// resolveSimplestreams picks the item of the newest version of a product.
+// Paths in the catalog are relative to the directory holding "streams/".
+func resolveSimplestreams(r *types.Resolver) (string, string, error) {
+	body, err := FetchURL(r.URL)
+	if err != nil {
+		return "", "", err
+	}
+	var catalog simplestreams
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return "", "", fmt.Errorf("parsing simplestreams catalog: %w", err)
+	}
+	product, ok := catalog.Products[r.Product]
+	if !ok {
+		return "", "", fmt.Errorf("product %q not found in %s", r.Product, r.URL)
+	}
+
+	versions := make([]string, 0, len(product.Versions))
+	for v, version := range product.Versions {
+		if _, ok := version.Items[r.Item]; ok {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return "", "", fmt.Errorf("no version of %s has an item %q", r.Product, r.Item)
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) < 0 })
+	item := product.Versions[versions[len(versions)-1]].Items[r.Item]
+
+	root, _, ok := strings.Cut(r.URL, "/streams/")
+	if !ok {
+		return "", "", fmt.Errorf("catalog URL %s is not below a streams/ directory", r.URL)
+	}
+	sum := ""
+	if item.SHA256 != "" {
+		sum = checksum.Format(checksum.SHA256, strings.ToLower(item.SHA256))
+	}
+	return joinURL(root, item.Path), sum, nil
+}
+
+// hrefPattern matches the links of an HTML directory listing.
+var hrefPattern = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'?#]+)["']`)
+
+// resolveIndex picks the file with the highest version matching the
+// pattern from a directory listing, and its checksum file.
+func resolveIndex(r *types.Resolver) (string, string, error) {
+	base, err := url.Parse(strings.TrimSuffix(r.URL, "/") + "/")
+	if err != nil {
+		return "", "", err
+	}
+	body, err := FetchURL(base.String())
+	if err != nil {
+		return "", "", err
+	}
+	links := listingLinks(base, body)
+
+	file, err := newestMatch(links, r.Pattern)
+	if err != nil {
+		return "", "", err
+	}
+	var checksumURL string
+	switch {
+	case r.ChecksumPattern != "":
+		if checksumURL, err = newestMatch(links, r.ChecksumPattern); err != nil {
+			return "", "", fmt.Errorf("checksum file: %w", err)
+		}
+	case r.ChecksumFile != "":
+		checksumURL = base.ResolveReference(&url.URL{Path: r.ChecksumFile}).String()
+	}
+	return file, checksumURL, nil
+}
+
+// listingLinks returns the absolute URLs linked from a directory listing.
+func listingLinks(base *url.URL, body []byte) []string {
+	var links []string
+	for _, m := range hrefPattern.FindAllSubmatch(body, -1) {
+		ref, err := url.Parse(string(m[1]))
+		if err != nil {
+			continue
+		}
+		links = append(links, base.ResolveReference(ref).String())
+	}
+	return links
+}
+
+// newestMatch returns the link whose file name matches pattern and has the
+// highest version.
+func newestMatch(links []string, pattern string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %w", err)
+	}
+	var best, bestName string
+	for _, link := range links {
+		name, err := url.PathUnescape(path.Base(link))
+		if err != nil || !re.MatchString(name) {
+			continue
+		}
+		if best == "" || compareVersions(name, bestName) > 0 {
+			best, bestName = link, name
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no file matches %q", pattern)
+	}
+	return best, nil
+}
+
+// resolveLatest follows the redirects of a "latest" URL to the file it
+// points to. The checksum file is looked up next to that file.
+func resolveLatest(r *types.Resolver) (string, string, error) {
+	resp, err := HTTPClient.Head(r.URL)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	final := resp.Request.URL
+	var checksumURL string
+	if r.ChecksumFile != "" {
+		checksumURL = final.ResolveReference(&url.URL{Path: r.ChecksumFile}).String()
+	}
+	return final.String(), checksumURL, nil
+}
+
+// compareVersions compares two strings such as file names, treating runs
+// of digits as numbers so that "9.10" sorts after "9.6".
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ca, restA := versionChunk(a)
+		cb, restB := versionChunk(b)
+		na, errA := strconv.ParseUint(ca, 10, 64)
+		nb, errB := strconv.ParseUint(cb, 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case ca != cb:
+			return strings.Compare(ca, cb)
+		}
+		a, b = restA, restB
+	}
+	return strings.Compare(a, b)
+}
+
+// versionChunk splits off the leading run of digits or non-digits of s.
+func versionChunk(s string) (string, string) {
+	digit := s[0] >= '0' && s[0] <= '9'
+	i := 1
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digit {
+		i++
+	}
+	return s[:i], s[i:]
+}
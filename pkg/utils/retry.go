@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// DefaultDownloadRetry is the retry policy of downloads and checksum
+// fetches, for any value missing from the settings file.
+var DefaultDownloadRetry = types.RetryPolicy{
+	Attempts:     3,
+	Backoff:      "2s",
+	MaxBackoff:   "1m",
+	Jitter:       0.2,
+	HTTPStatuses: []int{408, 429, 500, 502, 503, 504},
+}
+
+// DefaultStepRetry is the retry policy of steps, for any value missing from
+// the settings file and the step. Steps are not retried by default.
+var DefaultStepRetry = types.RetryPolicy{
+	Attempts:   1,
+	Backoff:    "5s",
+	MaxBackoff: "1m",
+	Jitter:     0.2,
+}
+
+// HTTPStatusError is returned for an unexpected HTTP response status.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+// Error implements the error interface.
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.Status)
+}
+
+// Retry is a parsed retry policy.
+type Retry struct {
+	Attempts     int
+	Backoff      time.Duration
+	MaxBackoff   time.Duration
+	Jitter       float64
+	HTTPStatuses []int
+	ExitCodes    []int
+}
+
+// NewRetry parses a retry policy.
+func NewRetry(p types.RetryPolicy) (Retry, error) {
+	if _, err := checkRetry(p); err != nil {
+		return Retry{}, err
+	}
+	backoff, _ := time.ParseDuration(p.Backoff)
+	maxBackoff, _ := time.ParseDuration(p.MaxBackoff)
+	return Retry{
+		Attempts:     max(p.Attempts, 1),
+		Backoff:      backoff,
+		MaxBackoff:   maxBackoff,
+		Jitter:       p.Jitter,
+		HTTPStatuses: p.HTTPStatuses,
+		ExitCodes:    p.ExitCodes,
+	}, nil
+}
+
+// StepRetryPolicy returns the retry policy of a step: the global policy of
+// steps overridden by the step's own.
+func StepRetryPolicy(settings types.Settings, step types.Step) types.RetryPolicy {
+	if step.Retry == nil {
+		return settings.Retry.Steps
+	}
+	return mergeRetry(settings.Retry.Steps, *step.Retry)
+}
+
+// Retryable reports whether err is worth another attempt: a network error,
+// or an HTTP status, including those of the Proxmox API, or exit code
+// listed in the policy.
+func (r Retry) Retryable(err error) bool {
+	var statusErr *HTTPStatusError
+	var apiErr *pve.APIError
+	var exitErr *exec.ExitError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &statusErr):
+		return slices.Contains(r.HTTPStatuses, statusErr.StatusCode)
+	case errors.As(err, &apiErr):
+		return slices.Contains(r.HTTPStatuses, apiErr.StatusCode)
+	case errors.As(err, &exitErr):
+		return len(r.ExitCodes) == 0 || slices.Contains(r.ExitCodes, exitErr.ExitCode())
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	return false
+}
+
+// Delay returns the randomized delay before the given retry, starting at 1.
+func (r Retry) Delay(retry int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < retry && (r.MaxBackoff <= 0 || d < r.MaxBackoff); i++ {
+		d *= 2
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(d))
+	}
+	return d
+}
+
+// Do calls fn until it succeeds, returns an error that is not retryable or
+// the attempts run out. onRetry, if not nil, is called after every failed
+// attempt that is retried, before waiting for the given delay.
+func (r Retry) Do(fn func() error, onRetry func(attempt int, err error, delay time.Duration)) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.Attempts || !r.Retryable(err) {
+			return err
+		}
+		delay := r.Delay(attempt)
+		if onRetry != nil {
+			onRetry(attempt, err, delay)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// reportRetry returns an onRetry function for Retry.Do that reports a failed
+// attempt of a step and logs its error.
+func reportRetry(rep report.Scope, step int, attempts int, logError func(string, error)) func(int, error, time.Duration) {
+	return func(attempt int, err error, delay time.Duration) {
+		rep.StepRetrying(step, attempt, attempts, err, delay)
+		logError(rep.Image.Name, fmt.Errorf("step '%s' attempt %d/%d failed: %w", rep.Image.Steps[step], attempt, attempts, err))
+	}
+}
+
+// checkRetry reports the first invalid value of a retry policy, with the
+// JSON name of the offending field.
+func checkRetry(p types.RetryPolicy) (string, error) {
+	if p.Attempts < 0 {
+		return "attempts", fmt.Errorf("attempts must not be negative")
+	}
+	durations := []struct{ field, value string }{{"backoff", p.Backoff}, {"max_backoff", p.MaxBackoff}}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return d.field, fmt.Errorf("invalid duration %q", d.value)
+		}
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return "jitter", fmt.Errorf("jitter must be between 0 and 1")
+	}
+	for _, status := range p.HTTPStatuses {
+		if status < 100 || status > 599 {
+			return "http_statuses", fmt.Errorf("invalid HTTP status %d", status)
+		}
+	}
+	for _, code := range p.ExitCodes {
+		if code < 1 || code > 255 {
+			return "exit_codes", fmt.Errorf("invalid exit code %d", code)
+		}
+	}
+	return "", nil
+}
+
+// mergeRetry returns base with every non-zero value of override applied.
+func mergeRetry(base, override types.RetryPolicy) types.RetryPolicy {
+	if override.Attempts != 0 {
+		base.Attempts = override.Attempts
+	}
+	if override.Backoff != "" {
+		base.Backoff = override.Backoff
+	}
+	if override.MaxBackoff != "" {
+		base.MaxBackoff = override.MaxBackoff
+	}
+	if override.Jitter != 0 {
+		base.Jitter = override.Jitter
+	}
+	if override.HTTPStatuses != nil {
+		base.HTTPStatuses = override.HTTPStatuses
+	}
+	if override.ExitCodes != nil {
+		base.ExitCodes = override.ExitCodes
+	}
+	return base
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy types.RetryPolicy
+		want   []time.Duration
+	}{
+		{
+			name:   "doubles up to max_backoff",
+			policy: types.RetryPolicy{Attempts: 8, Backoff: "2s", MaxBackoff: "1m"},
+			want:   []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute},
+		},
+		{
+			name:   "backoff above max_backoff",
+			policy: types.RetryPolicy{Attempts: 3, Backoff: "2m", MaxBackoff: "1m"},
+			want:   []time.Duration{time.Minute, time.Minute},
+		},
+		{
+			name:   "no max_backoff",
+			policy: types.RetryPolicy{Attempts: 5, Backoff: "1s"},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "no backoff",
+			policy: types.RetryPolicy{Attempts: 3},
+			want:   []time.Duration{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRetry(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []time.Duration
+			for retry := 1; retry < r.Attempts; retry++ {
+				got = append(got, r.Delay(retry))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("delays = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Many retries must not overflow the delay.
+	r := Retry{Backoff: time.Second, MaxBackoff: time.Minute}
+	if d := r.Delay(1000); d != time.Minute {
+		t.Errorf("Delay(1000) = %v, want %v", d, time.Minute)
+	}
+}
+
+func TestRetryDelayJitter(t *testing.T) {
+	r := Retry{Backoff: 10 * time.Second, MaxBackoff: time.Minute, Jitter: 0.2}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		d := r.Delay(2)
+		if d < 16*time.Second || d > 24*time.Second {
+			t.Fatalf("Delay(2) = %v, want 20s ± 20%%", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("Delay is not randomized")
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	unavailable := &HTTPStatusError{StatusCode: 503, Status: "503 Service Unavailable"}
+	notFound := &HTTPStatusError{StatusCode: 404, Status: "404 Not Found"}
+	tests := []struct {
+		name string
+		// errs are returned by the attempts in turn, then nil.
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"retried until success", []error{unavailable, unavailable}, 3, nil},
+		{"attempts run out", []error{unavailable, unavailable, unavailable, unavailable}, 3, unavailable},
+		{"not retryable", []error{notFound, unavailable}, 1, notFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Retry{Attempts: 3, Backoff: time.Nanosecond, HTTPStatuses: []int{503}}
+			attempts := 0
+			var retried []int
+			var delays []time.Duration
+			err := r.Do(func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			}, func(attempt int, err error, delay time.Duration) {
+				retried = append(retried, attempt)
+				delays = append(delays, delay)
+			})
+			if err != tt.wantErr {
+				t.Errorf("Do = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			for i, attempt := range retried {
+				if attempt != i+1 || delays[i] != time.Nanosecond<<i {
+					t.Errorf("retry %d: attempt %d, delay %v, want attempt %d, delay %v", i, attempt, delays[i], i+1, time.Nanosecond<<i)
+				}
+			}
+			if len(retried) != attempts-1 {
+				t.Errorf("onRetry called %d times for %d attempts", len(retried), attempts)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	r := Retry{HTTPStatuses: []int{502, 503}, ExitCodes: []int{3}}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"listed HTTP status", fmt.Errorf("download failed: %w", &HTTPStatusError{StatusCode: 503}), true},
+		{"other HTTP status", &HTTPStatusError{StatusCode: 404}, false},
+		{"listed API status", &pve.APIError{StatusCode: 502}, true},
+		{"other API status", &pve.APIError{StatusCode: 400}, false},
+		{"listed exit code", exitErr, true},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"truncated body", fmt.Errorf("response body read failed: %w", io.ErrUnexpectedEOF), true},
+		{"other error", errors.New("checksum mismatch"), false},
+	}
+	for _, tt := range tests {
+		if got := r.Retryable(tt.err); got != tt.want {
+			t.Errorf("%s: Retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Without listed exit codes, any failed command is retried.
+	if !(Retry{}).Retryable(exitErr) {
+		t.Error("exit code not retried without listed exit codes")
+	}
+	if (Retry{ExitCodes: []int{255}}).Retryable(exitErr) {
+		t.Error("unlisted exit code retried")
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// Selection picks a subset of the configured images.
+type Selection struct {
+	// Only keeps the images whose name or ID is listed.
+	Only []string
+	// Tags keeps the images carrying at least one of the listed tags. With
+	// Only, an image must match both.
+	Tags []string
+	// Exclude drops the images whose name, ID or tag is listed.
+	Exclude []string
+}
+
+// IsEmpty reports whether the selection keeps every image.
+func (s Selection) IsEmpty() bool {
+	return len(s.Only) == 0 && len(s.Tags) == 0 && len(s.Exclude) == 0
+}
+
+// SelectImages returns the images matching the selection, in their original
+// order. Only and Tags narrow the selection together, then Exclude drops
+// images from it. Names or IDs in Only that match no image are reported as
+// an error.
+func SelectImages(images []types.Image, sel Selection) ([]types.Image, error) {
+	for _, want := range sel.Only {
+		found := false
+		for _, img := range images {
+			if matchesNameOrID(img, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no image named %q", want)
+		}
+	}
+
+	var selected []types.Image
+	for _, img := range images {
+		if len(sel.Only) > 0 && !matchesAny(img, sel.Only, matchesNameOrID) {
+			continue
+		}
+		if len(sel.Tags) > 0 && !matchesAny(img, sel.Tags, hasTag) {
+			continue
+		}
+		excluded := false
+		for _, drop := range sel.Exclude {
+			if matchesNameOrID(img, drop) || hasTag(img, drop) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			selected = append(selected, img)
+		}
+	}
+	return selected, nil
+}
+
+// ImageTags splits the comma-separated tags of an image.
+func ImageTags(img types.Image) []string {
+	var tags []string
+	for _, tag := range strings.Split(img.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// matchesAny reports whether match holds for img and any of values.
+func matchesAny(img types.Image, values []string, match func(types.Image, string) bool) bool {
+	for _, value := range values {
+		if match(img, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesNameOrID(img types.Image, value string) bool {
+	return img.Name == value || strconv.Itoa(img.ID) == value
+}
+
+func hasTag(img types.Image, tag string) bool {
+	for _, t := range ImageTags(img) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
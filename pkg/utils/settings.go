@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// DefaultHardware is used for any hardware value missing from the settings
+// file, the image's profile and the image itself.
+var DefaultHardware = types.Hardware{
+	DiskSize: "32G",
+	Memory:   1024,
+	Cores:    2,
+	BIOS:     "ovmf",
+	Machine:  "q35",
+	Bridge:   "vmbr0",
+	Storage:  "local-lvm",
+}
+
+// envNamePattern matches the name of an environment variable.
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// diskSizePattern matches a size accepted by qemu-img resize.
+var diskSizePattern = regexp.MustCompile(`^\+?[0-9]+(\.[0-9]+)?[KMGT]?$`)
+
+// LoadSettings loads global settings from a JSON file. A missing file is not
+// an error; the defaults are returned instead.
+func LoadSettings(path string) (types.Settings, error) {
+	var settings types.Settings
+	file, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return settings, fmt.Errorf("error reading settings file: %w", err)
+	}
+	if err == nil {
+		if err := decodeJSON(file, &settings); err != nil {
+			return settings, fmt.Errorf("error parsing settings JSON %s: %w", path, err)
+		}
+	}
+	settings.Hardware = mergeHardware(DefaultHardware, settings.Hardware)
+	settings.Retry.Download = mergeRetry(DefaultDownloadRetry, settings.Retry.Download)
+	settings.Retry.Steps = mergeRetry(DefaultStepRetry, settings.Retry.Steps)
+	settings.HTTP = mergeHTTP(DefaultHTTP, settings.HTTP)
+	settings.Cache = mergeCache(DefaultCache, settings.Cache)
+	settings.Backend = mergeBackend(DefaultBackend, settings.Backend)
+	return settings, nil
+}
+
+// ResolveHardware returns the hardware of an image: the global defaults,
+// overridden by the image's profile, overridden by the image's own values.
+func ResolveHardware(settings types.Settings, img types.Image) (types.Hardware, error) {
+	hw := settings.Hardware
+	if img.Profile != "" {
+		profile, ok := settings.Profiles[img.Profile]
+		if !ok {
+			return hw, fmt.Errorf("unknown hardware profile %q", img.Profile)
+		}
+		hw = mergeHardware(hw, profile)
+	}
+	if img.Hardware != nil {
+		hw = mergeHardware(hw, *img.Hardware)
+	}
+	return hw, nil
+}
+
+// ResolveVars returns the global variables overridden by the image's own.
+// Secrets are set to pve.Redacted; their values are only read by
+// TemplateData.Reveal.
+func ResolveVars(settings types.Settings, img types.Image) map[string]string {
+	vars := make(map[string]string, len(settings.Vars)+len(img.Vars)+len(settings.Secrets))
+	for k, v := range settings.Vars {
+		vars[k] = v
+	}
+	for k, v := range img.Vars {
+		vars[k] = v
+	}
+	for k := range settings.Secrets {
+		vars[k] = pve.Redacted
+	}
+	return vars
+}
+
+// errNoSecret is returned by ReadSecret for a secret without a source.
+var errNoSecret = errors.New("env or file is required")
+
+// ReadSecret returns the value of a secret: its environment variable if
+// set, or else the content of its file without surrounding white space.
+func ReadSecret(secret types.Secret) (string, error) {
+	if secret.Env != "" {
+		if v := os.Getenv(secret.Env); v != "" {
+			return v, nil
+		}
+	}
+	if secret.File == "" {
+		return "", errNoSecret
+	}
+	value, err := os.ReadFile(secret.File)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(string(value)) == "" {
+		return "", fmt.Errorf("%s is empty", secret.File)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// checkSecret reports a secret that cannot have a value, with the JSON name
+// of the offending field.
+func checkSecret(secret types.Secret) (string, error) {
+	if secret.Env == "" && secret.File == "" {
+		return "", errNoSecret
+	}
+	if secret.Env != "" && !envNamePattern.MatchString(secret.Env) {
+		return "env", fmt.Errorf("invalid environment variable name %q", secret.Env)
+	}
+	return "", nil
+}
+
+// checkHardware reports the first invalid value of a resolved hardware
+// description, with the JSON name of the offending field.
+func checkHardware(hw types.Hardware) (string, error) {
+	switch {
+	case !diskSizePattern.MatchString(hw.DiskSize):
+		return "disk_size", fmt.Errorf("invalid disk size %q", hw.DiskSize)
+	case hw.Memory <= 0:
+		return "memory", fmt.Errorf("memory must be positive")
+	case hw.Cores <= 0:
+		return "cores", fmt.Errorf("cores must be positive")
+	case hw.BIOS != "ovmf" && hw.BIOS != "seabios":
+		return "bios", fmt.Errorf("bios must be ovmf or seabios, got %q", hw.BIOS)
+	case hw.Machine == "":
+		return "machine", fmt.Errorf("machine is required")
+	case hw.Bridge == "":
+		return "bridge", fmt.Errorf("bridge is required")
+	case hw.Storage == "":
+		return "storage", fmt.Errorf("storage is required")
+	}
+	return "", nil
+}
+
+// mergeHardware returns base with every non-zero value of override applied.
+func mergeHardware(base, override types.Hardware) types.Hardware {
+	if override.DiskSize != "" {
+		base.DiskSize = override.DiskSize
+	}
+	if override.Memory != 0 {
+		base.Memory = override.Memory
+	}
+	if override.Cores != 0 {
+		base.Cores = override.Cores
+	}
+	if override.BIOS != "" {
+		base.BIOS = override.BIOS
+	}
+	if override.Machine != "" {
+		base.Machine = override.Machine
+	}
+	if override.Bridge != "" {
+		base.Bridge = override.Bridge
+	}
+	if override.Storage != "" {
+		base.Storage = override.Storage
+	}
+	return base
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// compressionRatio estimates how much larger a compressed image gets once
+// unpacked; cloud images typically compress three to four times.
+const compressionRatio = 4
+
+// ImageSpace is the space a single image needs while it is built.
+type ImageSpace struct {
+	// Download is the size still to download into the cache, 0 if the
+	// image is cached or its size is unknown.
+	Download int64
+	// Scratch is the peak size of the scratch files in the work directory.
+	Scratch int64
+	// Data estimates the data of the disk once imported.
+	Data int64
+	// Disk is the provisioned size of the disk after it is resized.
+	Disk int64
+	// Storage is the Proxmox storage the disk is imported into.
+	Storage string
+}
+
+// SpaceNeed is the space a run needs on a file system or Proxmox storage.
+type SpaceNeed struct {
+	// Location names the storage, or the directories on the file system.
+	Location string
+	Needed   int64
+	Free     int64
+}
+
+// SpaceError lists the locations without enough free space for a run.
+type SpaceError struct {
+	Needs []SpaceNeed
+}
+
+func (e *SpaceError) Error() string {
+	var b strings.Builder
+	b.WriteString("Not enough disk space:")
+	for _, n := range e.Needs {
+		fmt.Fprintf(&b, "\n  %s: %s needed, %s free", n.Location, FormatSize(n.Needed), FormatSize(n.Free))
+	}
+	b.WriteString("\nFree some space or use --skip-space-check to build anyway.")
+	return b.String()
+}
+
+// EstimateSpace returns the space an image needs. The download size is
+// the Content-Length of the image unless a file of the same size from the
+// same URL is cached. Images with a resolver must have been resolved; one
+// that could not be only counts its storage. Unknown sizes count as zero.
+func EstimateSpace(img types.Image, settings types.Settings, paths types.Paths) (ImageSpace, error) {
+	var space ImageSpace
+	hw, err := ResolveHardware(settings, img)
+	if err != nil {
+		return space, err
+	}
+	space.Storage = hw.Storage
+
+	sources := ImageSources(img)
+	if len(sources) == 0 {
+		// The resolver failed; the build will report why.
+		return space, nil
+	}
+	src := sources[0]
+	cache := Cache{Dir: paths.ISODir}
+	var size int64
+	cached := ""
+	if img.Checksum != "" {
+		if path, ok := cache.Lookup(img.Checksum); ok {
+			cached, size = path, fileSize(path)
+		}
+	}
+	if cached == "" {
+		size = contentLength(src.URL)
+		if entry, ok := cache.Latest(img.Name); ok && entry.URL == src.URL && entry.Size == size {
+			cached, _ = cache.Lookup(entry.Checksum)
+		}
+	}
+	if cached == "" && size > 0 {
+		space.Download = max(size-PartialSize(filepath.Join(paths.ISODir, img.Name+PartSuffix), src.URL), 0)
+	}
+
+	packing, err := DetectPacking(img, cached, src.URL)
+	if err != nil {
+		return space, err
+	}
+	space.Data, space.Scratch = size, size
+	if packing.Compression != types.CompressionNone {
+		space.Data = size * compressionRatio
+		space.Scratch = space.Data
+	}
+	// The unpacked disk is kept until it is converted.
+	if !packing.Plain() && (packing.Compression != types.CompressionNone || packing.Tar) && packing.Format != types.FormatQcow2 {
+		space.Scratch += space.Data
+	}
+
+	if space.Disk, err = ParseSize(strings.TrimPrefix(hw.DiskSize, "+")); err != nil {
+		return space, err
+	}
+	if strings.HasPrefix(hw.DiskSize, "+") {
+		space.Disk += space.Data
+	}
+	return space, nil
+}
+
+// contentLength returns the size of a remote file, or 0 if it is unknown.
+func contentLength(url string) int64 {
+	resp, err := HTTPClient.Head(url)
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0
+	}
+	return resp.ContentLength
+}
+
+// thickStorages are the Proxmox storage types allocating the full size of a
+// disk up front. Other storages only take the space of the disk's data.
+var thickStorages = map[string]bool{"lvm": true, "iscsi": true, "iscsidirect": true}
+
+// CheckSpace compares the space images need, built parallel at a time,
+// with the free space of the ISO and work directories and of the Proxmox
+// storages they are imported into, as reported by backend. It returns a
+// *SpaceError listing every location lacking space. Locations whose free
+// space cannot be determined, e.g. when pvesm is not installed, are not
+// checked.
+//
+// Images with a resolver are resolved to estimate their space. They are
+// returned resolved, so that the build does not resolve them again; those
+// that could not be are returned as is and fail when they are built.
+func CheckSpace(images []types.Image, settings types.Settings, paths types.Paths, parallel int, backend pve.Backend) ([]types.Image, error) {
+	images = slices.Clone(images)
+	var download int64
+	var scratch []int64
+	data := make(map[string]int64)
+	disk := make(map[string]int64)
+	for i, img := range images {
+		if img.Resolver != nil {
+			if resolved, err := ResolveImage(img); err == nil {
+				images[i], img = resolved, resolved
+			}
+		}
+		space, err := EstimateSpace(img, settings, paths)
+		if err != nil {
+			return images, fmt.Errorf("estimating the space of %s: %w", img.Name, err)
+		}
+		download += space.Download
+		scratch = append(scratch, space.Scratch)
+		data[space.Storage] += space.Data
+		disk[space.Storage] += space.Disk
+	}
+	// Scratch files are removed once an image is built, so only the
+	// largest ones built at the same time add up.
+	sort.Slice(scratch, func(i, j int) bool { return scratch[i] > scratch[j] })
+	var work int64
+	for _, size := range scratch[:min(parallel, len(scratch))] {
+		work += size
+	}
+
+	var needs []SpaceNeed
+	dirs, err := dirNeeds([]SpaceNeed{{Location: paths.ISODir, Needed: download}, {Location: paths.WorkDir, Needed: work}})
+	if err != nil {
+		return images, err
+	}
+	needs = append(needs, dirs...)
+
+	storages, err := backend.StorageStatus(context.Background())
+	if err == nil {
+		names := make([]string, 0, len(disk))
+		for name := range disk {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			status, ok := storages[name]
+			if !ok {
+				return images, fmt.Errorf("storage %s not found on the node", name)
+			}
+			needed := data[name]
+			if thickStorages[status.Type] {
+				needed = disk[name]
+			}
+			needs = append(needs, SpaceNeed{Location: "storage " + name, Needed: needed, Free: status.Available})
+		}
+	} else if !errors.Is(err, exec.ErrNotFound) {
+		return images, err
+	}
+
+	var short []SpaceNeed
+	for _, need := range needs {
+		if need.Needed > need.Free {
+			short = append(short, need)
+		}
+	}
+	if len(short) > 0 {
+		return images, &SpaceError{Needs: short}
+	}
+	return images, nil
+}
+
+// dirNeeds adds up the space needed in directories sharing a file system.
+// Directories that do not exist yet are on the file system of their
+// nearest existing parent.
+func dirNeeds(dirs []SpaceNeed) ([]SpaceNeed, error) {
+	var needs []SpaceNeed
+	index := make(map[uint64]int)
+	for _, dir := range dirs {
+		free, device, err := diskFree(dir.Location)
+		if errors.Is(err, errUnsupported) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("checking free space of %s: %w", dir.Location, err)
+		}
+		if i, ok := index[device]; ok {
+			if !slices.Contains(strings.Split(needs[i].Location, ", "), dir.Location) {
+				needs[i].Location += ", " + dir.Location
+			}
+			needs[i].Needed += dir.Needed
+			continue
+		}
+		index[device] = len(needs)
+		dir.Free = free
+		needs = append(needs, dir)
+	}
+	return needs, nil
+}
+
+// errUnsupported is returned where free space cannot be determined.
+var errUnsupported = errors.New("not supported on this platform")
+
+// existingParent returns dir, or its nearest parent that exists.
+func existingParent(dir string) string {
+	dir = filepath.Clean(dir)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+// fileSize returns the size of a file, or 0 if it cannot be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package utils
+
+import "golang.org/x/sys/unix"
+
+// diskFree returns the space available to unprivileged users on the file
+// system of dir, and the device of the file system.
+func diskFree(dir string) (int64, uint64, error) {
+	dir = existingParent(dir)
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return 0, 0, err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(fs.Bavail) * fs.Bsize, st.Dev, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package utils
+
+// diskFree is only implemented on Linux, where Proxmox VE runs.
+func diskFree(dir string) (int64, uint64, error) {
+	return 0, 0, errUnsupported
+}
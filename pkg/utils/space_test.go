@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// remoteSize is the size of every remote image, far more than any test
+// file system has free.
+const remoteSize = 1 << 50
+
+// gig is the size of "1G".
+const gig = 1 << 30
+
+// storageBackend reports storages, or err; its other methods are not
+// implemented.
+type storageBackend struct {
+	pve.Backend
+	storages map[string]pve.Storage
+	err      error
+}
+
+func (b storageBackend) StorageStatus(ctx context.Context) (map[string]pve.Storage, error) {
+	return b.storages, b.err
+}
+
+func TestEstimateSpace(t *testing.T) {
+	srv := newTestServer(t, serveZeros(remoteSize))
+	settings := types.Settings{Hardware: types.Hardware{DiskSize: "32G", Storage: "local-lvm"}}
+	const s = remoteSize
+	tests := []struct {
+		name string
+		file string
+		hw   *types.Hardware
+		want ImageSpace
+	}{
+		{"qcow2", "image.qcow2", nil, ImageSpace{Download: s, Scratch: s, Data: s, Disk: 32 * gig, Storage: "local-lvm"}},
+		{"compressed qcow2", "image.qcow2.gz", nil, ImageSpace{Download: s, Scratch: 4 * s, Data: 4 * s, Disk: 32 * gig, Storage: "local-lvm"}},
+		{"compressed raw disk", "image.raw.xz", nil, ImageSpace{Download: s, Scratch: 8 * s, Data: 4 * s, Disk: 32 * gig, Storage: "local-lvm"}},
+		{"tar archive", "image.tar", nil, ImageSpace{Download: s, Scratch: 2 * s, Data: s, Disk: 32 * gig, Storage: "local-lvm"}},
+		{"raw disk", "image.img", nil, ImageSpace{Download: s, Scratch: s, Data: s, Disk: 32 * gig, Storage: "local-lvm"}},
+		{"grown disk", "image.qcow2.zst", &types.Hardware{DiskSize: "+10G", Storage: "thick"}, ImageSpace{Download: s, Scratch: 4 * s, Data: 4 * s, Disk: 10*gig + 4*s, Storage: "thick"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := types.Paths{ISODir: t.TempDir(), WorkDir: t.TempDir()}
+			img := types.Image{Name: "image", URL: srv.URL + "/" + tt.file, Hardware: tt.hw}
+			got, err := EstimateSpace(img, settings, paths)
+			if err != nil {
+				t.Fatalf("EstimateSpace: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("EstimateSpace = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateSpaceDownload(t *testing.T) {
+	srv := newTestServer(t, serveZeros(remoteSize))
+	settings := types.Settings{Hardware: types.Hardware{DiskSize: "32G"}}
+
+	// A cached image is not downloaded again, and its data is the size of
+	// the cached file.
+	paths := types.Paths{ISODir: t.TempDir(), WorkDir: t.TempDir()}
+	fillCache(t, paths.ISODir, []cachedFile{{"image", "cached", 1}})
+	img := types.Image{Name: "image", URL: srv.URL + "/image.qcow2", Checksum: sumOf("cached")}
+	got, err := EstimateSpace(img, settings, paths)
+	if err != nil {
+		t.Fatalf("EstimateSpace: %v", err)
+	}
+	if want := (ImageSpace{Scratch: 6, Data: 6, Disk: 32 * gig}); got != want {
+		t.Errorf("EstimateSpace of a cached image = %+v, want %+v", got, want)
+	}
+
+	// Only the rest of a partial download is still to download.
+	paths = types.Paths{ISODir: t.TempDir(), WorkDir: t.TempDir()}
+	img = types.Image{Name: "image", URL: srv.URL + "/image.qcow2"}
+	writePartial(t, filepath.Join(paths.ISODir, "image"+PartSuffix), img.URL, 1000, partState{ETag: `"v1"`})
+	got, err = EstimateSpace(img, settings, paths)
+	if err != nil {
+		t.Fatalf("EstimateSpace: %v", err)
+	}
+	if got.Download != remoteSize-1000 || got.Data != remoteSize {
+		t.Errorf("EstimateSpace of a partial download = %+v, want %d to download of %d", got, remoteSize-1000, remoteSize)
+	}
+}
+
+// requireDiskFree skips tests of the free space of directories where it
+// cannot be determined.
+func requireDiskFree(t *testing.T) {
+	t.Helper()
+	if _, _, err := diskFree(t.TempDir()); errors.Is(err, errUnsupported) {
+		t.Skip("free space not supported on this platform")
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	requireDiskFree(t)
+	srv := newTestServer(t, serveZeros(remoteSize))
+	settings := types.Settings{Hardware: types.Hardware{DiskSize: "32G", Storage: "thin"}}
+	thick := &types.Hardware{DiskSize: "+10G", Storage: "thick"}
+	// Download, scratch, data and disk of the images, in units of
+	// remoteSize plus the sizes of the settings:
+	//   a: 1, 1, 1, 32G on thin
+	//   b: 1, 8, 4, 10G+4 on thick
+	//   c: 1, 4, 4, 32G on thin
+	images := []types.Image{
+		{Name: "a", URL: srv.URL + "/a.qcow2"},
+		{Name: "b", URL: srv.URL + "/b.raw.xz", Hardware: thick},
+		{Name: "c", URL: srv.URL + "/c.qcow2.gz"},
+	}
+	const s = remoteSize
+	tests := []struct {
+		name     string
+		parallel int
+		storages map[string]pve.Storage
+		// wantDirs is the space needed in the ISO and work directories,
+		// which share a file system.
+		wantDirs int64
+		// wantStorages are the short storages and their needs.
+		wantStorages []SpaceNeed
+	}{
+		{
+			name:     "thin storage takes the data, thick storage the disk",
+			parallel: 1,
+			storages: map[string]pve.Storage{
+				"thin":  {Type: "lvmthin", Available: 5 * s},
+				"thick": {Type: "lvm", Available: 4 * s},
+			},
+			wantDirs:     3*s + 8*s,
+			wantStorages: []SpaceNeed{{Location: "storage thick", Needed: 10*gig + 4*s, Free: 4 * s}},
+		},
+		{
+			name:     "scratch of images built at the same time",
+			parallel: 2,
+			storages: map[string]pve.Storage{
+				"thin":  {Type: "dir", Available: 5*s - 1},
+				"thick": {Type: "iscsi", Available: 10*gig + 4*s},
+			},
+			wantDirs:     3*s + 8*s + 4*s,
+			wantStorages: []SpaceNeed{{Location: "storage thin", Needed: 5 * s, Free: 5*s - 1}},
+		},
+		{
+			name:     "more parallel builds than images",
+			parallel: 8,
+			storages: map[string]pve.Storage{
+				"thin":  {Type: "zfspool", Available: 5 * s},
+				"thick": {Type: "lvm", Available: 10*gig + 4*s},
+			},
+			wantDirs: 3*s + 8*s + 4*s + s,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := types.Paths{ISODir: filepath.Join(dir, "iso"), WorkDir: filepath.Join(dir, "work")}
+			_, err := CheckSpace(images, settings, paths, tt.parallel, storageBackend{storages: tt.storages})
+			var spaceErr *SpaceError
+			if !errors.As(err, &spaceErr) {
+				t.Fatalf("CheckSpace = %v, want a *SpaceError", err)
+			}
+			needs := spaceErr.Needs
+			if len(needs) == 0 || needs[0].Location != paths.ISODir+", "+paths.WorkDir || needs[0].Needed != tt.wantDirs {
+				t.Fatalf("needs = %+v, want %s, %s to need %d first", needs, paths.ISODir, paths.WorkDir, tt.wantDirs)
+			}
+			if got := fmt.Sprintf("%+v", needs[1:]); got != fmt.Sprintf("%+v", tt.wantStorages) {
+				t.Errorf("short storages = %s, want %+v", got, tt.wantStorages)
+			}
+		})
+	}
+}
+
+func TestCheckSpaceStorages(t *testing.T) {
+	dir := t.TempDir()
+	paths := types.Paths{ISODir: filepath.Join(dir, "iso"), WorkDir: filepath.Join(dir, "work")}
+	settings := types.Settings{Hardware: types.Hardware{DiskSize: "32G", Storage: "local-lvm"}}
+	fillCache(t, paths.ISODir, []cachedFile{{"image", "cached", 1}})
+	images := []types.Image{{Name: "image", URL: "http://127.0.0.1:1/image.qcow2", Checksum: sumOf("cached")}}
+
+	if _, err := CheckSpace(images, settings, paths, 1, storageBackend{storages: map[string]pve.Storage{"local-lvm": {Type: "lvmthin", Available: 6}}}); err != nil {
+		t.Errorf("CheckSpace = %v, want enough space", err)
+	}
+	_, err := CheckSpace(images, settings, paths, 1, storageBackend{storages: map[string]pve.Storage{"local": {Type: "dir", Available: 1 << 40}}})
+	if err == nil || err.Error() != "storage local-lvm not found on the node" {
+		t.Errorf("CheckSpace = %v, want the storage not to be found", err)
+	}
+	// Without pvesm, storages are not checked.
+	notFound := &exec.Error{Name: "pvesm", Err: exec.ErrNotFound}
+	if _, err := CheckSpace(images, settings, paths, 1, storageBackend{err: notFound}); err != nil {
+		t.Errorf("CheckSpace = %v, want storages not to be checked", err)
+	}
+	failed := errors.New("pvesm status: exit status 2")
+	if _, err := CheckSpace(images, settings, paths, 1, storageBackend{err: failed}); err != failed {
+		t.Errorf("CheckSpace = %v, want %v", err, failed)
+	}
+}
+
+func TestDirNeeds(t *testing.T) {
+	requireDiskFree(t)
+	dir := t.TempDir()
+	iso, work := filepath.Join(dir, "iso"), filepath.Join(dir, "work", "new")
+	if err := os.Mkdir(iso, 0755); err != nil {
+		t.Fatal(err)
+	}
+	needs, err := dirNeeds([]SpaceNeed{{Location: iso, Needed: 3}, {Location: work, Needed: 4}, {Location: iso, Needed: 5}})
+	if err != nil {
+		t.Fatalf("dirNeeds: %v", err)
+	}
+	if len(needs) != 1 || needs[0].Location != iso+", "+work || needs[0].Needed != 12 || needs[0].Free <= 0 {
+		t.Errorf("dirNeeds = %+v, want %s, %s to need 12", needs, iso, work)
+	}
+}
+
+func TestSpaceError(t *testing.T) {
+	err := &SpaceError{Needs: []SpaceNeed{
+		{Location: "/var/lib/vz/template/iso, /tmp", Needed: 12 * gig, Free: 3 * gig / 2},
+		{Location: "storage local-lvm", Needed: 64 * gig, Free: 512 << 20},
+	}}
+	want := strings.Join([]string{
+		"Not enough disk space:",
+		"  /var/lib/vz/template/iso, /tmp: 12.0G needed, 1.5G free",
+		"  storage local-lvm: 64.0G needed, 512.0M free",
+		"Free some space or use --skip-space-check to build anyway.",
+	}, "\n")
+	if got := err.Error(); got != want {
+		t.Errorf("Error() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCheckSpaceResolvesOnce(t *testing.T) {
+	var resolved atomic.Int32
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			resolved.Add(1)
+			http.Redirect(w, r, "/image-2.qcow2", http.StatusFound)
+			return
+		}
+		serveZeros(1000)(w, r)
+	})
+	dir := t.TempDir()
+	paths := types.Paths{ISODir: filepath.Join(dir, "iso"), WorkDir: filepath.Join(dir, "work")}
+	settings := types.Settings{Hardware: types.Hardware{DiskSize: "32G", Storage: "local-lvm"}}
+	images := []types.Image{{Name: "image", Resolver: &types.Resolver{Type: types.ResolverLatest, URL: srv.URL + "/latest"}}}
+	notFound := &exec.Error{Name: "pvesm", Err: exec.ErrNotFound}
+
+	got, err := CheckSpace(images, settings, paths, 1, storageBackend{err: notFound})
+	if err != nil {
+		t.Fatalf("CheckSpace: %v", err)
+	}
+	if n := resolved.Load(); n != 1 {
+		t.Errorf("resolved %d times, want once", n)
+	}
+	if got[0].Resolver != nil || got[0].URL != srv.URL+"/image-2.qcow2" {
+		t.Errorf("CheckSpace returned %+v, want the resolved image", got[0])
+	}
+	if images[0].Resolver == nil {
+		t.Error("CheckSpace modified the images it was given")
+	}
+}
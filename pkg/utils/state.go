@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// StateVersion is the version of the state file format written by WriteState.
+const StateVersion = 1
+
+// LoadState loads the state file. A missing file is an empty state.
+func LoadState(path string) (types.StateFile, error) {
+	state := types.StateFile{Version: StateVersion}
+	file, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("error reading state file: %w", err)
+	}
+	if err := decodeJSON(file, &state); err != nil {
+		return state, fmt.Errorf("error parsing state file JSON %s: %w", path, err)
+	}
+	if state.Version != StateVersion {
+		return state, fmt.Errorf("state file %s has unsupported version %d", path, state.Version)
+	}
+	return state, nil
+}
+
+// WriteState atomically replaces the state file at path.
+func WriteState(path string, state types.StateFile) error {
+	state.Version = StateVersion
+	if err := writeJSONFile(path, state); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	return nil
+}
+
+// RecordBuild replaces the entry of an image in the state file at path.
+// Callers must not record builds concurrently.
+func RecordBuild(path string, built types.BuiltImage) error {
+	state, err := LoadState(path)
+	if err != nil {
+		return err
+	}
+	for i, entry := range state.Images {
+		if entry.Name == built.Name {
+			state.Images[i] = built
+			return WriteState(path, state)
+		}
+	}
+	state.Images = append(state.Images, built)
+	return WriteState(path, state)
+}
+
+// BuiltImages returns the entries of a state file by image name.
+func BuiltImages(state types.StateFile) map[string]types.BuiltImage {
+	built := make(map[string]types.BuiltImage, len(state.Images))
+	for _, entry := range state.Images {
+		built[entry.Name] = entry
+	}
+	return built
+}
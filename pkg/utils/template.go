@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// TemplateData is the context step commands are rendered against.
+type TemplateData struct {
+	// ID, Name, Tags and Vendor are shortcuts for the fields of Image.
+	ID     int
+	Name   string
+	Tags   string
+	Vendor string
+	// FilePath is the scratch disk image the steps operate on.
+	FilePath string
+	// Image is the full image record from os_list.json.
+	Image types.Image
+	// Hardware is the resolved hardware of the image.
+	Hardware types.Hardware
+	// Storage and Bridge are shortcuts for the fields of Hardware.
+	Storage string
+	Bridge  string
+	// Vars holds the global variables overridden by the image's own.
+	Vars map[string]string
+	// Settings are the global settings.
+	Settings types.Settings
+	// Paths are the file system locations used by the run.
+	Paths types.Paths
+}
+
+// NewTemplateData builds the template context for an image. It fails if the
+// image refers to an unknown hardware profile.
+func NewTemplateData(img types.Image, filePath string, settings types.Settings, paths types.Paths) (TemplateData, error) {
+	hw, err := ResolveHardware(settings, img)
+	if err != nil {
+		return TemplateData{}, err
+	}
+	return TemplateData{
+		ID:       img.ID,
+		Name:     img.Name,
+		Tags:     img.Tags,
+		Vendor:   img.Vendor,
+		FilePath: filePath,
+		Image:    img,
+		Hardware: hw,
+		Storage:  hw.Storage,
+		Bridge:   hw.Bridge,
+		Vars:     ResolveVars(settings, img),
+		Settings: settings,
+		Paths:    paths,
+	}, nil
+}
+
+// Reveal returns data with the values of the secrets in Vars, for rendering
+// the commands that are run. Commands rendered against data itself show
+// pve.Redacted instead, so that they can be displayed and logged.
+func (d TemplateData) Reveal() (TemplateData, error) {
+	if len(d.Settings.Secrets) == 0 {
+		return d, nil
+	}
+	vars := maps.Clone(d.Vars)
+	for _, name := range slices.Sorted(maps.Keys(d.Settings.Secrets)) {
+		secret := d.Settings.Secrets[name]
+		value, err := ReadSecret(secret)
+		if errors.Is(err, errNoSecret) && secret.Env != "" {
+			err = fmt.Errorf("%s is not set", secret.Env)
+		}
+		if err != nil {
+			return d, fmt.Errorf("secret %s: %w", name, err)
+		}
+		vars[name] = value
+	}
+	d.Vars = vars
+	return d, nil
+}
+
+// ScratchFile returns the path of the scratch disk image of an image. Each
+// image has its own so that images can be built in parallel.
+func ScratchFile(paths types.Paths, img types.Image) string {
+	return filepath.Join(paths.WorkDir, img.Name+".qcow2")
+}
+
+// templateFuncs are the helper functions available to step commands.
+var templateFuncs = template.FuncMap{
+	"quote":   ShellQuote,
+	"join":    strings.Join,
+	"split":   strings.Split,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+	"default": func(fallback, value any) any {
+		if value == nil || value == "" {
+			return fallback
+		}
+		return value
+	},
+	"required": func(name string, value any) (any, error) {
+		if value == nil || value == "" {
+			return nil, fmt.Errorf("%s is required", name)
+		}
+		return value, nil
+	},
+	// var is bound to the data of each rendering by execute.
+	"var": TemplateData{}.variable,
+}
+
+// variable implements the var helper: it returns the variable name, or the
+// fallback if the variable is not set. Without a fallback, a missing
+// variable is an error like with .Vars.name.
+func (d TemplateData) variable(name string, fallback ...string) (string, error) {
+	if v, ok := d.Vars[name]; ok {
+		return v, nil
+	}
+	if len(fallback) > 0 {
+		return fallback[0], nil
+	}
+	return "", fmt.Errorf("variable %q is not set", name)
+}
+
+// execute renders a template parsed by parseTemplate against data.
+func execute(tmpl *template.Template, data TemplateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Funcs(template.FuncMap{"var": data.variable}).Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// ParseCommand parses the command of a step as a text/template.
+func ParseCommand(step types.Step) (*template.Template, error) {
+	return parseTemplate(step.Name, step.Command)
+}
+
+// parseTemplate parses text as a text/template with the helper functions
+// of step commands.
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).
+		Funcs(templateFuncs).
+		Option("missingkey=error").
+		Parse(text)
+}
+
+// operationFields returns the templates of a VM operation by the JSON name
+// of their field, e.g. "options.memory", in order.
+func operationFields(vm *types.VMOperation) [][2]string {
+	fields := [][2]string{{"disk", vm.Disk}, {"size", vm.Size}, {"storage", vm.Storage}}
+	for _, k := range pve.Options(vm.Options).Keys() {
+		fields = append(fields, [2]string{"options." + k, vm.Options[k]})
+	}
+	return fields
+}
+
+// parseOperation parses every template of the VM operation of a step and
+// reports the first that fails, with the JSON name of its field.
+func parseOperation(step types.Step) (string, error) {
+	for _, f := range operationFields(step.VM) {
+		if _, err := parseTemplate(step.Name, f[1]); err != nil {
+			return f[0], err
+		}
+	}
+	return "", nil
+}
+
+// RenderOperation renders the VM operation of a step against data. The
+// operation applies to the VM of the image, and import_disk imports the
+// scratch disk image, by default into the storage of the image. Options
+// rendering to an empty string are left out, so that a template can make
+// an option conditional.
+func RenderOperation(step types.Step, data TemplateData) (pve.Operation, error) {
+	vm := step.VM
+	rendered := make(map[string]string)
+	for _, f := range operationFields(vm) {
+		tmpl, err := parseTemplate(step.Name, f[1])
+		if err != nil {
+			return pve.Operation{}, fmt.Errorf("%s: %w", f[0], err)
+		}
+		value, err := execute(tmpl, data)
+		if err != nil {
+			return pve.Operation{}, fmt.Errorf("%s: %w", f[0], err)
+		}
+		rendered[f[0]] = value
+	}
+
+	op := pve.Operation{Op: vm.Op, VMID: data.ID, Disk: rendered["disk"], Size: rendered["size"]}
+	if len(vm.Options) > 0 {
+		op.Options = make(pve.Options, len(vm.Options))
+		for k := range vm.Options {
+			if v := rendered["options."+k]; v != "" {
+				op.Options[k] = v
+			}
+		}
+	}
+	if vm.Op == types.OpImportDisk {
+		op.File = data.FilePath
+		op.Storage = rendered["storage"]
+		if op.Storage == "" {
+			op.Storage = data.Storage
+		}
+	}
+	return op, nil
+}
+
+// RenderStep renders a step against data for display: its command, or the
+// qm command equivalent to its VM operation.
+func RenderStep(step types.Step, data TemplateData) (string, error) {
+	if step.VM == nil {
+		return RenderCommand(step, data)
+	}
+	op, err := RenderOperation(step, data)
+	if err != nil {
+		return "", err
+	}
+	return op.String(), nil
+}
+
+// RenderCommand renders the command of a step against data. Unknown fields
+// and missing variables are reported as errors.
+func RenderCommand(step types.Step, data TemplateData) (string, error) {
+	tmpl, err := ParseCommand(step)
+	if err != nil {
+		return "", err
+	}
+	return execute(tmpl, data)
+}
+
+// ShellQuote quotes s for safe use as a single word in a bash command.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
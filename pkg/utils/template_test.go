@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+func TestRenderCommand(t *testing.T) {
+	settings := types.Settings{
+		Hardware: types.Hardware{Storage: "local-lvm", BIOS: "ovmf"},
+		Vars:     map[string]string{"ciuser": "root", "empty": ""},
+	}
+	img := types.Image{ID: 8202, Name: "debian13", Tags: "debian,13", Vars: map[string]string{"ciuser": "debian"}}
+	data, err := NewTemplateData(img, "/tmp/debian13.qcow2", settings, types.Paths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		command string
+		want    string
+		wantErr string
+	}{
+		{"qm importdisk {{.ID}} {{.FilePath}} {{.Storage}}", "qm importdisk 8202 /tmp/debian13.qcow2 local-lvm", ""},
+		{"--ciuser {{quote .Vars.ciuser}}", "--ciuser 'debian'", ""},
+		{`{{if eq .Hardware.BIOS "ovmf"}}--efidisk0 {{.Storage}}:0{{end}}`, "--efidisk0 local-lvm:0", ""},
+		{`{{var "ciuser"}} {{var "cipassword" "changeme"}} {{var "empty" "x"}}`, "debian changeme ", ""},
+		{`{{default "none" .Image.Profile}} {{default "x" (var "empty")}}`, "none x", ""},
+		{"{{.Vars.cipassword}}", "", `map has no entry for key "cipassword"`},
+		{`{{var "cipassword"}}`, "", `variable "cipassword" is not set`},
+		{`{{required "profile" .Image.Profile}}`, "", "profile is required"},
+		{"{{.Foo}}", "", "can't evaluate field Foo"},
+	}
+	for _, tt := range tests {
+		got, err := RenderCommand(types.Step{Name: "step", Command: tt.command}, data)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("RenderCommand(%q) error = %v, want %q", tt.command, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("RenderCommand(%q): %v", tt.command, err)
+		case got != tt.want:
+			t.Errorf("RenderCommand(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestRenderOperationVar(t *testing.T) {
+	data, err := NewTemplateData(types.Image{ID: 100, Name: "a"}, "/tmp/a.qcow2", types.Settings{}, types.Paths{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := types.Step{Name: "Set credentials", VM: &types.VMOperation{Op: types.OpSet, Options: map[string]string{
+		"ciuser":     `{{var "ciuser" "root"}}`,
+		"cipassword": `{{var "cipassword" ""}}`,
+	}}}
+	op, err := RenderOperation(step, data)
+	if err != nil {
+		t.Fatalf("RenderOperation: %v", err)
+	}
+	if got := op.String(); got != "qm set 100 --ciuser root" {
+		t.Errorf("RenderOperation = %s, want the unset password left out", got)
+	}
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// Results of comparing a build or a local file with upstream.
+const (
+	UpdateCurrent  = "up to date"
+	UpdateStale    = "stale"
+	UpdateNotBuilt = "not built"
+	UpdateMissing  = "missing"
+	UpdateUnknown  = "unknown"
+)
+
+// UpdateCheck compares the upstream checksum of an image with the one its
+// template was built from and with the images in the cache.
+type UpdateCheck struct {
+	Name string
+	// URL is the newest source of the image.
+	URL string
+	// Upstream is the published checksum, or empty if the image has none.
+	Upstream string
+	// Template is the result for the template, one of UpdateCurrent,
+	// UpdateStale, UpdateNotBuilt or UpdateUnknown.
+	Template string
+	// Cache is UpdateCurrent if the upstream image is cached, UpdateStale
+	// if only older images are, and UpdateMissing if none is. It is
+	// UpdateUnknown for cached images without a checksum.
+	Cache string
+}
+
+// Stale reports whether the template must be rebuilt to match upstream.
+func (c UpdateCheck) Stale() bool {
+	return c.Template == UpdateStale || c.Template == UpdateNotBuilt
+}
+
+// CheckUpdate fetches the upstream checksum of an image and compares it
+// with its last build, if any, and with the image cache.
+func CheckUpdate(img types.Image, built *types.BuiltImage, paths types.Paths, retry Retry) (UpdateCheck, error) {
+	check := UpdateCheck{Name: img.Name, Template: UpdateUnknown, Cache: UpdateUnknown}
+	url, upstream, err := UpstreamChecksum(img, paths.KeyringDir, retry)
+	if err != nil {
+		return check, err
+	}
+	check.URL, check.Upstream = url, upstream
+
+	// Without a published checksum there is nothing to compare with, even
+	// for an image that was never built.
+	switch {
+	case upstream == "":
+	case built == nil:
+		check.Template = UpdateNotBuilt
+	case built.Checksum == "":
+	case sameAlgorithm(built.Checksum, upstream):
+		check.Template = compareChecksums(built.Checksum, upstream)
+	}
+
+	cache := Cache{Dir: paths.ISODir}
+	_, upstreamCached := cache.Lookup(upstream)
+	_, cached := cache.Latest(img.Name)
+	switch {
+	case upstreamCached:
+		check.Cache = UpdateCurrent
+	case !cached:
+		check.Cache = UpdateMissing
+	case upstream != "":
+		check.Cache = UpdateStale
+	}
+	return check, nil
+}
+
+// UpstreamChecksum returns the newest source of an image and its
+// published checksum, e.g. "sha512:...". Images with a resolver are
+// resolved first; the checksum is the image's pinned one, else the one in
+// the checksum file of the first source that has one. It is empty if the
+// image has neither.
+func UpstreamChecksum(img types.Image, keyringDir string, retry Retry) (string, string, error) {
+	if img.Resolver != nil {
+		err := retry.Do(func() (err error) {
+			img, err = ResolveImage(img)
+			return err
+		}, nil)
+		if err != nil {
+			return "", "", fmt.Errorf("resolving latest build failed: %w", err)
+		}
+	}
+	sources := ImageSources(img)
+	if img.Checksum != "" {
+		algo, digest, err := checksum.Parse(img.Checksum)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid checksum: %w", err)
+		}
+		return sources[0].URL, checksum.Format(algo, digest), nil
+	}
+
+	var errs []error
+	for _, src := range sources {
+		if src.ChecksumURL == "" {
+			continue
+		}
+		var digest, algo string
+		err := retry.Do(func() (err error) {
+			if img.GPG != nil {
+				digest, algo, err = GetVerifiedChecksum(src, img.GPG, keyringDir, filepath.Base(src.URL))
+			} else {
+				digest, algo, err = GetExpectedChecksum(src.ChecksumURL, filepath.Base(src.URL))
+			}
+			return err
+		}, nil)
+		if err == nil {
+			return src.URL, checksum.Format(algo, digest), nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src.ChecksumURL, err))
+	}
+	return sources[0].URL, "", errors.Join(errs...)
+}
+
+// sameAlgorithm reports whether two checksums use the same algorithm.
+func sameAlgorithm(a, b string) bool {
+	algoA, _, errA := checksum.Parse(a)
+	algoB, _, errB := checksum.Parse(b)
+	return errA == nil && errB == nil && algoA == algoB
+}
+
+// compareChecksums returns UpdateCurrent if both checksums are equal and
+// UpdateStale otherwise.
+func compareChecksums(have, want string) string {
+	if have == want {
+		return UpdateCurrent
+	}
+	return UpdateStale
+}
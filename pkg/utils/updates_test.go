@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+func TestCheckUpdateWithoutChecksum(t *testing.T) {
+	srv := newTestServer(t, serveImage(""))
+	paths := types.Paths{ISODir: t.TempDir()}
+	img := types.Image{ID: 100, Name: "a", URL: srv.URL + "/a.qcow2"}
+	for _, built := range []*types.BuiltImage{nil, {Name: "a", ID: 100, Checksum: sumOf(string(image))}} {
+		check, err := CheckUpdate(img, built, paths, Retry{Attempts: 1})
+		if err != nil {
+			t.Fatalf("CheckUpdate: %v", err)
+		}
+		if check.Template != UpdateUnknown || check.Stale() {
+			t.Errorf("built %v: template %s, want %s", built != nil, check.Template, UpdateUnknown)
+		}
+	}
+}
+
+func TestChecksumFetchedOnce(t *testing.T) {
+	var fetches atomic.Int32
+	sum := sumOf(string(image))
+	srv := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/SHA256SUMS" {
+			fetches.Add(1)
+			fmt.Fprintf(w, "%s *a.qcow2\n", strings.TrimPrefix(sum, "sha256:"))
+			return
+		}
+		serveImage("")(w, r)
+	})
+	img := types.Image{ID: 100, Name: "a", URL: srv.URL + "/a.qcow2", ChecksumURL: srv.URL + "/SHA256SUMS"}
+	retry := Retry{Attempts: 1}
+	rep := report.Scope{Reporter: &report.Recorder{}}
+
+	// Without an upstream checksum, the checksum file is fetched to look
+	// the image up in the cache and reused to verify the download.
+	paths := types.Paths{ISODir: t.TempDir()}
+	if _, err := HandleDownloadAndChecksum(rep, 0, img, paths, Upstream{}, retry, NewLocks(), false); err != nil {
+		t.Fatalf("HandleDownloadAndChecksum: %v", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("checksum file fetched %d times, want once", n)
+	}
+
+	fetches.Store(0)
+	paths.ISODir = t.TempDir()
+	url, upstream, err := UpstreamChecksum(img, paths.KeyringDir, retry)
+	if err != nil || upstream != sum {
+		t.Fatalf("UpstreamChecksum = %s, %v, want %s", upstream, err, sum)
+	}
+	download, err := HandleDownloadAndChecksum(rep, 0, img, paths, Upstream{URL: url, Checksum: upstream}, retry, NewLocks(), false)
+	if err != nil {
+		t.Fatalf("HandleDownloadAndChecksum: %v", err)
+	}
+	if download.Checksum != sum {
+		t.Errorf("download checksum = %s, want %s", download.Checksum, sum)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("checksum file fetched %d times, want once by UpstreamChecksum", n)
+	}
+}
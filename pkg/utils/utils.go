@@ -2,50 +2,44 @@ package utils
 
 import (
 	"bufio"
-	"crypto/md5"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
+	"context"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 	"time"
 
-	"github.com/aloks98/pve-ctgen/pkg/style"
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/report"
 	"github.com/aloks98/pve-ctgen/pkg/types"
-	"github.com/rivo/tview"
 )
 
+// LogDir is the directory LogError writes to.
+var LogDir = "logs"
+
 // --- Progress Writer ---
 
 // ProgressWriter is an io.Writer that reports download progress.
 type ProgressWriter struct {
-	Total      float64
-	Downloaded float64
+	Total      int64
+	Downloaded int64
 	LastUpdate time.Time
-	App        *tview.Application
-	OutputView *tview.TextView
+	Reporter   report.Scope
 }
 
 // Write implements the io.Writer interface for ProgressWriter.
 func (pw *ProgressWriter) Write(p []byte) (int, error) {
 	n := len(p)
-	pw.Downloaded += float64(n)
+	pw.Downloaded += int64(n)
 
 	if time.Since(pw.LastUpdate) > 100*time.Millisecond || pw.Downloaded == pw.Total {
 		pw.LastUpdate = time.Now()
-		percentage := (pw.Downloaded / pw.Total) * 100
-		pw.App.QueueUpdateDraw(func() {
-			pw.OutputView.Clear()
-			pw.OutputView.SetText(fmt.Sprintf("Downloading: %.2f%%", percentage))
-		})
+		pw.Reporter.DownloadProgress(pw.Downloaded, pw.Total)
 	}
 	return n, nil
 }
@@ -59,218 +53,297 @@ func LoadImages(path string) ([]types.Image, error) {
 		return nil, fmt.Errorf("error reading images file: %w", err)
 	}
 	var images []types.Image
-	if err := json.Unmarshal(file, &images); err != nil {
-		return nil, fmt.Errorf("error parsing images JSON: %w", err)
+	if err := decodeJSON(file, &images); err != nil {
+		return nil, fmt.Errorf("error parsing images JSON %s: %w", path, err)
 	}
 	return images, nil
 }
 
-// LoadSteps loads step configurations from a JSON file.
-func LoadSteps(path string) ([]types.Step, error) {
-	file, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("error reading steps file: %w", err)
-	}
-	var steps []types.Step
-	if err := json.Unmarshal(file, &steps); err != nil {
-		return nil, fmt.Errorf("error parsing steps JSON: %w", err)
-	}
-	return steps, nil
+// Download is a verified image in the cache.
+type Download struct {
+	// Path is the location of the image.
+	Path string
+	// URL is the source the image was downloaded from or verified against.
+	URL string
+	// Checksum identifies the image, e.g. "sha256:5a1b...". It is the
+	// verified checksum, or the SHA-256 of images without one. It is empty
+	// in dry-run mode if the image would be downloaded.
+	Checksum string
+}
+
+// Upstream is the checksum of a source as looked up, and verified, by
+// UpstreamChecksum.
+type Upstream struct {
+	URL string
+	// Checksum is e.g. "sha256:5a1b...", or empty if none was found.
+	Checksum string
 }
 
 // HandleDownloadAndChecksum handles the download and checksum verification of an image.
-func HandleDownloadAndChecksum(app *tview.Application, stepView, commandView, outputView *tview.TextView, step *types.UISTep, img types.Image, isoFilePath string, updateNodeStatus func(*tview.TreeNode, string), appendOutput func(string)) (string, error) {
-	updateNodeStatus(step.Node, "running")
-	app.QueueUpdateDraw(func() {
-		stepView.Clear()
-		commandView.Clear()
-		outputView.Clear()
-		stepView.SetText(fmt.Sprintf("Step: %s\n[yellow]Verifying local file and checksum...", step.Name))
-		commandView.SetText("No command")
-	})
-
-	filePath := filepath.Join(isoFilePath, img.Name)
-
-	if _, err := os.Stat(filePath); err == nil {
-		if img.ChecksumURL == "" {
-			appendOutput("☑️ File exists, no checksum URL provided. Skipping check and download.\n")
-			return filePath, nil
+// Images are kept in a cache in the ISO directory, keyed by checksum, so an
+// image whose expected checksum is already cached is not downloaded again,
+// even if it was downloaded for another image.
+// The image's sources are tried in order, falling back to the next mirror
+// when a download fails or does not match its checksum. Failed downloads and
+// checksum fetches are retried according to retry before moving on. If the
+// image has a GPG configuration, a checksum file is only trusted once its
+// signature has been verified. The caller starts the step; images with a
+// resolver must have been resolved with ResolveLatest. The checksum file of
+// each source is fetched once, and not at all for the source of upstream.
+// A cached file is verified, and removed if it is corrupt, holding its
+// CacheLock in locks. In dry-run mode the cache is verified but never
+// modified.
+func HandleDownloadAndChecksum(rep report.Scope, step int, img types.Image, paths types.Paths, upstream Upstream, retry Retry, locks *Locks, dryRun bool) (Download, error) {
+	appendOutput := rep.Output
+	appendOutput("Looking up the image in the cache...\n")
+
+	onRetry := reportRetry(rep, step, retry.Attempts, LogError)
+	// known holds the checksums fetched so far by source URL.
+	known := make(map[string]string)
+	if upstream.Checksum != "" {
+		known[upstream.URL] = upstream.Checksum
+		if img.Checksum == "" && img.GPG != nil {
+			appendOutput(fmt.Sprintf("🔏 Signature of the checksum of %s verified with %s.\n", upstream.URL, img.GPG.Keyring))
 		}
-
-		appendOutput("🔎 Verifying checksum...\n")
-		filenameFromURL := filepath.Base(img.URL)
-		expectedChecksum, algo, err := GetExpectedChecksum(img.ChecksumURL, filenameFromURL)
-		if err != nil {
-			appendOutput(fmt.Sprintf("⚠️ Could not get checksum: %v. Re-downloading...\n", err))
-			os.Remove(filePath)
-		} else {
-			localChecksum, err := CalculateFileChecksum(filePath, algo)
+	}
+	getChecksum := func(src Source) (digest, algo string, err error) {
+		if img.Checksum != "" {
+			algo, digest, err = checksum.Parse(img.Checksum)
+			return digest, algo, err
+		}
+		sum, ok := known[src.URL]
+		if !ok {
+			err = retry.Do(func() error {
+				digest, algo, err = GetVerifiedChecksum(src, img.GPG, paths.KeyringDir, filepath.Base(src.URL))
+				return err
+			}, onRetry)
 			if err != nil {
-				appendOutput(fmt.Sprintf("⚠️ Could not calculate local checksum: %v. Re-downloading...\n", err))
-				os.Remove(filePath)
-			} else if localChecksum == expectedChecksum {
-				appendOutput(fmt.Sprintf("✅ Checksum match (%s). Skipping download.\n", algo))
-				return filePath, nil
-			} else {
-				appendOutput(fmt.Sprintf("❌ Checksum mismatch (%s). Re-downloading...\n", algo))
-				os.Remove(filePath)
+				return "", "", err
 			}
+			if img.GPG != nil {
+				appendOutput(fmt.Sprintf("🔏 Signature of %s verified with %s.\n", src.ChecksumURL, img.GPG.Keyring))
+			}
+			sum = checksum.Format(algo, digest)
+			known[src.URL] = sum
 		}
+		algo, digest, err = checksum.Parse(sum)
+		return digest, algo, err
 	}
-
-	if err := DownloadFile(app, stepView, commandView, outputView, filePath, img.URL); err != nil {
-		return "", fmt.Errorf("download failed: %w", err)
+	hasChecksum := func(src Source) bool {
+		return img.Checksum != "" || src.ChecksumURL != ""
 	}
-
-	return filePath, nil
-}
-
-// GetExpectedChecksum fetches the expected checksum for a given image from its checksum URL.
-func GetExpectedChecksum(url string, filename string) (string, string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", "", err
+	if img.Checksum != "" {
+		appendOutput(fmt.Sprintf("📌 Using pinned checksum %s\n", img.Checksum))
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", err
+	sources := ImageSources(img)
+	if img.ProbeMirrors && len(sources) > 1 {
+		appendOutput("Probing mirrors...\n")
+		sources = ProbeSources(sources)
+		appendOutput(fmt.Sprintf("Fastest mirror: %s\n", sources[0].URL))
 	}
 
-	var checksum string
-	bodyString := string(body)
-	lines := strings.Split(bodyString, "\n")
-
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		if len(fields) >= 2 {
-			checksumFilename := strings.TrimPrefix(fields[1], "*")
-			if checksumFilename == filename {
-				checksum = fields[0]
-				break
+	cache := Cache{Dir: paths.ISODir}
+	use := func(path string, src Source, sum string) (Download, error) {
+		if !dryRun {
+			if err := cache.Use(img.Name, sum, src.URL); err != nil {
+				return Download{}, err
 			}
 		}
+		return Download{Path: path, URL: src.URL, Checksum: sum}, nil
 	}
 
-	if checksum == "" {
-		for i, line := range lines {
-			if strings.HasPrefix(line, "## ") && strings.TrimPrefix(line, "## ") == filename {
-				if i+1 < len(lines) {
-					nextLine := lines[i+1]
-					if strings.HasPrefix(nextLine, "SHA256: ") {
-						checksum = strings.TrimSpace(strings.TrimPrefix(nextLine, "SHA256: "))
-						break
+	if hasChecksum(sources[0]) {
+		// Any mirror will do to look the image up.
+		verified := sources[0]
+		expectedChecksum, algo, err := getChecksum(verified)
+		for _, src := range sources[1:] {
+			if err == nil || !hasChecksum(src) {
+				break
+			}
+			verified = src
+			expectedChecksum, algo, err = getChecksum(src)
+		}
+		if err != nil {
+			appendOutput(fmt.Sprintf("⚠️ Could not get checksum: %v. Downloading...\n", err))
+		} else {
+			sum := checksum.Format(algo, expectedChecksum)
+			path, cached := cache.Lookup(sum)
+			if !cached {
+				// Adopt the file of a release that stored images by name.
+				if path, cached = adoptLegacyFile(appendOutput, cache, img, algo, expectedChecksum, dryRun); cached {
+					return use(path, verified, sum)
+				}
+			}
+			if cached {
+				// Other images may be verifying or copying the same file.
+				unlock := locks.Lock(CacheLock(sum))
+				appendOutput("🔎 Verifying cached image...\n")
+				localChecksum, err := CalculateFileChecksum(path, algo)
+				switch {
+				case err != nil:
+					appendOutput(fmt.Sprintf("⚠️ Could not calculate local checksum: %v. Re-downloading...\n", err))
+				case localChecksum == expectedChecksum:
+					unlock()
+					appendOutput(fmt.Sprintf("✅ Checksum match (%s). Using cached %s.\n", algo, path))
+					return use(path, verified, sum)
+				default:
+					appendOutput(fmt.Sprintf("❌ Checksum mismatch (%s). Re-downloading...\n", algo))
+					if !dryRun {
+						cache.Remove(sum)
 					}
 				}
+				unlock()
 			}
 		}
+	} else if entry, ok := cache.Latest(img.Name); ok && entry.URL == sources[0].URL {
+		path, _ := cache.Lookup(entry.Checksum)
+		appendOutput("☑️ Image is cached, no checksum URL provided. Skipping check and download.\n")
+		return use(path, sources[0], entry.Checksum)
 	}
 
-	if checksum == "" {
-		for _, line := range lines {
-			if strings.Contains(line, "("+filename+")") {
-				parts := strings.Split(line, "= ")
-				if len(parts) == 2 {
-					checksum = strings.TrimSpace(parts[1])
-					break
-				}
-			}
+	partPath := filepath.Join(paths.ISODir, img.Name+PartSuffix)
+	if dryRun {
+		if offset := PartialSize(partPath, sources[0].URL); offset > 0 {
+			appendOutput(fmt.Sprintf("Would resume download of %s to %s at %d bytes\n", sources[0].URL, partPath, offset))
+		} else {
+			appendOutput(fmt.Sprintf("Would download %s to %s\n", sources[0].URL, partPath))
 		}
+		for _, src := range sources[1:] {
+			appendOutput(fmt.Sprintf("Would fall back to %s\n", src.URL))
+		}
+		return Download{URL: sources[0].URL}, nil
 	}
 
-	if checksum == "" && len(strings.Fields(bodyString)) == 1 {
-		checksum = strings.Fields(bodyString)[0]
+	// The image only enters the cache once it is known to be good.
+	fetch := func(src Source) (string, error) {
+		download := func() error { return DownloadFile(rep, partPath, src.URL) }
+		if err := retry.Do(download, onRetry); err != nil {
+			return "", fmt.Errorf("download failed: %w", err)
+		}
+		if !hasChecksum(src) {
+			digest, err := CalculateFileChecksum(partPath, checksum.SHA256)
+			if err != nil {
+				return "", fmt.Errorf("could not calculate checksum: %w", err)
+			}
+			return checksum.Format(checksum.SHA256, digest), nil
+		}
+		appendOutput("🔎 Verifying downloaded file...\n")
+		expectedChecksum, algo, err := getChecksum(src)
+		if err != nil {
+			return "", fmt.Errorf("could not get checksum: %w", err)
+		}
+		localChecksum, err := CalculateFileChecksum(partPath, algo)
+		if err != nil {
+			return "", fmt.Errorf("could not calculate checksum: %w", err)
+		}
+		if localChecksum != expectedChecksum {
+			RemovePartial(partPath)
+			if img.Checksum != "" {
+				return "", fmt.Errorf("checksum mismatch (%s): downloaded file does not match the pinned checksum", algo)
+			}
+			return "", fmt.Errorf("checksum mismatch (%s) for downloaded file", algo)
+		}
+		appendOutput(fmt.Sprintf("✅ Checksum match (%s).\n", algo))
+		return checksum.Format(algo, localChecksum), nil
 	}
 
-	if checksum == "" {
-		return "", "", fmt.Errorf("for %s not found in checksum file", filename)
+	var errs []error
+	for i, src := range sources {
+		if i > 0 {
+			appendOutput(fmt.Sprintf("⚠️ Trying next mirror: %s\n", src.URL))
+		}
+		sum, err := fetch(src)
+		if err == nil {
+			path, err := cache.Store(partPath, sum)
+			if err != nil {
+				return Download{}, fmt.Errorf("storing downloaded file in the cache failed: %w", err)
+			}
+			RemovePartial(partPath)
+			return use(path, src, sum)
+		}
+		if len(sources) > 1 {
+			appendOutput(fmt.Sprintf("❌ %s: %v\n", src.URL, err))
+			LogError(img.Name, fmt.Errorf("mirror %s failed: %w", src.URL, err))
+		}
+		errs = append(errs, err)
 	}
-
-	var algo string
-	switch len(checksum) {
-	case 128:
-		algo = "sha512"
-	case 64:
-		algo = "sha256"
-	case 40:
-		algo = "sha1"
-	case 32:
-		algo = "md5"
-	default:
-		return "", "", fmt.Errorf("unsupported checksum length: %d", len(checksum))
+	if len(errs) == 1 {
+		return Download{}, errs[0]
 	}
-
-	return checksum, algo, nil
+	return Download{}, fmt.Errorf("all %d mirrors failed: %w", len(errs), errors.Join(errs...))
 }
 
-// CalculateFileChecksum calculates the checksum of a file using the specified algorithm.
-func CalculateFileChecksum(filePath string, algorithm string) (string, error) {
-	var h hash.Hash
-	switch strings.ToLower(algorithm) {
-	case "sha512":
-		h = sha512.New()
-	case "sha256":
-		h = sha256.New()
-	case "sha1":
-		h = sha1.New()
-	case "md5":
-		h = md5.New()
-	default:
-		return "", fmt.Errorf("unsupported algorithm: %s", algorithm)
+// adoptLegacyFile moves the image stored by name in the ISO directory into
+// the cache if it matches the expected checksum, and removes it otherwise.
+// In dry-run mode the file is only verified.
+func adoptLegacyFile(appendOutput func(string), cache Cache, img types.Image, algo, expectedChecksum string, dryRun bool) (string, bool) {
+	legacy := filepath.Join(cache.Dir, img.Name)
+	if info, err := os.Stat(legacy); err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	appendOutput(fmt.Sprintf("🔎 Verifying %s...\n", legacy))
+	localChecksum, err := CalculateFileChecksum(legacy, algo)
+	if err != nil || localChecksum != expectedChecksum {
+		if !dryRun {
+			os.Remove(legacy)
+		}
+		return "", false
 	}
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+	if dryRun {
+		appendOutput(fmt.Sprintf("✅ Checksum match (%s). Would move %s into the cache.\n", algo, legacy))
+		return legacy, true
 	}
-	defer file.Close()
-
-	if _, err := io.Copy(h, file); err != nil {
-		return "", err
+	path, err := cache.Store(legacy, checksum.Format(algo, expectedChecksum))
+	if err != nil {
+		return "", false
 	}
-	return hex.EncodeToString(h.Sum(nil)), nil
+	appendOutput(fmt.Sprintf("✅ Checksum match (%s). Moved %s into the cache.\n", algo, legacy))
+	return path, true
 }
 
-// DownloadFile downloads a file from the given URL to the specified path.
-func DownloadFile(app *tview.Application, stepView, commandView, outputView *tview.TextView, filePath string, url string) error {
-	app.QueueUpdateDraw(func() {
-		stepView.SetText(fmt.Sprintf("Downloading %s", url))
-		commandView.SetText("No command")
-	})
-
-	file, err := os.Create(filePath)
+// GetExpectedChecksum fetches the expected checksum for a given image from its checksum URL.
+func GetExpectedChecksum(url string, filename string) (string, string, error) {
+	body, err := FetchURL(url)
 	if err != nil {
-		return fmt.Errorf("create file failed: %w", err)
+		return "", "", err
 	}
-	defer file.Close()
+	algo, digest, err := checksum.Lookup(body, filename, url)
+	return digest, algo, err
+}
 
-	resp, err := http.Get(url)
+// FetchURL returns the body of a small remote file, such as a checksum
+// file or a signature.
+func FetchURL(url string) ([]byte, error) {
+	resp, err := HTTPClient.Get(url)
 	if err != nil {
-		return fmt.Errorf("HTTP request failed: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		return nil, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
 	}
+	return io.ReadAll(resp.Body)
+}
 
-	totalSize := float64(resp.ContentLength)
-	
-	progressWriter := &ProgressWriter{
-		Total:      totalSize,
-		App:        app,
-		OutputView: outputView,
+// CalculateFileChecksum calculates the checksum of a file using the specified algorithm.
+func CalculateFileChecksum(filePath string, algorithm string) (string, error) {
+	h, err := checksum.New(algorithm)
+	if err != nil {
+		return "", err
 	}
 
-	writer := io.MultiWriter(file, progressWriter)
-
-	_, err = io.Copy(writer, resp.Body)
+	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("response body read failed: %w", err)
+		return "", err
 	}
+	defer file.Close()
 
-	return nil
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // CopyFile copies a file from source to destination.
@@ -292,71 +365,121 @@ func CopyFile(src, dst string) error {
 }
 
 // ExecuteCommands executes a series of commands for a given image.
-func ExecuteCommands(app *tview.Application, stepView, commandView, outputView *tview.TextView, steps []*types.UISTep, filePath string, img types.Image, stepData []types.Step, updateNodeStatus func(*tview.TreeNode, string), appendOutput func(string), logError func(string, error)) error {
-	cloudinitFilePath := filepath.Join("/var/lib/vz/snippets/", img.Vendor)
-	configFilePath := filepath.Join("cloudinit", img.Vendor)
-	if err := CopyFile(configFilePath, cloudinitFilePath); err != nil {
-		return fmt.Errorf("copying cloudinit config failed: %w", err)
+// Commands are rendered against data and the steps are reported starting at
+// index firstStep. The VM operations of steps are performed by backend.
+// Steps naming a lock hold it in locks while they run. In dry-run mode each
+// command is rendered and reported but nothing is executed.
+func ExecuteCommands(rep report.Scope, firstStep int, paths types.Paths, data TemplateData, stepData []types.Step, backend pve.Backend, locks *Locks, dryRun bool, logError func(string, error)) error {
+	img := data.Image
+	filePath := data.FilePath
+	cloudinitFilePath := filepath.Join(paths.SnippetsDir, img.Vendor)
+	configFilePath := filepath.Join(paths.CloudInitDir, img.Vendor)
+	if dryRun {
+		if _, err := os.Stat(configFilePath); err != nil {
+			return fmt.Errorf("cloudinit config not found: %w", err)
+		}
+		rep.Output(fmt.Sprintf("Would copy %s to %s\n", configFilePath, cloudinitFilePath))
+	} else {
+		// Images sharing a vendor file must not write the snippet at the same time.
+		unlock := locks.Lock("snippet:" + img.Vendor)
+		err := CopyFile(configFilePath, cloudinitFilePath)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("copying cloudinit config failed: %w", err)
+		}
 	}
 
-	replacer := strings.NewReplacer(
-		"{{.ID}}", fmt.Sprintf("%d", img.ID),
-		"{{.Name}}", img.Name,
-		"{{.Tags}}", img.Tags,
-		"{{.Vendor}}", img.Vendor,
-		"{{.FilePath}}", filePath,
-	)
+	// Commands are displayed and logged as rendered against data, with
+	// secrets redacted, and run as rendered against their values.
+	secrets := data
+	var secretsErr error
+	if !dryRun {
+		secrets, secretsErr = data.Reveal()
+	}
 
 	var hasFailed bool
 	for i, step := range stepData {
-		uiStep := steps[i]
+		stepIndex := firstStep + i
 		if hasFailed {
-			updateNodeStatus(uiStep.Node, "skipped")
+			rep.StepFinished(stepIndex, report.StatusSkipped, nil)
 			continue
 		}
 
-		updateNodeStatus(uiStep.Node, "running")
-		commandString := replacer.Replace(step.Command)
-		cmd := exec.Command("bash", "-c", commandString)
+		var op pve.Operation
+		var commandString, command string
+		var err error
+		if step.VM != nil {
+			if op, err = RenderOperation(step, data); err == nil {
+				commandString = op.String()
+				if err = secretsErr; err == nil {
+					op, err = RenderOperation(step, secrets)
+				}
+			}
+		} else if commandString, err = RenderCommand(step, data); err == nil {
+			if err = secretsErr; err == nil {
+				command, err = RenderCommand(step, secrets)
+			}
+		}
+		if err != nil {
+			rep.StepStarted(stepIndex, step.Command)
+			rep.StepFinished(stepIndex, report.StatusFailed, err)
+			hasFailed = true
+			logError(img.Name, fmt.Errorf("step '%s' failed to render: %w", step.Name, err))
+			continue
+		}
+		if dryRun {
+			rep.StepStarted(stepIndex, commandString)
+			rep.StepFinished(stepIndex, report.StatusSkipped, nil)
+			continue
+		}
+		retry, err := NewRetry(StepRetryPolicy(data.Settings, step))
+		if err != nil {
+			rep.StepStarted(stepIndex, commandString)
+			rep.StepFinished(stepIndex, report.StatusFailed, err)
+			hasFailed = true
+			logError(img.Name, fmt.Errorf("step '%s' has an invalid retry policy: %w", step.Name, err))
+			continue
+		}
 
-		if err := RunCommandWithStreaming(app, stepView, commandView, outputView, cmd, step.Name, appendOutput, logError); err != nil {
-			updateNodeStatus(uiStep.Node, "failed")
+		// The lock is released between attempts so that a retrying step
+		// does not hold up the other images.
+		err = retry.Do(func() error {
+			unlock := locks.Lock(step.Lock)
+			defer unlock()
+			rep.StepStarted(stepIndex, commandString)
+			if step.VM != nil {
+				return pve.Run(context.Background(), backend, op)
+			}
+			cmd := exec.Command("bash", "-c", command)
+			return RunCommandWithStreaming(rep, cmd, logError)
+		}, reportRetry(rep, stepIndex, retry.Attempts, logError))
+		if err != nil {
+			rep.StepFinished(stepIndex, report.StatusFailed, err)
 			hasFailed = true
 			logError(img.Name, fmt.Errorf("step '%s' failed: %w. Command: %s", step.Name, err, commandString))
 		} else {
-			updateNodeStatus(uiStep.Node, "success")
+			rep.StepFinished(stepIndex, report.StatusSuccess, nil)
 			time.Sleep(1 * time.Second)
 		}
 	}
 
-	if err := os.Remove(filePath); err != nil {
-		logError(img.Name, fmt.Errorf("failed to remove base.qcow2 file: %w", err))
+	if !dryRun {
+		if err := os.Remove(filePath); err != nil {
+			logError(img.Name, fmt.Errorf("failed to remove %s: %w", filePath, err))
+		}
 	}
 
+	// A step failing to render fails a dry run too.
 	if hasFailed {
 		return fmt.Errorf("one or more steps failed for %s", img.Name)
 	}
 	return nil
 }
 
-// RunCommandWithStreaming executes a shell command and streams its output to the UI.
-func RunCommandWithStreaming(app *tview.Application, stepView, commandView, outputView *tview.TextView, cmd *exec.Cmd, name string, appendOutput func(string), logError func(string, error)) error {
-	var displayCmd string
-	if len(cmd.Args) > 2 && cmd.Args[0] == "bash" && cmd.Args[1] == "-c" {
-		displayCmd = cmd.Args[2]
-	} else {
-		displayCmd = strings.Join(cmd.Args, " ")
-	}
-
-	app.QueueUpdateDraw(func() {
-		stepView.Clear()
-		commandView.Clear()
-		outputView.Clear()
-		stepView.SetText(name)
-		writer := tview.ANSIWriter(commandView)
-		fmt.Fprint(writer, style.Yellow(displayCmd))
-	})
-
+// RunCommandWithStreaming executes a shell command and streams its output
+// to the reporter. The step running it must already be started, with the
+// command as it may be displayed.
+func RunCommandWithStreaming(rep report.Scope, cmd *exec.Cmd, logError func(string, error)) error {
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stdout pipe: %w", err)
@@ -375,7 +498,7 @@ func RunCommandWithStreaming(app *tview.Application, stepView, commandView, outp
 	go func() {
 		scanner := bufio.NewScanner(stdoutPipe)
 		for scanner.Scan() {
-			appendOutput(scanner.Text() + "\n")
+			rep.Output(scanner.Text() + "\n")
 		}
 		if scanner.Err() != nil {
 			logError("command_stdout_stream", fmt.Errorf("error reading stdout: %w", scanner.Err()))
@@ -386,7 +509,7 @@ func RunCommandWithStreaming(app *tview.Application, stepView, commandView, outp
 	go func() {
 		scanner := bufio.NewScanner(stderrPipe)
 		for scanner.Scan() {
-			appendOutput(scanner.Text() + "\n")
+			rep.Output(scanner.Text() + "\n")
 		}
 		if scanner.Err() != nil {
 			logError("command_stderr_stream", fmt.Errorf("error reading stderr: %w", scanner.Err()))
@@ -404,9 +527,13 @@ func RunCommandWithStreaming(app *tview.Application, stepView, commandView, outp
 	return nil
 }
 
-// LogError logs an error to a file specific to the image name.
+// LogError logs an error to a file specific to the image name. Nothing is
+// written when LogDir is empty.
 func LogError(imageName string, err error) {
-	logFilePath := filepath.Join("logs", fmt.Sprintf("%s.error.log", imageName))
+	if LogDir == "" {
+		return
+	}
+	logFilePath := filepath.Join(LogDir, fmt.Sprintf("%s.error.log", imageName))
 	f, _ := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if f != nil {
 		defer f.Close()
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/report"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// optionsBackend records the options set on VMs; its other methods are not
+// implemented.
+type optionsBackend struct {
+	pve.Backend
+	options []pve.Options
+}
+
+func (b *optionsBackend) SetOptions(ctx context.Context, vmid int, options pve.Options) error {
+	b.options = append(b.options, options)
+	return nil
+}
+
+func TestExecuteCommandsSecrets(t *testing.T) {
+	const password = "s3cr3t pa$$"
+	dir := t.TempDir()
+	paths := types.Paths{CloudInitDir: dir, SnippetsDir: t.TempDir()}
+	if err := os.WriteFile(filepath.Join(dir, "vendor.yaml"), []byte("#cloud-config\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	settings := types.Settings{Secrets: map[string]types.Secret{"cipassword": {Env: "PVE_CTGEN_TEST_PASSWORD"}}}
+	out := filepath.Join(dir, "out")
+	steps := []types.Step{
+		{Name: "Set credentials", VM: &types.VMOperation{Op: types.OpSet, Options: map[string]string{"cipassword": "{{.Vars.cipassword}}"}}},
+		{Name: "Use the password", Command: fmt.Sprintf("echo {{quote .Vars.cipassword}} > %s; exit 1", out)},
+	}
+	run := func(dryRun bool) (*optionsBackend, string, error) {
+		data, err := NewTemplateData(types.Image{ID: 100, Name: "a", Vendor: "vendor.yaml"}, filepath.Join(dir, "a.qcow2"), settings, paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := &report.Recorder{}
+		backend := &optionsBackend{}
+		var logged strings.Builder
+		err = ExecuteCommands(report.Scope{Reporter: rec}, 0, paths, data, steps, backend, NewLocks(), dryRun, func(name string, err error) {
+			fmt.Fprintln(&logged, err)
+		})
+		events, _ := json.Marshal(rec.Events())
+		return backend, string(events) + logged.String(), err
+	}
+
+	// Dry runs do not need the secrets.
+	if _, shown, err := run(true); err != nil {
+		t.Fatalf("dry run: %v", err)
+	} else if !strings.Contains(shown, "echo '********'") {
+		t.Errorf("dry run did not show the redacted command:\n%s", shown)
+	}
+
+	if _, shown, err := run(false); err == nil || !strings.Contains(shown, "secret cipassword: PVE_CTGEN_TEST_PASSWORD is not set") {
+		t.Errorf("ExecuteCommands error = %v, want the missing secret reported:\n%s", err, shown)
+	}
+
+	t.Setenv("PVE_CTGEN_TEST_PASSWORD", password)
+	backend, shown, err := run(false)
+	if err == nil {
+		t.Fatal("ExecuteCommands succeeded, want the failing step reported")
+	}
+	if strings.Contains(shown, "s3cr3t") {
+		t.Errorf("the password was displayed or logged:\n%s", shown)
+	}
+	for _, want := range []string{"qm set 100 --cipassword ********", "Command: echo '********' > "} {
+		if !strings.Contains(shown, want) {
+			t.Errorf("%q not displayed:\n%s", want, shown)
+		}
+	}
+	if len(backend.options) != 1 || backend.options[0]["cipassword"] != password {
+		t.Errorf("options set = %v, want the password", backend.options)
+	}
+	if got, err := os.ReadFile(out); err != nil || string(got) != password+"\n" {
+		t.Errorf("command wrote %q, %v, want the password", got, err)
+	}
+}
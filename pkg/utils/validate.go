@@ -0,0 +1,592 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aloks98/pve-ctgen/pkg/checksum"
+	"github.com/aloks98/pve-ctgen/pkg/pve"
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+// ValidationError describes a problem with a single field of a
+// configuration file.
+type ValidationError struct {
+	// File is the configuration file containing the problem.
+	File string
+	// Field locates the value within the file, e.g. "[3].vendor".
+	Field string
+	// Subject names the image or step the field belongs to, if known.
+	Subject string
+	// Message describes the problem.
+	Message string
+}
+
+// Error implements the error interface.
+func (e ValidationError) Error() string {
+	location := e.File
+	if e.Field != "" {
+		location += ": " + e.Field
+	}
+	if e.Subject != "" {
+		location += fmt.Sprintf(" (%s)", e.Subject)
+	}
+	return location + ": " + e.Message
+}
+
+// ValidationErrors is the list of problems found by ValidateConfig.
+type ValidationErrors []ValidationError
+
+// Error implements the error interface.
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return fmt.Sprintf("invalid configuration:\n%s", strings.Join(lines, "\n"))
+}
+
+// tagPattern matches a valid Proxmox VE tag.
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_\-+.]*$`)
+
+// ValidateConfig checks the images and steps for problems that JSON parsing
+// cannot detect, such as duplicate VM IDs, missing cloud-init files, step
+// templates that fail to render or invalid URLs. It returns nil if the
+// configuration is valid.
+func ValidateConfig(paths types.Paths, settings types.Settings, images []types.Image, pipelines types.Pipelines) error {
+	var errs ValidationErrors
+	imageErr := func(i int, img types.Image, field, format string, args ...any) {
+		errs = append(errs, ValidationError{
+			File:    paths.ImagesFile,
+			Field:   fmt.Sprintf("[%d].%s", i, field),
+			Subject: img.Name,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	stepErr := func(pipeline string, i int, step types.Step, field, format string, args ...any) {
+		errs = append(errs, ValidationError{
+			File:    paths.StepsFile,
+			Field:   fmt.Sprintf("%s[%d].%s", pipeline, i, field),
+			Subject: step.Name,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(images) == 0 {
+		errs = append(errs, ValidationError{File: paths.ImagesFile, Message: "no images defined"})
+	}
+	ids := make(map[int]int)
+	names := make(map[string]int)
+	usesGPG := false
+	for i, img := range images {
+		switch {
+		case img.ID < 100 || img.ID > 999999999:
+			imageErr(i, img, "id", "VM ID %d is outside the range 100-999999999", img.ID)
+		default:
+			if j, ok := ids[img.ID]; ok {
+				imageErr(i, img, "id", "duplicate VM ID %d, also used by [%d] (%s)", img.ID, j, images[j].Name)
+			} else {
+				ids[img.ID] = i
+			}
+		}
+
+		switch {
+		case img.Name == "":
+			imageErr(i, img, "name", "name is required")
+		case strings.ContainsAny(img.Name, `/\`) || img.Name == "." || img.Name == "..":
+			imageErr(i, img, "name", "name %q must not contain path separators", img.Name)
+		default:
+			if j, ok := names[img.Name]; ok {
+				imageErr(i, img, "name", "duplicate name, also used by [%d]", j)
+			} else {
+				names[img.Name] = i
+			}
+		}
+
+		if img.Resolver != nil {
+			if img.URL != "" || len(img.Mirrors) > 0 || img.ChecksumURL != "" || img.Checksum != "" {
+				imageErr(i, img, "resolver", "resolver cannot be combined with url, mirrors, checksum_url or checksum")
+			}
+			checkResolver(img.Resolver, func(field, format string, args ...any) {
+				imageErr(i, img, field, format, args...)
+			})
+		} else if img.URL == "" && len(img.Mirrors) == 0 {
+			imageErr(i, img, "url", "url, mirrors or resolver is required")
+		} else if img.URL != "" {
+			if err := checkURL(img.URL); err != nil {
+				imageErr(i, img, "url", "%v", err)
+			}
+		}
+		for j, mirror := range img.Mirrors {
+			if err := checkURL(mirror); err != nil {
+				imageErr(i, img, fmt.Sprintf("mirrors[%d]", j), "%v", err)
+			}
+		}
+		switch {
+		case len(img.Mirrors) > 0 && strings.TrimSpace(img.Path) == "":
+			imageErr(i, img, "path", "path is required with mirrors")
+		case len(img.Mirrors) == 0 && img.Path != "":
+			imageErr(i, img, "path", "path is only used with mirrors")
+		case len(img.Mirrors) == 0 && img.ChecksumPath != "":
+			imageErr(i, img, "checksum_path", "checksum_path is only used with mirrors")
+		case img.URL != "" && img.Path != "" && filepath.Base(img.URL) != filepath.Base(img.Path):
+			imageErr(i, img, "path", "file name %q differs from the one in url", filepath.Base(img.Path))
+		}
+		if img.ChecksumURL != "" {
+			if err := checkURL(img.ChecksumURL); err != nil {
+				imageErr(i, img, "checksum_url", "%v", err)
+			}
+		}
+		if img.Checksum != "" {
+			if _, _, err := checksum.Parse(img.Checksum); err != nil {
+				imageErr(i, img, "checksum", "%v", err)
+			}
+		}
+
+		if field, err := checkPacking(img); err != nil {
+			imageErr(i, img, field, "%v", err)
+		}
+
+		if strings.TrimSpace(img.Tags) == "" {
+			imageErr(i, img, "tags", "at least one tag is required")
+		} else {
+			// Tags are trimmed like when images are selected by tag.
+			for j, tag := range strings.Split(img.Tags, ",") {
+				tag = strings.TrimSpace(tag)
+				switch {
+				case tag == "":
+					imageErr(i, img, "tags", "tag %d is empty", j+1)
+				case !tagPattern.MatchString(tag):
+					imageErr(i, img, "tags", "tag %q contains characters not allowed by Proxmox", tag)
+				}
+			}
+		}
+
+		if img.GPG != nil {
+			usesGPG = true
+			checkGPG(paths, img, func(field, format string, args ...any) {
+				imageErr(i, img, field, format, args...)
+			})
+		}
+
+		if hw, err := ResolveHardware(settings, img); err != nil {
+			imageErr(i, img, "profile", "%v", err)
+		} else if field, err := checkHardware(hw); err != nil {
+			imageErr(i, img, "hardware."+field, "%v", err)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(img.Vars)) {
+			if _, ok := settings.Secrets[name]; ok {
+				imageErr(i, img, "vars."+name, "%s is a secret and cannot be overridden", name)
+			}
+		}
+
+		if img.Vendor == "" {
+			imageErr(i, img, "vendor", "vendor is required")
+		} else if strings.ContainsAny(img.Vendor, `/\`) {
+			imageErr(i, img, "vendor", "vendor %q must be a file name inside %s", img.Vendor, paths.CloudInitDir)
+		} else if info, err := os.Stat(filepath.Join(paths.CloudInitDir, img.Vendor)); err != nil {
+			imageErr(i, img, "vendor", "cloud-init file %s not found", filepath.Join(paths.CloudInitDir, img.Vendor))
+		} else if info.IsDir() {
+			imageErr(i, img, "vendor", "cloud-init file %s is a directory", filepath.Join(paths.CloudInitDir, img.Vendor))
+		}
+	}
+
+	if usesGPG {
+		if _, err := exec.LookPath(GPGVerifier); err != nil {
+			errs = append(errs, ValidationError{File: paths.ImagesFile, Field: "gpg", Message: fmt.Sprintf("%s is required to verify signatures: %v", GPGVerifier, err)})
+		}
+	}
+
+	if field, err := checkHardware(settings.Hardware); err != nil {
+		errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "hardware." + field, Message: err.Error()})
+	}
+	profileNames := make([]string, 0, len(settings.Profiles))
+	for name := range settings.Profiles {
+		profileNames = append(profileNames, name)
+	}
+	sort.Strings(profileNames)
+	for _, name := range profileNames {
+		profile := settings.Profiles[name]
+		if field, err := checkHardware(mergeHardware(settings.Hardware, profile)); err != nil {
+			errs = append(errs, ValidationError{File: paths.SettingsFile, Field: fmt.Sprintf("profiles.%s.%s", name, field), Message: err.Error()})
+		}
+	}
+
+	retries := []struct {
+		name   string
+		policy types.RetryPolicy
+	}{{"download", settings.Retry.Download}, {"steps", settings.Retry.Steps}}
+	for _, r := range retries {
+		if field, err := checkRetry(r.policy); err != nil {
+			errs = append(errs, ValidationError{File: paths.SettingsFile, Field: fmt.Sprintf("retry.%s.%s", r.name, field), Message: err.Error()})
+		}
+	}
+
+	if field, err := checkHTTP(settings.HTTP); err != nil {
+		errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "http." + field, Message: err.Error()})
+	}
+	if field, err := checkCache(settings.Cache); err != nil {
+		errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "cache." + field, Message: err.Error()})
+	}
+	if field, err := checkBackend(settings.Backend); err != nil {
+		errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "backend." + field, Message: err.Error()})
+	}
+	secretNames := make([]string, 0, len(settings.Secrets))
+	for name := range settings.Secrets {
+		secretNames = append(secretNames, name)
+	}
+	sort.Strings(secretNames)
+	for _, name := range secretNames {
+		if _, ok := settings.Vars[name]; ok {
+			errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "secrets." + name, Message: "also defined in vars"})
+		}
+		if field, err := checkSecret(settings.Secrets[name]); err != nil {
+			if field != "" {
+				field = "." + field
+			}
+			errs = append(errs, ValidationError{File: paths.SettingsFile, Field: "secrets." + name + field, Message: err.Error()})
+		}
+	}
+
+	if len(pipelines) == 0 {
+		errs = append(errs, ValidationError{File: paths.StepsFile, Message: "no pipelines defined"})
+	}
+	for _, name := range PipelineNames(pipelines) {
+		steps := pipelines[name]
+		if len(steps) == 0 {
+			errs = append(errs, ValidationError{File: paths.StepsFile, Field: name, Message: "no steps defined"})
+		}
+		seen := make(map[string]int)
+		for i, step := range steps {
+			if j, ok := seen[step.Name]; ok && step.Name != "" {
+				stepErr(name, i, step, "name", "duplicate step name, also used by [%d]", j)
+			}
+			seen[step.Name] = i
+			if err := checkStep(step); err != nil {
+				stepErr(name, i, step, err.field, "%v", err.err)
+			} else if tool := nodeCommand(settings.Backend, step); tool != "" {
+				stepErr(name, i, step, "command", "%s runs on this host, not through the api backend; use a vm step", tool)
+			}
+		}
+	}
+
+	// Resolve and render the steps of every image so that unknown
+	// pipelines, bad overrides and missing fields or variables are found
+	// before anything runs. A failing pipeline step is reported once, for
+	// the first image it fails for.
+	reported := make(map[string]bool)
+	for i, img := range images {
+		steps, err := ResolveSteps(pipelines, img)
+		if err != nil {
+			field := "steps"
+			if _, ok := pipelines[img.Pipeline]; img.Pipeline != "" && !ok {
+				field = "pipeline"
+			}
+			imageErr(i, img, field, "%v", err)
+			continue
+		}
+		data, err := NewTemplateData(img, ScratchFile(paths, img), settings, paths)
+		if err != nil {
+			// Already reported for the image.
+			continue
+		}
+		pipeline := img.Pipeline
+		if pipeline == "" {
+			pipeline = DefaultPipeline
+		}
+		for _, step := range steps {
+			j := stepIndex(pipelines[pipeline], step.Name)
+			fromPipeline := j >= 0 && pipelines[pipeline][j] == step
+			if fromPipeline && reported[fmt.Sprintf("%s/%d", pipeline, j)] {
+				continue
+			}
+			if !fromPipeline {
+				if err := checkStep(step); err != nil {
+					imageErr(i, img, "steps", "step %q: %v", step.Name, err.err)
+					continue
+				}
+				if tool := nodeCommand(settings.Backend, step); tool != "" {
+					imageErr(i, img, "steps", "step %q: %s runs on this host, not through the api backend; use a vm step", step.Name, tool)
+					continue
+				}
+			}
+			if fromPipeline && checkStep(step) != nil {
+				// Already reported for the pipeline.
+				continue
+			}
+			if _, err := RenderStep(step, data); err != nil {
+				if fromPipeline {
+					field := "command"
+					if step.VM != nil {
+						field = "vm"
+					}
+					reported[fmt.Sprintf("%s/%d", pipeline, j)] = true
+					stepErr(pipeline, j, step, field, "rendering for image %s: %v", img.Name, err)
+				} else {
+					imageErr(i, img, "steps", "step %q: %v", step.Name, err)
+				}
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// fieldError is a problem with a named field of a step.
+type fieldError struct {
+	field string
+	err   error
+}
+
+// checkStep checks the fields of a single step and that its command or
+// VM operation parses.
+func checkStep(step types.Step) *fieldError {
+	if step.Name == "" {
+		return &fieldError{"name", fmt.Errorf("name is required")}
+	}
+	switch {
+	case step.VM != nil && strings.TrimSpace(step.Command) != "":
+		return &fieldError{"vm", fmt.Errorf("command and vm are mutually exclusive")}
+	case step.VM != nil:
+		if field, err := checkOperation(step.VM); err != nil {
+			return &fieldError{"vm." + field, err}
+		}
+		if field, err := parseOperation(step); err != nil {
+			return &fieldError{"vm." + field, err}
+		}
+	case strings.TrimSpace(step.Command) == "":
+		return &fieldError{"command", fmt.Errorf("command or vm is required")}
+	default:
+		if _, err := ParseCommand(step); err != nil {
+			return &fieldError{"command", err}
+		}
+	}
+	if step.Retry != nil {
+		if field, err := checkRetry(*step.Retry); err != nil {
+			return &fieldError{"retry." + field, err}
+		}
+	}
+	return nil
+}
+
+// nodeToolPattern matches an invocation of a Proxmox command-line tool in a
+// step command.
+var nodeToolPattern = regexp.MustCompile("(?:^|[\\s;&|(`])(qm|pvesm)(?:\\s|$)")
+
+// nodeCommand returns the Proxmox tool, e.g. "qm", that the command of a
+// step invokes when VM operations go through the API backend, or "" if it
+// invokes none. Such a command would act on the local host instead of the
+// configured node.
+func nodeCommand(cfg types.BackendSettings, step types.Step) string {
+	if cfg.Type != types.BackendAPI || step.VM != nil {
+		return ""
+	}
+	if m := nodeToolPattern.FindStringSubmatch(step.Command); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// operationUse lists the fields each VM operation requires and the ones it
+// may have.
+var operationUse = map[string]struct{ required, optional []string }{
+	types.OpDestroy:    {},
+	types.OpCreate:     {optional: []string{"options"}},
+	types.OpImportDisk: {required: []string{"disk"}, optional: []string{"options", "storage"}},
+	types.OpResize:     {required: []string{"disk", "size"}},
+	types.OpSet:        {required: []string{"options"}},
+	types.OpTemplate:   {},
+}
+
+// optionPattern matches the name of a VM or disk option, e.g. "net0".
+var optionPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// checkOperation reports the first invalid value of a VM operation, with
+// the JSON name of the offending field.
+func checkOperation(vm *types.VMOperation) (string, error) {
+	use, ok := operationUse[vm.Op]
+	if !ok {
+		return "op", fmt.Errorf("unknown operation %q, expected %s, %s, %s, %s, %s or %s", vm.Op,
+			types.OpDestroy, types.OpCreate, types.OpImportDisk, types.OpResize, types.OpSet, types.OpTemplate)
+	}
+	fields := []struct {
+		name string
+		set  bool
+	}{{"options", len(vm.Options) > 0}, {"disk", vm.Disk != ""}, {"size", vm.Size != ""}, {"storage", vm.Storage != ""}}
+	for _, f := range fields {
+		switch {
+		case slices.Contains(use.required, f.name) && !f.set:
+			return f.name, fmt.Errorf("%s is required by %s", f.name, vm.Op)
+		case f.set && !slices.Contains(use.required, f.name) && !slices.Contains(use.optional, f.name):
+			return f.name, fmt.Errorf("%s is not used by %s", f.name, vm.Op)
+		}
+	}
+	for _, k := range pve.Options(vm.Options).Keys() {
+		if !optionPattern.MatchString(k) {
+			return "options." + k, fmt.Errorf("invalid option name %q", k)
+		}
+	}
+	return "", nil
+}
+
+// checkGPG checks the signature verification settings of an image.
+func checkGPG(paths types.Paths, img types.Image, imageErr func(field, format string, args ...any)) {
+	g := img.GPG
+	switch {
+	case g.Keyring == "":
+		imageErr("gpg.keyring", "keyring is required")
+	case strings.ContainsAny(g.Keyring, `/\`):
+		imageErr("gpg.keyring", "keyring %q must be a file name inside %s", g.Keyring, paths.KeyringDir)
+	default:
+		if _, err := os.Stat(filepath.Join(paths.KeyringDir, g.Keyring)); err != nil {
+			imageErr("gpg.keyring", "keyring %s not found", filepath.Join(paths.KeyringDir, g.Keyring))
+		}
+	}
+	if r := img.Resolver; r != nil {
+		switch {
+		case r.Type == types.ResolverSimplestreams:
+			imageErr("gpg", "signature verification is not supported with a simplestreams resolver")
+		case r.ChecksumFile == "" && r.ChecksumPattern == "":
+			imageErr("gpg", "signature verification requires resolver.checksum_file or resolver.checksum_pattern")
+		case !g.Clearsigned:
+			imageErr("gpg.clearsigned", "images with a resolver only support clearsigned checksum files")
+		}
+	} else if img.ChecksumURL == "" && img.ChecksumPath == "" {
+		imageErr("gpg", "signature verification requires checksum_url or checksum_path")
+	}
+	switch {
+	case g.Clearsigned && (g.SignatureURL != "" || g.SignaturePath != ""):
+		imageErr("gpg.clearsigned", "a clearsigned checksum file has no detached signature")
+	case !g.Clearsigned && g.SignatureURL == "" && g.SignaturePath == "":
+		imageErr("gpg", "signature_url, signature_path or clearsigned is required")
+	case g.SignaturePath != "" && len(img.Mirrors) == 0:
+		imageErr("gpg.signature_path", "signature_path is only used with mirrors")
+	case !g.Clearsigned && g.SignatureURL == "" && img.URL != "":
+		imageErr("gpg.signature_url", "signature_url is required to verify the checksum file of url")
+	}
+	if g.SignatureURL != "" {
+		if err := checkURL(g.SignatureURL); err != nil {
+			imageErr("gpg.signature_url", "%v", err)
+		}
+	}
+}
+
+// checkResolver checks the settings of an image resolver.
+func checkResolver(r *types.Resolver, imageErr func(field, format string, args ...any)) {
+	if err := checkURL(r.URL); err != nil {
+		imageErr("resolver.url", "%v", err)
+	}
+	switch r.Type {
+	case types.ResolverSimplestreams:
+		if r.Product == "" {
+			imageErr("resolver.product", "product is required")
+		}
+		if r.Item == "" {
+			imageErr("resolver.item", "item is required")
+		}
+		if !strings.Contains(r.URL, "/streams/") {
+			imageErr("resolver.url", "simplestreams catalog URL must be below a streams/ directory")
+		}
+		if r.Pattern != "" || r.ChecksumFile != "" || r.ChecksumPattern != "" {
+			imageErr("resolver", "pattern, checksum_file and checksum_pattern are not used by simplestreams")
+		}
+	case types.ResolverIndex:
+		if r.Pattern == "" {
+			imageErr("resolver.pattern", "pattern is required")
+		}
+		if r.ChecksumFile != "" && r.ChecksumPattern != "" {
+			imageErr("resolver.checksum_pattern", "checksum_file and checksum_pattern are mutually exclusive")
+		}
+	case types.ResolverLatest:
+		if r.Pattern != "" || r.ChecksumPattern != "" {
+			imageErr("resolver", "pattern and checksum_pattern are only used by index")
+		}
+	case "":
+		imageErr("resolver.type", "type is required")
+	default:
+		imageErr("resolver.type", "unknown resolver type %q, expected %s, %s or %s", r.Type, types.ResolverSimplestreams, types.ResolverIndex, types.ResolverLatest)
+	}
+	if r.Type != types.ResolverSimplestreams && (r.Product != "" || r.Item != "") {
+		imageErr("resolver", "product and item are only used by simplestreams")
+	}
+	for _, p := range []struct{ field, value string }{{"pattern", r.Pattern}, {"checksum_pattern", r.ChecksumPattern}} {
+		if _, err := regexp.Compile(p.value); err != nil {
+			imageErr("resolver."+p.field, "invalid pattern: %v", err)
+		}
+	}
+	if strings.ContainsAny(r.ChecksumFile, `/\`) {
+		imageErr("resolver.checksum_file", "checksum_file %q must be a file name", r.ChecksumFile)
+	}
+}
+
+// checkURL reports whether raw is an absolute http or https URL.
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL %q must use http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("URL %q has no host", raw)
+	}
+	return nil
+}
+
+// decodeJSON strictly decodes data into v, rejecting unknown fields and
+// data after the JSON value, and reporting the line and column of syntax
+// and type errors.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil {
+		end := dec.InputOffset()
+		if _, err := dec.Token(); err != io.EOF {
+			rest := bytes.TrimLeft(data[end:], " \t\r\n")
+			line, col := position(data, int64(len(data)-len(rest)))
+			return fmt.Errorf("line %d, column %d: unexpected data after the JSON value", line, col)
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := position(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %w", line, col, err)
+	case errors.As(err, &typeErr):
+		line, col := position(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: field %s: expected %s, got %s", line, col, typeErr.Field, typeErr.Type, typeErr.Value)
+	}
+	return err
+}
+
+// position converts a byte offset into a 1-based line and column.
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aloks98/pve-ctgen/pkg/types"
+)
+
+func TestValidateConfigTags(t *testing.T) {
+	tests := []struct {
+		tags string
+		want []string
+	}{
+		{"debian,13", nil},
+		{"debian, 13 ,cloudinit", nil},
+		{" ", []string{"at least one tag is required"}},
+		{"debian,,13", []string{"tag 2 is empty"}},
+		{"debian, 13 x", []string{`tag "13 x" contains characters not allowed by Proxmox`}},
+	}
+	for _, tt := range tests {
+		img := types.Image{ID: 100, Name: "debian13", URL: "https://example.com/debian.qcow2", Tags: tt.tags}
+		err := ValidateConfig(types.Paths{ImagesFile: "os_list.json"}, types.Settings{}, []types.Image{img}, nil)
+		var errs ValidationErrors
+		errors.As(err, &errs)
+		var got []string
+		for _, e := range errs {
+			if e.Field == "[0].tags" {
+				got = append(got, e.Message)
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("tags %q: errors %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{`{"name": "a"}`, ""},
+		{"{\"name\": \"a\"}\n\n", ""},
+		{"{\"name\": \"a\"}\n{\"name\": \"b\"}\n", "line 2, column 1: unexpected data after the JSON value"},
+		{`{"name": "a"} x`, "line 1, column 15: unexpected data after the JSON value"},
+		{"{\n  \"nmae\": \"a\"\n}", `unknown field "nmae"`},
+		{"{\n  \"name\": \"a\",\n}", "invalid character '}' looking for beginning of object key string"},
+		{`{"id": "100"}`, "line 1, column 13: field id: expected int, got string"},
+	}
+	for _, tt := range tests {
+		var img types.Image
+		err := decodeJSON([]byte(tt.in), &img)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("decodeJSON(%q): %v", tt.in, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("decodeJSON(%q) error = %v, want %q", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateConfigSecrets(t *testing.T) {
+	settings := types.Settings{
+		Vars: map[string]string{"ciuser": "root", "token": "x"},
+		Secrets: map[string]types.Secret{
+			"cipassword": {Env: "PVE_CTGEN_CIPASSWORD"},
+			"sshkey":     {File: "/etc/pve-ctgen/sshkey"},
+			"token":      {Env: "TOKEN"},
+			"empty":      {},
+			"bad":        {Env: "PVE-CTGEN"},
+		},
+	}
+	img := types.Image{ID: 100, Name: "a", URL: "https://example.com/a.qcow2", Tags: "a", Vars: map[string]string{"ciuser": "a", "cipassword": "a"}}
+	err := ValidateConfig(types.Paths{ImagesFile: "os_list.json", SettingsFile: "settings.json"}, settings, []types.Image{img}, nil)
+	var errs ValidationErrors
+	errors.As(err, &errs)
+	var got []string
+	for _, e := range errs {
+		if strings.HasPrefix(e.Field, "secrets.") || strings.HasPrefix(e.Field, "[0].vars.") {
+			got = append(got, e.Field+": "+e.Message)
+		}
+	}
+	want := []string{
+		"[0].vars.cipassword: cipassword is a secret and cannot be overridden",
+		`secrets.bad.env: invalid environment variable name "PVE-CTGEN"`,
+		"secrets.empty: env or file is required",
+		"secrets.token: also defined in vars",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("errors %q, want %q", got, want)
+	}
+}